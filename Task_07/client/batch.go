@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A batch file holds one JSON message per line, for example
+//
+//	{"type": "text", "text": "hello"}
+//	{"type": "command", "command": "status", "parameter": "all"}
+//	{"type": "data", "field1": 7, "field2": 1.5, "field3": "sensor"}
+//
+// Blank lines are skipped. The messages are sent in order over one
+// connection and the replies are reported as a JSON document on stdout.
+// The batch stops at the first failure unless -continue-on-error is given,
+// and always stops when a reply does not arrive, since a late reply would
+// be taken for the answer to the next message.
+const maxBatchLine = 1 << 20
+
+var errNoReply = errors.New("no reply")
+
+type batchMessage struct {
+	Type      string   `json:"type"`
+	Text      string   `json:"text"`
+	Command   string   `json:"command"`
+	Parameter string   `json:"parameter"`
+	Field1    *uint32  `json:"field1"`
+	Field2    *float64 `json:"field2"`
+	Field3    string   `json:"field3"`
+}
+
+type batchResult struct {
+	Line     int    `json:"line"`
+	Type     string `json:"type,omitempty"`
+	Accepted bool   `json:"accepted"`
+	Response string `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type batchReport struct {
+	Sent     int           `json:"sent"`
+	Accepted int           `json:"accepted"`
+	Failed   int           `json:"failed"`
+	Skipped  int           `json:"skipped"`
+	Results  []batchResult `json:"results"`
+}
+
+// args turns the message into the arguments of the matching command.
+func (m batchMessage) args() ([]string, error) {
+	switch m.Type {
+	case "text":
+		return []string{"text", m.Text}, nil
+	case "command":
+		return []string{"command", m.Command, m.Parameter}, nil
+	case "data":
+		if m.Field1 == nil || m.Field2 == nil {
+			return nil, errors.New("data messages need field1 and field2")
+		}
+		return []string{"data", strconv.FormatUint(uint64(*m.Field1), 10), strconv.FormatFloat(*m.Field2, 'g', -1, 64), m.Field3}, nil
+	}
+	return nil, fmt.Errorf("unknown message type %q", m.Type)
+}
+
+// runBatch sends the messages in the file named by args, or stdin if there
+// is none or it is "-", and returns the exit code.
+func runBatch(o options, args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: batch [file]")
+		return exitUsage
+	}
+	var input io.Reader = os.Stdin
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error opening batch file:", err)
+			return exitUsage
+		}
+		defer f.Close()
+		input = f
+	}
+
+	c, code := connectScripted(o)
+	if c == nil {
+		return code
+	}
+	defer c.close()
+
+	report := batchReport{Results: []batchResult{}}
+	code = exitOK
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(nil, maxBatchLine)
+	line := 0
+	stopped := false
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if stopped {
+			report.Skipped++
+			continue
+		}
+
+		result, err := sendBatchMessage(c, o, text)
+		result.Line = line
+		report.Results = append(report.Results, result)
+		if err == nil || errors.Is(err, errNoReply) {
+			report.Sent++
+		}
+		if result.Accepted {
+			report.Accepted++
+			continue
+		}
+		report.Failed++
+		if code == exitOK {
+			code = exitRejected
+		}
+		if errors.Is(err, errNoReply) {
+			code = exitNoResponse
+			stopped = true
+		} else if !o.keepGoing {
+			stopped = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading batch file:", err)
+		code = exitUsage
+	}
+
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	return code
+}
+
+// sendBatchMessage sends one line of a batch file. The error is errNoReply
+// if the message went out but the reply did not arrive.
+func sendBatchMessage(c *connection, o options, text string) (batchResult, error) {
+	var m batchMessage
+	var result batchResult
+	if err := json.Unmarshal([]byte(text), &m); err != nil {
+		result.Error = "invalid JSON: " + err.Error()
+		return result, err
+	}
+	result.Type = m.Type
+	args, err := m.args()
+	var send func(net.Conn)
+	if err == nil {
+		send, err = buildCommand(args)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+
+	response, err := exchange(c, send, o.timeout)
+	if err != nil {
+		result.Error = err.Error()
+		return result, fmt.Errorf("%w: %v", errNoReply, err)
+	}
+	result.Response = response
+	result.Accepted = accepted(response)
+	return result, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBatchMessageArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string // nil when the message must be refused
+	}{
+		{`{"type": "text", "text": "hello"}`, []string{"text", "hello"}},
+		{`{"type": "command", "command": "status", "parameter": "all"}`, []string{"command", "status", "all"}},
+		{`{"type": "command", "command": "who"}`, []string{"command", "who", ""}},
+		{`{"type": "data", "field1": 7, "field2": 1.5, "field3": "sensor"}`, []string{"data", "7", "1.5", "sensor"}},
+		{`{"type": "data", "field1": 0, "field2": 0}`, []string{"data", "0", "0", ""}},
+		{`{"type": "data", "field1": 7, "field2": 1e-7}`, []string{"data", "7", "1e-07", ""}},
+		{`{"type": "data", "field2": 1.5}`, nil},
+		{`{"type": "data", "field1": 7}`, nil},
+		{`{"type": "publish"}`, nil},
+		{`{}`, nil},
+	}
+	for _, tt := range tests {
+		var m batchMessage
+		if err := json.Unmarshal([]byte(tt.line), &m); err != nil {
+			t.Fatal(err)
+		}
+		args, err := m.args()
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: args %q", tt.line, args)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(args, tt.want) {
+			t.Errorf("%s: args %q, %v, want %q", tt.line, args, err, tt.want)
+		}
+		if _, err := buildCommand(args); err != nil {
+			t.Errorf("%s: %v", tt.line, err)
+		}
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	addr := textServer(t)
+	ok := `{"type": "text", "text": "hello"}`
+	reject := `{"type": "text", "text": "reject me"}`
+	silent := `{"type": "text", "text": "silent"}`
+	tests := []struct {
+		name      string
+		lines     []string
+		keepGoing bool
+		code      int
+		report    batchReport // without results
+		failed    []int       // lines of the results not accepted
+	}{
+		{"all accepted", []string{ok, "", ok}, false, exitOK, batchReport{Sent: 2, Accepted: 2}, nil},
+		{"empty", nil, false, exitOK, batchReport{}, nil},
+		{"stop on error", []string{ok, reject, ok, ok}, false, exitRejected, batchReport{Sent: 2, Accepted: 1, Failed: 1, Skipped: 2}, []int{2}},
+		{"continue on error", []string{ok, reject, ok}, true, exitRejected, batchReport{Sent: 3, Accepted: 2, Failed: 1}, []int{2}},
+		{"invalid lines are not sent", []string{"{", `{"type": "data", "field1": 1}`, ok}, true, exitRejected, batchReport{Sent: 1, Accepted: 1, Failed: 2}, []int{1, 2}},
+		// A late reply would answer the next message
+		{"no reply always stops", []string{ok, silent, ok}, true, exitNoResponse, batchReport{Sent: 2, Accepted: 1, Failed: 1, Skipped: 1}, []int{2}},
+	}
+	for _, tt := range tests {
+		file := t.TempDir() + "/batch.ndjson"
+		if err := os.WriteFile(file, []byte(strings.Join(tt.lines, "\n")), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		o := scriptedOptions(t, addr)
+		o.keepGoing = tt.keepGoing
+		var code int
+		output := captureOutput(t, &os.Stdout, func() { code = runBatch(o, []string{file}) })
+
+		var report batchReport
+		if err := json.Unmarshal([]byte(output), &report); err != nil {
+			t.Fatalf("%s: report %q: %v", tt.name, output, err)
+		}
+		var failed []int
+		for _, result := range report.Results {
+			if !result.Accepted {
+				failed = append(failed, result.Line)
+			}
+		}
+		results := report.Results
+		report.Results = nil
+		if code != tt.code || !reflect.DeepEqual(report, tt.report) || !slices.Equal(failed, tt.failed) {
+			t.Errorf("%s: exit %d, report %+v failing lines %v, want exit %d, %+v failing lines %v",
+				tt.name, code, report, failed, tt.code, tt.report, tt.failed)
+		}
+		if len(results) != report.Accepted+report.Failed {
+			t.Errorf("%s: %d results for %d messages", tt.name, len(results), report.Accepted+report.Failed)
+		}
+	}
+
+	var code int
+	usage := captureOutput(t, &os.Stderr, func() { code = runBatch(scriptedOptions(t, addr), []string{"a", "b"}) })
+	if code != exitUsage || usage != "usage: batch [file]\n" {
+		t.Errorf("two files: exit %d with %q, want %d", code, usage, exitUsage)
+	}
+}
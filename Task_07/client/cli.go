@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes of the scripted client. The server's reply is free text, so a
+// message counts as accepted when the reply is one of acceptedResponses.
+const (
+	exitOK             = 0
+	exitRejected       = 1
+	exitUsage          = 2
+	exitConnectFailed  = 3
+	exitAuthFailed     = 4
+	exitNoResponse     = 5
+	defaultReplyWindow = 5 * time.Second
+)
+
+var errNoPassword = errors.New("no password given")
+
+// options are the command line settings shared by the interactive and the
+// scripted client.
+type options struct {
+	addr         string
+	username     string
+	passwordEnv  string
+	passwordFile string
+	timeout      time.Duration
+	keepGoing    bool
+	historyPath  string
+
+	// requireSecure refuses servers that agree on no cipher, and
+	// allowPlainPassword sends the password hash to servers that agree on
+	// no key exchange.
+	requireSecure      bool
+	allowPlainPassword bool
+}
+
+func parseOptions(args []string) (options, []string, error) {
+	var o options
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	fs.StringVar(&o.addr, "addr", serverAddress, "server address, unix:path for a Unix socket or udp://host:port for UDP")
+	fs.StringVar(&o.username, "user", "", "username (prompted for if empty)")
+	fs.StringVar(&o.passwordEnv, "password-env", "", "read the password from this environment variable")
+	fs.StringVar(&o.passwordFile, "password-file", "", "read the password from the first line of this file")
+	fs.DurationVar(&o.timeout, "timeout", defaultReplyWindow, "how long a scripted command waits for the server's reply")
+	fs.StringVar(&o.historyPath, "history", defaultHistoryPath(), "file that keeps the line editor's history")
+	fs.BoolVar(&o.keepGoing, "continue-on-error", false, "in batch mode, send the remaining messages after one fails")
+	fs.BoolVar(&o.requireSecure, "require-secure", false, "refuse to log in unless the server agrees on a cipher")
+	fs.BoolVar(&o.allowPlainPassword, "allow-plain-password", false, "send the password hash itself to servers that agree on no key exchange, such as version 7 servers")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: client [flags] [text <message> | command <command> [parameter] | data <field1> <field2> <field3> | batch [file]]\n\n")
+		fmt.Fprintf(fs.Output(), "Without a command the client runs interactively. Exit codes: %d accepted, %d rejected, %d usage, %d connection failed, %d authentication failed, %d no reply.\n\n",
+			exitOK, exitRejected, exitUsage, exitConnectFailed, exitAuthFailed, exitNoResponse)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return o, nil, err
+	}
+	return o, fs.Args(), nil
+}
+
+// credentialPolicy returns the policy the flags ask for. -require-secure
+// wins over -allow-plain-password.
+func (o options) credentialPolicy() credentialPolicy {
+	switch {
+	case o.requireSecure:
+		return requireCipher
+	case o.allowPlainPassword:
+		return allowPlainPassword
+	}
+	return requireKeyed
+}
+
+// password reads the password from the sources named in the options, or
+// prompts for it on reader if there are none.
+func (o options) password(reader *bufio.Reader) (string, error) {
+	switch {
+	case o.passwordEnv != "":
+		password, ok := os.LookupEnv(o.passwordEnv)
+		if !ok {
+			return "", fmt.Errorf("%w: %s is not set", errNoPassword, o.passwordEnv)
+		}
+		return password, nil
+	case o.passwordFile != "":
+		data, err := os.ReadFile(o.passwordFile)
+		if err != nil {
+			return "", err
+		}
+		password, _, _ := strings.Cut(string(data), "\n")
+		return strings.TrimSpace(password), nil
+	}
+	fmt.Print("Enter password: ")
+	password, _ := reader.ReadString('\n')
+	return strings.TrimSpace(password), nil
+}
+
+// buildCommand checks the arguments of a scripted command and returns a
+// function that sends it.
+func buildCommand(args []string) (func(net.Conn), error) {
+	switch args[0] {
+	case "text":
+		if len(args) != 2 {
+			return nil, errors.New("usage: text <message>")
+		}
+		return func(conn net.Conn) { sendMessage(conn, 0x01, args[1]) }, nil
+	case "command":
+		if len(args) != 2 && len(args) != 3 {
+			return nil, errors.New("usage: command <command> [parameter]")
+		}
+		parameter := ""
+		if len(args) == 3 {
+			parameter = args[2]
+		}
+		return func(conn net.Conn) { sendCommandMessage(conn, args[1], parameter) }, nil
+	case "data":
+		if len(args) != 4 {
+			return nil, errors.New("usage: data <field1> <field2> <field3>")
+		}
+		dataField1, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data field 1 %q", args[1])
+		}
+		dataField2, err := strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data field 2 %q", args[2])
+		}
+		return func(conn net.Conn) { sendDataPacket(conn, uint32(dataField1), dataField2, args[3]) }, nil
+	}
+	return nil, fmt.Errorf("unknown command %q", args[0])
+}
+
+// runCommand sends one message without prompting and returns the exit
+// code. It prints the server's reply on stdout and errors on stderr.
+func runCommand(o options, args []string) int {
+	if args[0] == "batch" {
+		return runBatch(o, args[1:])
+	}
+	send, err := buildCommand(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	c, code := connectScripted(o)
+	if c == nil {
+		return code
+	}
+	defer c.close()
+
+	response, err := exchange(c, send, o.timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading server response:", err)
+		return exitNoResponse
+	}
+	fmt.Println(response)
+	if !accepted(response) {
+		return exitRejected
+	}
+	return exitOK
+}
+
+// connectScripted logs in with the credentials from the options, which
+// are not needed if the server identifies the client by peer credentials.
+// It reports failures on stderr and returns a nil connection and the exit
+// code.
+func connectScripted(o options) (*connection, int) {
+	// Without streaming the server sends nothing but replies
+	raw, reader, sess, err := dialServer(o.addr, false, o.credentialPolicy())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error connecting:", err)
+		return nil, exitConnectFailed
+	}
+
+	var passwordHash string
+	if sess.authenticatedAs == "" {
+		code := exitOK
+		if o.username == "" {
+			fmt.Fprintln(os.Stderr, "-user is required with a command")
+			code = exitUsage
+		} else if o.passwordEnv == "" && o.passwordFile == "" {
+			fmt.Fprintln(os.Stderr, "-password-env or -password-file is required with a command")
+			code = exitUsage
+		} else if password, err := o.password(nil); err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading password:", err)
+			code = exitUsage
+		} else {
+			passwordHash = hashPassword(password)
+		}
+		if code != exitOK {
+			raw.Close()
+			return nil, code
+		}
+	}
+	c, err := login(raw, reader, sess, o.username, passwordHash)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, errAuthenticationFailed) {
+			return nil, exitAuthFailed
+		}
+		return nil, exitConnectFailed
+	}
+	return c, exitOK
+}
+
+// exchange sends one message and waits up to timeout for the reply.
+func exchange(c *connection, send func(net.Conn), timeout time.Duration) (string, error) {
+	send(c.conn)
+	c.raw.SetReadDeadline(time.Now().Add(timeout))
+	return readResponse(c.reader)
+}
+
+// acceptedResponses are the server's replies to the messages the scripted
+// client sends when it took them. A command's reply may be followed by
+// its output after ": ".
+var acceptedResponses = []string{
+	"Text message received successfully",
+	"Command message received successfully",
+	"Data packet received successfully",
+}
+
+func accepted(response string) bool {
+	for _, reply := range acceptedResponses {
+		if response == reply || strings.HasPrefix(response, reply+": ") {
+			return true
+		}
+	}
+	return false
+}
+
+// readResponse reads a 0x05 server response.
+func readResponse(reader *bufio.Reader) (string, error) {
+	messageType, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if messageType != 0x05 {
+		return "", fmt.Errorf("unexpected message type %d", messageType)
+	}
+	return readLengthPrefixedString(reader)
+}
+
+// runInteractive logs in and runs the REPL.
+func runInteractive(o options) int {
+	raw, connReader, sess, err := dialServer(o.addr, true, o.credentialPolicy())
+	if err != nil {
+		fmt.Println("Error connecting:", err.Error())
+		return exitConnectFailed
+	}
+	fmt.Printf("Connected to %s using protocol version %d\n", sess.serverIdentity, sess.version)
+	if sess.version >= 8 {
+		fmt.Println("Negotiated features:", sess.features)
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+
+	username := o.username
+	var hashedPassword string
+	if sess.authenticatedAs != "" {
+		username = sess.authenticatedAs
+		fmt.Println("Identified by peer credentials as", username)
+	} else {
+		if username == "" {
+			fmt.Print("Enter username: ")
+			username, _ = reader.ReadString('\n')
+			username = strings.TrimSpace(username)
+		}
+		password, err := o.password(reader)
+		if err != nil {
+			fmt.Println("Error reading password:", err)
+			raw.Close()
+			return exitUsage
+		}
+		hashedPassword = hashPassword(password)
+		fmt.Println("Hashed password:", hashedPassword)
+	}
+
+	first, err := login(raw, connReader, sess, username, hashedPassword)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("Authentication failed, exiting.")
+		return exitAuthFailed
+	}
+	fmt.Println("Authentication successful")
+
+	conn := newReconnectingConn(first, o.addr, o.credentialPolicy(), username, hashedPassword, receiveAndParseMessages, printStateChange)
+	defer conn.Close()
+	go acknowledgeInboxItems(conn)
+
+	runREPL(conn, reader, o.historyPath)
+	return exitOK
+}
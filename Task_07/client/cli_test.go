@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccepted(t *testing.T) {
+	tests := map[string]bool{
+		"Text message received successfully":              true,
+		"Command message received successfully":           true,
+		"Command message received successfully: 3m2s":     true,
+		"Data packet received successfully":               true,
+		"Invalid text message checksum":                   false,
+		"Command message received successfully, but late": false,
+		"Unknown message type: not received successfully": false,
+		"": false,
+	}
+	for response, want := range tests {
+		if got := accepted(response); got != want {
+			t.Errorf("accepted(%q) = %v, want %v", response, got, want)
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	defaults, _, err := parseOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(change func(*options)) options {
+		o := defaults
+		change(&o)
+		return o
+	}
+	tests := []struct {
+		args []string
+		want options
+		rest []string
+	}{
+		{nil, defaults, nil},
+		{[]string{"-addr", "unix:/tmp/s", "-user", "user1", "text", "hi"},
+			with(func(o *options) { o.addr, o.username = "unix:/tmp/s", "user1" }), []string{"text", "hi"}},
+		{[]string{"-password-env", "PW", "-timeout", "2s", "command", "who"},
+			with(func(o *options) { o.passwordEnv, o.timeout = "PW", 2*time.Second }), []string{"command", "who"}},
+		{[]string{"-password-file", "pw.txt", "-continue-on-error", "batch", "-"},
+			with(func(o *options) { o.passwordFile, o.keepGoing = "pw.txt", true }), []string{"batch", "-"}},
+		// Flags end at the first argument that is not one
+		{[]string{"data", "1", "-2.5", "x"}, defaults, []string{"data", "1", "-2.5", "x"}},
+	}
+	for _, tt := range tests {
+		o, rest, err := parseOptions(tt.args)
+		if err != nil {
+			t.Errorf("%v: %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(o, tt.want) || !slices.Equal(rest, tt.rest) {
+			t.Errorf("%v: parsed %+v with %q, want %+v with %q", tt.args, o, rest, tt.want, tt.rest)
+		}
+	}
+
+	for _, args := range [][]string{{"-no-such-flag"}, {"-timeout", "soon"}} {
+		var err error
+		usage := captureOutput(t, &os.Stderr, func() { _, _, err = parseOptions(args) })
+		if err == nil || !strings.Contains(usage, "5 no reply") {
+			t.Errorf("%v: parsed, or printed usage %q", args, usage)
+		}
+	}
+}
+
+func TestPasswordSources(t *testing.T) {
+	file := t.TempDir() + "/password"
+	if err := os.WriteFile(file, []byte(" from file \nsecond line\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CLIENT_TEST_PASSWORD", "from env")
+	tests := []struct {
+		name string
+		o    options
+		want string
+		ok   bool
+	}{
+		{"environment", options{passwordEnv: "CLIENT_TEST_PASSWORD"}, "from env", true},
+		{"unset variable", options{passwordEnv: "CLIENT_TEST_UNSET"}, "", false},
+		{"file", options{passwordFile: file}, "from file", true},
+		{"missing file", options{passwordFile: file + ".missing"}, "", false},
+		{"environment before file", options{passwordEnv: "CLIENT_TEST_PASSWORD", passwordFile: file}, "from env", true},
+	}
+	for _, tt := range tests {
+		got, err := tt.o.password(nil)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("%s: password() = %q, %v", tt.name, got, err)
+		}
+	}
+}
+
+// recordingConn keeps what is written to it.
+type recordingConn struct {
+	net.Conn
+	written []byte
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.written = append(c.written, p...)
+	return len(p), nil
+}
+
+func TestBuildCommand(t *testing.T) {
+	u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+	frame := func(parts ...[]byte) []byte { return appendChecksum(bytes.Join(parts, nil)) }
+	tests := []struct {
+		args []string
+		want []byte // nil when the arguments must be refused
+	}{
+		{[]string{"text", "hello"}, frame([]byte{0x01}, u32(5), []byte("hello"))},
+		{[]string{"text", ""}, frame([]byte{0x01}, u32(0))},
+		{[]string{"command", "who"}, frame([]byte{0x02}, u32(3), []byte("who"), u32(0))},
+		{[]string{"command", "echo", "hi"}, frame([]byte{0x02}, u32(4), []byte("echo"), u32(2), []byte("hi"))},
+		{[]string{"data", "7", "1.5", "x"},
+			frame([]byte{0x03}, u32(7), binary.BigEndian.AppendUint64(nil, math.Float64bits(1.5)), u32(1), []byte("x"))},
+
+		{[]string{"text"}, nil},
+		{[]string{"text", "a", "b"}, nil},
+		{[]string{"command"}, nil},
+		{[]string{"command", "a", "b", "c"}, nil},
+		{[]string{"data", "7", "1.5"}, nil},
+		{[]string{"data", "-1", "1.5", "x"}, nil},
+		{[]string{"data", "4294967296", "1.5", "x"}, nil},
+		{[]string{"data", "7", "many", "x"}, nil},
+		{[]string{"publish", "news"}, nil},
+	}
+	for _, tt := range tests {
+		send, err := buildCommand(tt.args)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: accepted", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+			continue
+		}
+		conn := &recordingConn{}
+		send(conn)
+		if !bytes.Equal(conn.written, tt.want) {
+			t.Errorf("%q sent %x, want %x", tt.args, conn.written, tt.want)
+		}
+	}
+}
+
+// textServer is a version 7 server that answers text frames: a text
+// starting with "silent" gets no reply, one starting with "reject" is
+// refused and any other is taken.
+func textServer(t *testing.T) string {
+	return legacyServer(t, func(conn net.Conn, reader *bufio.Reader) {
+		for {
+			header := make([]byte, 5)
+			if _, err := io.ReadFull(reader, header); err != nil || header[0] != 0x01 {
+				return
+			}
+			text := make([]byte, binary.BigEndian.Uint32(header[1:])+4)
+			if _, err := io.ReadFull(reader, text); err != nil {
+				return
+			}
+			response := "Text message received successfully"
+			switch {
+			case bytes.HasPrefix(text, []byte("silent")):
+				continue
+			case bytes.HasPrefix(text, []byte("reject")):
+				response = "Invalid text message checksum"
+			}
+			reply := binary.BigEndian.AppendUint32([]byte{0x05}, uint32(len(response)))
+			conn.Write(append(reply, response...))
+		}
+	})
+}
+
+// captureOutput returns what fn writes to *file, os.Stdout or os.Stderr.
+func captureOutput(t *testing.T, file **os.File, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := *file
+	*file = w
+	out := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- data
+	}()
+	defer func() { *file = saved }()
+	fn()
+	w.Close()
+	return string(<-out)
+}
+
+// scriptedOptions are the options of a scripted client logging in to addr.
+func scriptedOptions(t *testing.T, addr string) options {
+	t.Setenv("CLIENT_TEST_PASSWORD", "password")
+	return options{
+		addr:               addr,
+		username:           "user1",
+		passwordEnv:        "CLIENT_TEST_PASSWORD",
+		timeout:            200 * time.Millisecond,
+		allowPlainPassword: true,
+	}
+}
+
+func TestRunCommandExitCodes(t *testing.T) {
+	addr := textServer(t)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		change func(*options)
+		args   []string
+		want   int
+		output string
+	}{
+		{"accepted", nil, []string{"text", "hello"}, exitOK, "Text message received successfully\n"},
+		{"rejected", nil, []string{"text", "reject me"}, exitRejected, "Invalid text message checksum\n"},
+		{"no reply", nil, []string{"text", "silent"}, exitNoResponse, ""},
+		{"bad arguments", nil, []string{"text"}, exitUsage, ""},
+		{"no user", func(o *options) { o.username = "" }, []string{"text", "hello"}, exitUsage, ""},
+		{"no password source", func(o *options) { o.passwordEnv = "" }, []string{"text", "hello"}, exitUsage, ""},
+		{"unreachable", func(o *options) { o.addr = closedAddr }, []string{"text", "hello"}, exitConnectFailed, ""},
+		{"no key exchange", func(o *options) { o.allowPlainPassword = false }, []string{"text", "hello"}, exitConnectFailed, ""},
+	}
+	for _, tt := range tests {
+		o := scriptedOptions(t, addr)
+		if tt.change != nil {
+			tt.change(&o)
+		}
+		var code int
+		var output string
+		stderr := captureOutput(t, &os.Stderr, func() {
+			output = captureOutput(t, &os.Stdout, func() { code = runCommand(o, tt.args) })
+		})
+		if code != tt.want || output != tt.output {
+			t.Errorf("%s: exit %d with %q, want %d with %q", tt.name, code, output, tt.want, tt.output)
+		}
+		// Failures are explained on stderr
+		if (stderr == "") != (code == exitOK || code == exitRejected) {
+			t.Errorf("%s: stderr %q", tt.name, stderr)
+		}
+	}
+}
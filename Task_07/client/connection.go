@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	errAuthenticationFailed = errors.New("authentication failed")
+	errInsecureChannel      = errors.New("insecure channel")
+)
+
+// credentialPolicy says what the server must agree on before the client
+// sends credentials.
+type credentialPolicy int
+
+const (
+	// requireKeyed, the default, never sends the password hash itself, only
+	// a proof of it, so the server must agree on a key exchange. Otherwise a
+	// relay could strip the keyed features from the hellos and read the
+	// hash off the wire.
+	requireKeyed credentialPolicy = iota
+	// requireCipher also needs the frames to be encrypted.
+	requireCipher
+	// allowPlainPassword sends the password hash to servers that agree on
+	// no key exchange, such as those speaking version 7.
+	allowPlainPassword
+)
+
+// connection is one authenticated connection to the server.
+type connection struct {
+	raw           net.Conn
+	conn          net.Conn // wraps raw in envelopes from version 8
+	reader        *bufio.Reader
+	session       *session
+	retransmitter *retransmitter
+}
+
+// dialServer connects to the server and runs the hello exchange. An
+// address of the form unix:path is a Unix socket, and udp://host:port
+// uses the datagram transport. It hangs up before any credentials are
+// sent if the server agreed on less than policy asks for.
+func dialServer(addr string, streaming bool, policy credentialPolicy) (net.Conn, *bufio.Reader, *session, error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+	}
+	var raw net.Conn
+	var err error
+	if hostPort, ok := strings.CutPrefix(addr, "udp://"); ok {
+		raw, err = dialUDP(hostPort)
+	} else {
+		raw, err = net.Dial(network, addr)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	reader := bufio.NewReader(raw)
+	sess, err := negotiateProtocol(raw, reader, streaming)
+	if err != nil {
+		raw.Close()
+		return nil, nil, nil, fmt.Errorf("negotiating protocol: %w", err)
+	}
+	switch {
+	case policy == requireCipher && !sess.features.secure():
+		raw.Close()
+		return nil, nil, nil, fmt.Errorf("%w: %s agreed no cipher, speaking version %d with %s", errInsecureChannel, sess.serverIdentity, sess.version, sess.features)
+	case policy == requireKeyed && !sess.features.keyed() && sess.authenticatedAs == "":
+		raw.Close()
+		return nil, nil, nil, fmt.Errorf("%w: %s agreed no key exchange, speaking version %d with %s, so logging in would send the password hash in the clear (-allow-plain-password permits it)",
+			errInsecureChannel, sess.serverIdentity, sess.version, sess.features)
+	}
+	return raw, reader, sess, nil
+}
+
+// login authenticates on a connection returned by dialServer and sets up
+// the envelopes the session agreed on. It closes raw if it fails.
+func login(raw net.Conn, reader *bufio.Reader, sess *session, username, passwordHash string) (*connection, error) {
+	c, err := authenticate(raw, reader, sess, username, passwordHash)
+	if err != nil {
+		raw.Close()
+	}
+	return c, err
+}
+
+func authenticate(raw net.Conn, reader *bufio.Reader, sess *session, username, passwordHash string) (*connection, error) {
+	// Peer credentials stand in for the username and password
+	if sess.authenticatedAs == "" {
+		credentials := username + "\n"
+		if sess.features.keyed() {
+			// Prove knowledge of the password hash without sending it
+			credentials += authProof(passwordHash, sess) + "\n"
+		} else {
+			credentials += passwordHash + "\n"
+		}
+		if _, err := raw.Write([]byte(credentials)); err != nil {
+			return nil, err
+		}
+	}
+
+	authResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(authResponse) != "Authentication successful" {
+		return nil, fmt.Errorf("%w: %s", errAuthenticationFailed, strings.TrimSpace(authResponse))
+	}
+
+	c := &connection{raw: raw, conn: raw, reader: reader, session: sess}
+	if sess.version >= 8 {
+		// Frames travel in envelopes from here on
+		codec, err := newFrameCodec(sess, passwordHash)
+		if err != nil {
+			return nil, fmt.Errorf("setting up frame codec: %w", err)
+		}
+		envelopes := &envelopeConn{Conn: raw, codec: codec}
+		if sess.features.acknowledgements {
+			// Dropping the connection hands the unacknowledged frames to
+			// whoever reconnects, or fails the wait for a reply
+			envelopes.retransmitter = newRetransmitter(envelopes.writeEnvelope, func(err error) {
+				fmt.Println("Giving up on the connection:", err)
+				raw.Close()
+			})
+		}
+		c.conn = envelopes
+		c.retransmitter = envelopes.retransmitter
+		c.reader = bufio.NewReader(&envelopeReader{codec: codec, reader: reader, retransmitter: envelopes.retransmitter})
+	}
+	return c, nil
+}
+
+// close closes the connection and returns the frames the server never
+// acknowledged, oldest first.
+func (c *connection) close() [][]byte {
+	c.raw.Close()
+	if c.retransmitter == nil {
+		return nil
+	}
+	return c.retransmitter.close()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestDialServerCredentialPolicy(t *testing.T) {
+	// A version 7 server agrees on no key exchange, which is also what a
+	// relay stripping the keyed features from the hellos looks like
+	addr := legacyServer(t, func(net.Conn, *bufio.Reader) {})
+	tests := []struct {
+		name   string
+		policy credentialPolicy
+		ok     bool
+	}{
+		{"default", requireKeyed, false},
+		{"require secure", requireCipher, false},
+		{"allow plain password", allowPlainPassword, true},
+	}
+	for _, tt := range tests {
+		raw, _, _, err := dialServer(addr, false, tt.policy)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+				continue
+			}
+			raw.Close()
+		} else if !errors.Is(err, errInsecureChannel) {
+			t.Errorf("%s: %v, want errInsecureChannel", tt.name, err)
+		}
+	}
+}
+
+func TestCredentialPolicyFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want credentialPolicy
+	}{
+		{nil, requireKeyed},
+		{[]string{"-require-secure"}, requireCipher},
+		{[]string{"-allow-plain-password"}, allowPlainPassword},
+		{[]string{"-allow-plain-password", "-require-secure"}, requireCipher},
+	}
+	for _, tt := range tests {
+		o, _, err := parseOptions(tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := o.credentialPolicy(); got != tt.want {
+			t.Errorf("%v: policy %d, want %d", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"../protocol"
+)
+
+// From protocol version 8 every frame after authentication travels in an
+// envelope:
+//
+//	[type uint8][flags uint8][payload length uint32][payload][trailer]
+//
+// Version 9 adds the frame's sequence number after the flags:
+//
+//	[type uint8][flags uint8][sequence uint64][payload length uint32][payload][trailer]
+//
+// The payload is the version 7 body of the frame without its own checksum;
+// the trailer, whose length depends on the negotiated integrity algorithm,
+// covers the header and the payload as sent. On a secure channel the
+// payload is encrypted in place and the AEAD tag is the trailer.
+const envelopeHeaderSize = 1 + 1 + 4
+
+// Envelope flags.
+const (
+	flagCompressed = 1 << iota
+)
+
+// Features this client supports, in order of preference.
+var (
+	supportedCompression = []string{protocol.CompressionDeflate, protocol.CompressionGzip}
+	supportedChecksums   = []string{protocol.ChecksumHMACSHA256, protocol.ChecksumCRC32C, protocol.ChecksumCRC32IEEE}
+)
+
+const defaultMaxFrameSize = 16 * 1024 * 1024
+
+var errFrameRejected = errors.New("frame rejected")
+
+// features is the set of optional protocol features agreed with the
+// server. Where several algorithms are agreed, the first is the one in use.
+type features struct {
+	compression  []string
+	checksums    []string
+	ciphers      []string
+	maxFrameSize uint32
+	streaming    bool
+
+	// acknowledgements has the server acknowledge every frame it receives.
+	// It needs the sequence numbers of version 9.
+	acknowledgements bool
+}
+
+// legacyFeatures describes a version 7 connection.
+var legacyFeatures = features{
+	checksums:    []string{protocol.ChecksumCRC32IEEE},
+	maxFrameSize: defaultMaxFrameSize,
+	streaming:    true,
+}
+
+// acceptFeatures checks that the features in the server's hello are a
+// subset of what the client offered.
+func acceptFeatures(reply hello) (features, error) {
+	for _, algorithm := range reply.Compression {
+		if !slices.Contains(supportedCompression, algorithm) {
+			return features{}, fmt.Errorf("server chose unsupported compression %q", algorithm)
+		}
+	}
+	for _, algorithm := range reply.Checksums {
+		if !slices.Contains(supportedChecksums, algorithm) {
+			return features{}, fmt.Errorf("server chose unsupported checksum %q", algorithm)
+		}
+	}
+	for _, name := range reply.Ciphers {
+		if !slices.Contains(supportedCiphers, name) {
+			return features{}, fmt.Errorf("server chose unsupported cipher %q", name)
+		}
+	}
+	if len(reply.Checksums) == 0 {
+		return features{}, errors.New("server agreed no checksum algorithm")
+	}
+	if reply.Checksums[0] == protocol.ChecksumHMACSHA256 && len(reply.Ciphers) > 0 {
+		return features{}, errors.New("server chose HMAC integrity alongside a cipher")
+	}
+	if reply.MaxFrameSize == 0 || reply.MaxFrameSize > defaultMaxFrameSize {
+		return features{}, fmt.Errorf("server chose invalid maximum frame size %d", reply.MaxFrameSize)
+	}
+	if reply.Acks && reply.Version < 9 {
+		return features{}, fmt.Errorf("server chose acknowledgements at version %d", reply.Version)
+	}
+	return features{
+		compression:      reply.Compression,
+		checksums:        reply.Checksums,
+		ciphers:          reply.Ciphers,
+		maxFrameSize:     reply.MaxFrameSize,
+		streaming:        reply.Streaming,
+		acknowledgements: reply.Acks,
+	}, nil
+}
+
+func (f features) String() string {
+	compression := "none"
+	if len(f.compression) > 0 {
+		compression = strings.Join(f.compression, ",")
+	}
+	ciphers := "none"
+	if f.secure() {
+		ciphers = strings.Join(f.ciphers, ",")
+	}
+	return fmt.Sprintf("compression=%s checksums=%s ciphers=%s max-frame-size=%d streaming=%t acknowledgements=%t",
+		compression, strings.Join(f.checksums, ","), ciphers, f.maxFrameSize, f.streaming, f.acknowledgements)
+}
+
+// secure reports whether frames are encrypted.
+func (f features) secure() bool {
+	return len(f.ciphers) > 0
+}
+
+// keyed reports whether the hellos carry a key exchange, which both a
+// cipher and HMAC integrity need.
+func (f features) keyed() bool {
+	return f.secure() || f.checksums[0] == protocol.ChecksumHMACSHA256
+}
+
+// allowedFlags returns the envelope flags the negotiated features permit.
+func (f features) allowedFlags() byte {
+	var flags byte
+	if len(f.compression) > 0 {
+		flags |= flagCompressed
+	}
+	return flags
+}
+
+// frameCodec encodes and decodes envelopes under the negotiated features.
+// Frames must be encoded and decoded in the order they travel, since they
+// are numbered.
+type frameCodec struct {
+	features  features
+	integrity protocol.Integrity
+	channel   *protocol.SecureChannel
+	sequenced bool
+
+	sendSeq uint64
+	recvSeq uint64 // counts received frames when they carry no number
+	lastSeq uint64 // number of the last frame decoded
+	window  *protocol.ReplayWindow
+}
+
+// newFrameCodec returns the codec for a session once the user has
+// authenticated, which is when the session keys can be derived.
+func newFrameCodec(s *session, passwordHash string) (*frameCodec, error) {
+	check := protocol.Integrity{Algorithm: s.features.checksums[0]}
+	if check.Algorithm == protocol.ChecksumHMACSHA256 {
+		clientKey, serverKey, err := s.sessionKeys("integrity", passwordHash)
+		if err != nil {
+			return nil, err
+		}
+		check.SendKey, check.RecvKey = clientKey, serverKey
+	}
+	c := &frameCodec{
+		features:  s.features,
+		integrity: check,
+		sequenced: s.version >= 9,
+		window:    protocol.NewReplayWindow(),
+	}
+	if s.features.secure() {
+		var err error
+		c.channel, err = newSecureChannel(s, passwordHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *frameCodec) headerSize() int {
+	if c.sequenced {
+		return envelopeHeaderSize + 8
+	}
+	return envelopeHeaderSize
+}
+
+func (c *frameCodec) trailerSize() int {
+	if c.channel != nil {
+		return c.channel.Overhead()
+	}
+	return c.integrity.Size()
+}
+
+// encode wraps a frame, given as its type byte and body, in an envelope.
+func (c *frameCodec) encode(frame []byte) ([]byte, error) {
+	if len(frame) == 0 {
+		return nil, errors.New("empty frame")
+	}
+	payload := frame[1:]
+	if uint64(len(payload)) > uint64(c.features.maxFrameSize) {
+		return nil, fmt.Errorf("%w: payload of %d bytes exceeds the maximum frame size %d", errFrameRejected, len(payload), c.features.maxFrameSize)
+	}
+
+	var flags byte
+	if len(c.features.compression) > 0 && len(payload) >= protocol.CompressionThreshold {
+		compressed, err := protocol.Compress(c.features.compression[0], payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(payload) {
+			payload = compressed
+			flags |= flagCompressed
+		}
+	}
+
+	c.sendSeq++
+	buf := append(make([]byte, 0, c.headerSize()+len(payload)+c.trailerSize()), frame[0], flags)
+	if c.sequenced {
+		buf = binary.BigEndian.AppendUint64(buf, c.sendSeq)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	if c.channel != nil {
+		return c.channel.Seal(buf, c.sendSeq, payload), nil
+	}
+	buf = append(buf, payload...)
+	return append(buf, c.integrity.Seal(buf)...), nil
+}
+
+// decode reads one envelope and returns the frame type and payload. A
+// frame whose trailer fails the integrity check is consumed and reported
+// with an *protocol.IntegrityError, and one the replay window refuses with a
+// *protocol.ReplayError.
+func (c *frameCodec) decode(reader *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, c.headerSize())
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	messageType, flags := header[0], header[1]
+	if unsupported := flags &^ c.features.allowedFlags(); unsupported != 0 {
+		return 0, nil, fmt.Errorf("%w: unsupported flags %#02x", errFrameRejected, unsupported)
+	}
+	length := binary.BigEndian.Uint32(header[len(header)-4:])
+	if length > c.features.maxFrameSize {
+		return 0, nil, fmt.Errorf("%w: payload of %d bytes exceeds the maximum frame size %d", errFrameRejected, length, c.features.maxFrameSize)
+	}
+
+	rest := make([]byte, int(length)+c.trailerSize())
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return 0, nil, err
+	}
+	c.recvSeq++
+	seq := c.recvSeq
+	if c.sequenced {
+		seq = binary.BigEndian.Uint64(header[2:])
+	}
+	var payload []byte
+	if c.channel != nil {
+		var ok bool
+		payload, ok = c.channel.Open(header, seq, rest)
+		if !ok {
+			return 0, nil, &protocol.IntegrityError{Algorithm: c.channel.Name, MessageType: messageType, Seq: seq}
+		}
+	} else {
+		payload = rest[:length]
+		if !c.integrity.Verify(append(header, payload...), rest[length:]) {
+			return 0, nil, &protocol.IntegrityError{Algorithm: c.integrity.Algorithm, MessageType: messageType, Seq: seq}
+		}
+	}
+	if c.sequenced {
+		// Only numbers from frames that passed the check can move the window
+		if err := c.window.Accept(seq); err != nil {
+			return 0, nil, err
+		}
+	}
+	c.lastSeq = seq
+	if flags&flagCompressed != 0 {
+		var err error
+		payload, err = protocol.Decompress(c.features.compression[0], payload, protocol.DecompressionLimit(len(payload), c.features.maxFrameSize))
+		if err != nil {
+			return 0, nil, fmt.Errorf("%w: %v", errFrameRejected, err)
+		}
+	}
+	return messageType, payload, nil
+}
+
+// envelopeReader turns a stream of envelopes back into the frames that
+// receiveAndParseMessages decodes. Frames failing their integrity check or
+// replayed are dropped, and acknowledgements go to the retransmitter.
+type envelopeReader struct {
+	codec         *frameCodec
+	reader        *bufio.Reader
+	retransmitter *retransmitter
+	pending       []byte
+}
+
+func (r *envelopeReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		messageType, payload, err := r.codec.decode(r.reader)
+		if protocol.DroppedFrame(err) {
+			fmt.Println("Dropped frame:", err)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if r.retransmitter != nil && (messageType == frameAck || messageType == frameNack) {
+			if len(payload) == 8 {
+				r.retransmitter.acknowledged(binary.BigEndian.Uint64(payload), messageType == frameAck)
+			}
+			continue
+		}
+		r.pending = append([]byte{messageType}, payload...)
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// envelopeConn wraps every frame written to it in an envelope. Each Write
+// must carry exactly one frame with its version 7 checksum, which the
+// envelope trailer replaces. With a retransmitter, every envelope is kept
+// until the server acknowledges it.
+type envelopeConn struct {
+	net.Conn
+	codec         *frameCodec
+	retransmitter *retransmitter
+
+	// writeMu keeps envelopes in the order they were numbered.
+	writeMu sync.Mutex
+}
+
+func (c *envelopeConn) Write(frame []byte) (int, error) {
+	if len(frame) < 1+4 {
+		return 0, errors.New("frame too short")
+	}
+	if c.retransmitter != nil {
+		if err := c.retransmitter.reserve(); err != nil {
+			return 0, err
+		}
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	buf, err := c.codec.encode(frame[:len(frame)-4])
+	if err != nil {
+		if c.retransmitter != nil {
+			c.retransmitter.release()
+		}
+		return 0, err
+	}
+	if c.retransmitter != nil {
+		if err := c.retransmitter.track(c.codec.sendSeq, frame, buf); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(frame), nil
+}
+
+// writeEnvelope sends an envelope that was encoded earlier.
+func (c *envelopeConn) writeEnvelope(buf []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(buf)
+	return err
+}
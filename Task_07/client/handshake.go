@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"../protocol"
+)
+
+// The client speaks protocol versions in this range. Versions are numbered
+// after the task that introduced the wire format.
+const (
+	minProtocolVersion = 7
+	maxProtocolVersion = 9
+	clientIdentity     = "Task_07 client"
+	maxHelloSize       = 64 * 1024
+)
+
+var helloMagic = []byte("GSPH")
+
+var (
+	errIncompatibleVersion = errors.New("incompatible protocol version")
+	errInvalidChecksum     = errors.New("invalid checksum")
+)
+
+// hello is exchanged before authentication. On the wire it is
+//
+//	[magic "GSPH"][body length uint32][TLV body][checksum uint32]
+type hello struct {
+	MinVersion   uint16   `tlv:"1"`
+	MaxVersion   uint16   `tlv:"2"`
+	Identity     string   `tlv:"3,omitempty"`
+	Version      uint16   `tlv:"4,omitempty"`
+	Error        string   `tlv:"5,omitempty"`
+	Compression  []string `tlv:"6"`
+	Checksums    []string `tlv:"7"`
+	MaxFrameSize uint32   `tlv:"8,omitempty"`
+	Streaming    bool     `tlv:"9,omitempty"`
+	Nonce        []byte   `tlv:"10,omitempty"`
+	Ciphers      []string `tlv:"11"`
+	KeyShare     []byte   `tlv:"12,omitempty"`
+	Acks         bool     `tlv:"13,omitempty"`
+
+	// Authenticated names the user the server identified by peer
+	// credentials. The client then sends no credentials.
+	Authenticated string `tlv:"14,omitempty"`
+}
+
+const helloNonceSize = 16
+
+// session describes the connection to the server as agreed in the hello
+// exchange.
+type session struct {
+	serverIdentity string
+	version        uint16
+	features       features
+
+	// Both hellos as sent, nonces and key shares included, which the
+	// transcript covers.
+	clientHello []byte
+	serverHello []byte
+
+	// Set when a cipher or HMAC integrity was agreed.
+	sharedSecret []byte
+
+	// authenticatedAs is the user the server identified by peer
+	// credentials, if any.
+	authenticatedAs string
+}
+
+// negotiateProtocol sends the client hello and waits for the server's
+// choice of version and features. It fails if the server rejects the
+// client's offer or answers with something the client did not offer.
+// Without streaming the server only answers the client's own frames.
+func negotiateProtocol(conn net.Conn, reader *bufio.Reader, streaming bool) (*session, error) {
+	nonce := make([]byte, helloNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	body, err := protocol.MarshalTLV(hello{
+		MinVersion:   minProtocolVersion,
+		MaxVersion:   maxProtocolVersion,
+		Identity:     clientIdentity,
+		Compression:  supportedCompression,
+		Checksums:    supportedChecksums,
+		MaxFrameSize: defaultMaxFrameSize,
+		Streaming:    streaming,
+		Nonce:        nonce,
+		Ciphers:      supportedCiphers,
+		KeyShare:     private.PublicKey().Bytes(),
+		Acks:         true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf := append([]byte(nil), helloMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(body)))
+	buf = append(buf, body...)
+	sent := appendChecksum(buf)
+	if _, err := conn.Write(sent); err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(helloMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, helloMagic) {
+		return nil, fmt.Errorf("%w: server does not support the handshake", errIncompatibleVersion)
+	}
+	bodyLengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, bodyLengthBuf); err != nil {
+		return nil, err
+	}
+	bodyLength := binary.BigEndian.Uint32(bodyLengthBuf)
+	if bodyLength > maxHelloSize {
+		return nil, fmt.Errorf("server hello of %d bytes is too large", bodyLength)
+	}
+	rest := make([]byte, bodyLength+4)
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return nil, err
+	}
+	message := append(append(magic, bodyLengthBuf...), rest...)
+	if calculateCRC32(message[:len(message)-4]) != binary.BigEndian.Uint32(message[len(message)-4:]) {
+		return nil, errInvalidChecksum
+	}
+
+	var reply hello
+	if err := protocol.UnmarshalTLV(rest[:bodyLength], &reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("%w: server %q: %s", errIncompatibleVersion, reply.Identity, reply.Error)
+	}
+	if reply.Version < minProtocolVersion || reply.Version > maxProtocolVersion {
+		return nil, fmt.Errorf("%w: server %q chose version %d, client speaks %d-%d",
+			errIncompatibleVersion, reply.Identity, reply.Version, minProtocolVersion, maxProtocolVersion)
+	}
+
+	s := &session{
+		serverIdentity:  reply.Identity,
+		version:         reply.Version,
+		features:        legacyFeatures,
+		clientHello:     sent,
+		serverHello:     message,
+		authenticatedAs: reply.Authenticated,
+	}
+	if reply.Version >= 8 {
+		s.features, err = acceptFeatures(reply)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.features.keyed() {
+		peer, err := ecdh.X25519().NewPublicKey(reply.KeyShare)
+		if err != nil {
+			return nil, fmt.Errorf("server sent an invalid key share: %w", err)
+		}
+		s.sharedSecret, err = private.ECDH(peer)
+		if err != nil {
+			return nil, fmt.Errorf("server sent an invalid key share: %w", err)
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+)
+
+// inboxAcks receives the IDs of inbox items once the frame queued under
+// them has been handled, for acknowledgeInboxItems to confirm.
+var inboxAcks = make(chan uint64, 64)
+
+// sendDirectDataPacket sends a data packet to one user. The server keeps
+// it in the user's inbox if the user is offline.
+func sendDirectDataPacket(conn net.Conn, recipient string, dataField1 uint32, dataField2 float64, dataField3 string) {
+	buf := binary.BigEndian.AppendUint32([]byte{0x14}, uint32(len(recipient)))
+	buf = append(buf, recipient...)
+	buf = binary.BigEndian.AppendUint32(buf, dataField1)
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(dataField2))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(dataField3)))
+	buf = append(buf, dataField3...)
+
+	bufWithChecksum := appendChecksum(buf)
+	conn.Write(bufWithChecksum)
+}
+
+// acknowledgeInboxItems confirms delivered inbox items so the server
+// removes them.
+func acknowledgeInboxItems(conn net.Conn) {
+	for itemID := range inboxAcks {
+		buf := binary.BigEndian.AppendUint64([]byte{0x16}, itemID)
+
+		bufWithChecksum := appendChecksum(buf)
+		conn.Write(bufWithChecksum)
+	}
+}
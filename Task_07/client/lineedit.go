@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads lines from a terminal in raw mode with cursor movement,
+// history and tab completion. Text printed with printAbove while a line is
+// being edited appears above the prompt, and the line is redrawn below it.
+//
+// Keys: left/right, home/end, ctrl-a/e/b/f move; backspace, delete,
+// ctrl-k and ctrl-u delete; up/down walk the history; tab completes;
+// ctrl-c abandons the line; ctrl-d on an empty line ends input.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	complete func(line string) []string
+
+	mu      sync.Mutex
+	editing bool
+	prompt  string
+	line    []rune
+	pos     int
+
+	history []string
+}
+
+func newLineEditor(in *bufio.Reader, out io.Writer, complete func(string) []string) *lineEditor {
+	return &lineEditor{in: in, out: out, complete: complete}
+}
+
+// printAbove prints text, which may span several lines, without corrupting
+// the line being edited.
+func (e *lineEditor) printAbove(text string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	text = strings.ReplaceAll(strings.TrimSuffix(text, "\n"), "\n", "\r\n")
+	if !e.editing {
+		fmt.Fprint(e.out, text+"\r\n")
+		return
+	}
+	fmt.Fprint(e.out, "\r\x1b[K"+text+"\r\n")
+	e.redrawLocked()
+}
+
+func (e *lineEditor) redrawLocked() {
+	fmt.Fprint(e.out, "\r\x1b[K"+e.prompt+string(e.line))
+	if back := len(e.line) - e.pos; back > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", back)
+	}
+}
+
+// readLine shows prompt and returns the line entered, io.EOF at the end of
+// input or errInterrupted if the line was abandoned.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	e.mu.Lock()
+	e.editing, e.prompt, e.line, e.pos = true, prompt, nil, 0
+	e.redrawLocked()
+	e.mu.Unlock()
+
+	historyPos := len(e.history)
+	draft := ""
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			e.finish()
+			return "", err
+		}
+
+		e.mu.Lock()
+		switch r {
+		case '\r', '\n':
+			line := string(e.line)
+			e.mu.Unlock()
+			e.finish()
+			return line, nil
+		case 3: // ctrl-c
+			e.mu.Unlock()
+			e.finish()
+			return "", errInterrupted
+		case 4: // ctrl-d
+			if len(e.line) == 0 {
+				e.mu.Unlock()
+				e.finish()
+				return "", io.EOF
+			}
+			e.deleteLocked(e.pos, e.pos+1)
+		case 127, 8: // backspace
+			if e.pos > 0 {
+				e.deleteLocked(e.pos-1, e.pos)
+				e.pos--
+			}
+		case 1: // ctrl-a
+			e.pos = 0
+		case 5: // ctrl-e
+			e.pos = len(e.line)
+		case 2: // ctrl-b
+			e.pos = max(e.pos-1, 0)
+		case 6: // ctrl-f
+			e.pos = min(e.pos+1, len(e.line))
+		case 11: // ctrl-k
+			e.line = e.line[:e.pos]
+		case 21: // ctrl-u
+			e.deleteLocked(0, e.pos)
+			e.pos = 0
+		case '\t':
+			e.completeLocked()
+		case 27: // escape sequence
+			e.mu.Unlock()
+			key := e.readEscape()
+			e.mu.Lock()
+			switch key {
+			case 'A', 'B':
+				if key == 'A' && historyPos > 0 {
+					if historyPos == len(e.history) {
+						draft = string(e.line)
+					}
+					historyPos--
+					e.line = []rune(e.history[historyPos])
+				} else if key == 'B' && historyPos < len(e.history) {
+					historyPos++
+					if historyPos == len(e.history) {
+						e.line = []rune(draft)
+					} else {
+						e.line = []rune(e.history[historyPos])
+					}
+				}
+				e.pos = len(e.line)
+			case 'C':
+				e.pos = min(e.pos+1, len(e.line))
+			case 'D':
+				e.pos = max(e.pos-1, 0)
+			case 'H':
+				e.pos = 0
+			case 'F':
+				e.pos = len(e.line)
+			case '~':
+				e.deleteLocked(e.pos, e.pos+1)
+			}
+		default:
+			if unicode.IsPrint(r) {
+				e.line = append(e.line[:e.pos], append([]rune{r}, e.line[e.pos:]...)...)
+				e.pos++
+			}
+		}
+		e.redrawLocked()
+		e.mu.Unlock()
+	}
+}
+
+// readEscape reads the rest of an escape sequence and returns its final
+// byte, or '~' for delete. Home and end arrive in several forms.
+func (e *lineEditor) readEscape() rune {
+	b, err := e.in.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return 0
+	}
+	var params []byte
+	for {
+		c, err := e.in.ReadByte()
+		if err != nil {
+			return 0
+		}
+		if c >= '0' && c <= '9' || c == ';' {
+			params = append(params, c)
+			continue
+		}
+		if c != '~' {
+			return rune(c)
+		}
+		switch string(params) {
+		case "3":
+			return '~'
+		case "1", "7":
+			return 'H'
+		case "4", "8":
+			return 'F'
+		}
+		return 0
+	}
+}
+
+func (e *lineEditor) deleteLocked(from, to int) {
+	if from < 0 || to > len(e.line) || from >= to {
+		return
+	}
+	e.line = append(e.line[:from], e.line[to:]...)
+}
+
+// completeLocked completes the text before the cursor. A single candidate
+// replaces it; several are extended to their common prefix, or listed if
+// that adds nothing.
+func (e *lineEditor) completeLocked() {
+	if e.complete == nil {
+		return
+	}
+	before := string(e.line[:e.pos])
+	candidates := e.complete(before)
+	if len(candidates) == 0 {
+		return
+	}
+	replacement := candidates[0]
+	if len(candidates) == 1 {
+		replacement += " "
+	} else {
+		for _, c := range candidates[1:] {
+			for !strings.HasPrefix(c, replacement) {
+				replacement = replacement[:len(replacement)-1]
+			}
+		}
+		if len(replacement) <= len(before) {
+			fmt.Fprint(e.out, "\r\x1b[K"+strings.Join(candidates, "  ")+"\r\n")
+			return
+		}
+	}
+	rest := e.line[e.pos:]
+	e.line = append([]rune(replacement), rest...)
+	e.pos = len([]rune(replacement))
+}
+
+func (e *lineEditor) finish() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.editing = false
+	fmt.Fprint(e.out, "\r\n")
+}
+
+// addHistory records a line for the up and down keys.
+func (e *lineEditor) addHistory(line string) {
+	if line == "" || len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+}
+
+// captureStdout sends everything printed to os.Stdout through printAbove
+// until the returned function is called.
+func (e *lineEditor) captureStdout() (func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lines := bufio.NewReader(r)
+		for {
+			line, err := lines.ReadString('\n')
+			if line != "" {
+				e.printAbove(line)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return func() {
+		os.Stdout = stdout
+		w.Close()
+		<-done
+		r.Close()
+	}, nil
+}
@@ -4,12 +4,17 @@ import (
 	"bufio"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"math"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func hashPassword(password string) string {
@@ -74,10 +79,234 @@ func sendDataPacket(conn net.Conn, dataField1 uint32, dataField2 float64, dataFi
 	conn.Write(bufWithChecksum)
 }
 
-func receiveAndParseMessages(conn net.Conn) {
-	for {
-		reader := bufio.NewReader(conn)
+func sendDirectMessage(conn net.Conn, recipient string, text string) {
+	recipientBytes := []byte(recipient)
+	recipientLength := uint32(len(recipientBytes))
+
+	textBytes := []byte(text)
+	textLength := uint32(len(textBytes))
+
+	buf := make([]byte, 1+4+len(recipientBytes)+4+len(textBytes))
+	buf[0] = 0x04
+	binary.BigEndian.PutUint32(buf[1:], recipientLength)
+	copy(buf[5:], recipientBytes)
+	binary.BigEndian.PutUint32(buf[5+len(recipientBytes):], textLength)
+	copy(buf[9+len(recipientBytes):], textBytes)
+
+	bufWithChecksum := appendChecksum(buf)
+	conn.Write(bufWithChecksum)
+}
+
+// sendSubscription sends a subscribe (0x06) or unsubscribe (0x07) request.
+func sendSubscription(conn net.Conn, messageType byte, topic string) {
+	conn.Write(subscriptionFrame(messageType, topic))
+}
+
+func subscriptionFrame(messageType byte, topic string) []byte {
+	topicBytes := []byte(topic)
+	topicLength := uint32(len(topicBytes))
+
+	buf := make([]byte, 1+4+len(topicBytes))
+	buf[0] = messageType
+	binary.BigEndian.PutUint32(buf[1:], topicLength)
+	copy(buf[5:], topicBytes)
 
+	return appendChecksum(buf)
+}
+
+func sendListSubscriptions(conn net.Conn) {
+	bufWithChecksum := appendChecksum([]byte{0x08})
+	conn.Write(bufWithChecksum)
+}
+
+func sendPublish(conn net.Conn, topic string, dataField1 uint32, dataField2 float64, dataField3 string) {
+	topicBytes := []byte(topic)
+	topicLength := uint32(len(topicBytes))
+
+	dataField3Bytes := []byte(dataField3)
+	dataField3Length := uint32(len(dataField3Bytes))
+
+	buf := make([]byte, 1+4+len(topicBytes)+4+8+4+len(dataField3Bytes))
+	buf[0] = 0x09
+	binary.BigEndian.PutUint32(buf[1:], topicLength)
+	copy(buf[5:], topicBytes)
+	offset := 5 + len(topicBytes)
+	binary.BigEndian.PutUint32(buf[offset:], dataField1)
+	binary.BigEndian.PutUint64(buf[offset+4:], math.Float64bits(dataField2))
+	binary.BigEndian.PutUint32(buf[offset+12:], dataField3Length)
+	copy(buf[offset+16:], dataField3Bytes)
+
+	bufWithChecksum := appendChecksum(buf)
+	conn.Write(bufWithChecksum)
+}
+
+const (
+	queryByDataField1 = 1 << iota
+	queryByTime
+	queryBySender
+	queryByDataField3
+)
+
+// packetQuery selects stored data packets. Only the filters whose flag is
+// set are applied by the server.
+type packetQuery struct {
+	flags         byte
+	dataField1Min uint32
+	dataField1Max uint32
+	from          time.Time
+	to            time.Time
+	sender        string
+	dataField3    string
+	limit         uint32
+	cursor        uint64
+}
+
+// appendQueryFilters encodes the filters shared by query and aggregation
+// requests.
+func appendQueryFilters(buf []byte, q packetQuery) []byte {
+	var from, to int64
+	if q.flags&queryByTime != 0 {
+		from = q.from.UnixNano()
+		to = q.to.UnixNano()
+	}
+
+	buf = append(buf, q.flags)
+	buf = binary.BigEndian.AppendUint32(buf, q.dataField1Min)
+	buf = binary.BigEndian.AppendUint32(buf, q.dataField1Max)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(from))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(to))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(q.sender)))
+	buf = append(buf, q.sender...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(q.dataField3)))
+	buf = append(buf, q.dataField3...)
+	return buf
+}
+
+func sendQuery(conn net.Conn, q packetQuery) {
+	buf := appendQueryFilters([]byte{0x0A}, q)
+	buf = binary.BigEndian.AppendUint32(buf, q.limit)
+	buf = binary.BigEndian.AppendUint64(buf, q.cursor)
+
+	bufWithChecksum := appendChecksum(buf)
+	conn.Write(bufWithChecksum)
+}
+
+func sendAggregation(conn net.Conn, q packetQuery, bucketWidth time.Duration, percentile float64) {
+	buf := appendQueryFilters([]byte{0x0C}, q)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(bucketWidth))
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(percentile))
+
+	bufWithChecksum := appendChecksum(buf)
+	conn.Write(bufWithChecksum)
+}
+
+// readQueryFilters asks for the filters of a data packet query or
+// aggregation. Blank answers leave a filter unset.
+func readQueryFilters(ask func(string) string) (packetQuery, error) {
+	var q packetQuery
+
+	if answer := ask("Data field 1 value or range (e.g. 7 or 5-10, blank for any): "); answer != "" {
+		minText, maxText, isRange := strings.Cut(answer, "-")
+		if !isRange {
+			maxText = minText
+		}
+		low, err := strconv.ParseUint(strings.TrimSpace(minText), 10, 32)
+		if err != nil {
+			return q, fmt.Errorf("invalid data field 1: %w", err)
+		}
+		high, err := strconv.ParseUint(strings.TrimSpace(maxText), 10, 32)
+		if err != nil {
+			return q, fmt.Errorf("invalid data field 1: %w", err)
+		}
+		q.flags |= queryByDataField1
+		q.dataField1Min = uint32(low)
+		q.dataField1Max = uint32(high)
+	}
+
+	fromText := ask("Received from (RFC 3339, blank for any): ")
+	toText := ask("Received before (RFC 3339, blank for now): ")
+	if fromText != "" || toText != "" {
+		q.flags |= queryByTime
+		q.to = time.Now()
+		if fromText != "" {
+			from, err := time.Parse(time.RFC3339, fromText)
+			if err != nil {
+				return q, fmt.Errorf("invalid start time: %w", err)
+			}
+			q.from = from
+		}
+		if toText != "" {
+			to, err := time.Parse(time.RFC3339, toText)
+			if err != nil {
+				return q, fmt.Errorf("invalid end time: %w", err)
+			}
+			q.to = to
+		}
+	}
+
+	if q.sender = ask("Sender (blank for any): "); q.sender != "" {
+		q.flags |= queryBySender
+	}
+	if q.dataField3 = ask("Data field 3 contains (blank for any): "); q.dataField3 != "" {
+		q.flags |= queryByDataField3
+	}
+	return q, nil
+}
+
+// readQuery asks for a data packet query and its paging.
+func readQuery(ask func(string) string) (packetQuery, error) {
+	q, err := readQueryFilters(ask)
+	if err != nil {
+		return q, err
+	}
+
+	if answer := ask("Limit (blank for the server default): "); answer != "" {
+		limit, err := strconv.ParseUint(answer, 10, 32)
+		if err != nil {
+			return q, fmt.Errorf("invalid limit: %w", err)
+		}
+		q.limit = uint32(limit)
+	}
+	if answer := ask("Cursor (blank to start from the beginning): "); answer != "" {
+		cursor, err := strconv.ParseUint(answer, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid cursor: %w", err)
+		}
+		q.cursor = cursor
+	}
+	return q, nil
+}
+
+// readAggregation asks for an aggregation's filters, time bucket width and
+// percentile.
+func readAggregation(ask func(string) string) (packetQuery, time.Duration, float64, error) {
+	q, err := readQueryFilters(ask)
+	if err != nil {
+		return q, 0, 0, err
+	}
+
+	var bucketWidth time.Duration
+	if answer := ask("Time bucket width (e.g. 1m or 1h, blank for a single bucket): "); answer != "" {
+		bucketWidth, err = time.ParseDuration(answer)
+		if err != nil || bucketWidth <= 0 {
+			return q, 0, 0, fmt.Errorf("invalid bucket width %q", answer)
+		}
+	}
+
+	percentile := 95.0
+	if answer := ask("Percentile (blank for 95): "); answer != "" {
+		percentile, err = strconv.ParseFloat(answer, 64)
+		if err != nil || percentile < 0 || percentile > 100 {
+			return q, 0, 0, fmt.Errorf("invalid percentile %q", answer)
+		}
+	}
+	return q, bucketWidth, percentile, nil
+}
+
+func receiveAndParseMessages(reader *bufio.Reader) {
+	// inboxItem is the inbox item whose frame comes next
+	var inboxItem uint64
+	for {
 		messageType, err := reader.ReadByte()
 		if err != nil {
 			fmt.Println("Error reading message type:", err)
@@ -87,7 +316,7 @@ func receiveAndParseMessages(conn net.Conn) {
 		switch messageType {
 		case 0x01:
 			lengthBuf := make([]byte, 4)
-			_, err := reader.Read(lengthBuf)
+			_, err := io.ReadFull(reader, lengthBuf)
 			if err != nil {
 				fmt.Println("Error reading text length:", err)
 				return
@@ -95,7 +324,7 @@ func receiveAndParseMessages(conn net.Conn) {
 			textLength := binary.BigEndian.Uint32(lengthBuf)
 
 			text := make([]byte, textLength)
-			_, err = reader.Read(text)
+			_, err = io.ReadFull(reader, text)
 			if err != nil {
 				fmt.Println("Error reading text:", err)
 				return
@@ -105,7 +334,7 @@ func receiveAndParseMessages(conn net.Conn) {
 
 		case 0x02:
 			commandLengthBuf := make([]byte, 4)
-			_, err := reader.Read(commandLengthBuf)
+			_, err := io.ReadFull(reader, commandLengthBuf)
 			if err != nil {
 				fmt.Println("Error reading command length:", err)
 				return
@@ -113,14 +342,14 @@ func receiveAndParseMessages(conn net.Conn) {
 			commandLength := binary.BigEndian.Uint32(commandLengthBuf)
 
 			command := make([]byte, commandLength)
-			_, err = reader.Read(command)
+			_, err = io.ReadFull(reader, command)
 			if err != nil {
 				fmt.Println("Error reading command:", err)
 				return
 			}
 
 			parameterLengthBuf := make([]byte, 4)
-			_, err = reader.Read(parameterLengthBuf)
+			_, err = io.ReadFull(reader, parameterLengthBuf)
 			if err != nil {
 				fmt.Println("Error reading parameter length:", err)
 				return
@@ -128,7 +357,7 @@ func receiveAndParseMessages(conn net.Conn) {
 			parameterLength := binary.BigEndian.Uint32(parameterLengthBuf)
 
 			parameter := make([]byte, parameterLength)
-			_, err = reader.Read(parameter)
+			_, err = io.ReadFull(reader, parameter)
 			if err != nil {
 				fmt.Println("Error reading parameter:", err)
 				return
@@ -138,7 +367,7 @@ func receiveAndParseMessages(conn net.Conn) {
 
 		case 0x03:
 			dataField1Buf := make([]byte, 4)
-			_, err := reader.Read(dataField1Buf)
+			_, err := io.ReadFull(reader, dataField1Buf)
 			if err != nil {
 				fmt.Println("Error reading data field 1:", err)
 				return
@@ -146,7 +375,7 @@ func receiveAndParseMessages(conn net.Conn) {
 			dataField1 := binary.BigEndian.Uint32(dataField1Buf)
 
 			dataField2Buf := make([]byte, 8)
-			_, err = reader.Read(dataField2Buf)
+			_, err = io.ReadFull(reader, dataField2Buf)
 			if err != nil {
 				fmt.Println("Error reading data field 2:", err)
 				return
@@ -154,7 +383,7 @@ func receiveAndParseMessages(conn net.Conn) {
 			dataField2 := math.Float64frombits(binary.BigEndian.Uint64(dataField2Buf))
 
 			dataField3LengthBuf := make([]byte, 4)
-			_, err = reader.Read(dataField3LengthBuf)
+			_, err = io.ReadFull(reader, dataField3LengthBuf)
 			if err != nil {
 				fmt.Println("Error reading data field 3 length:", err)
 				return
@@ -162,7 +391,7 @@ func receiveAndParseMessages(conn net.Conn) {
 			dataField3Length := binary.BigEndian.Uint32(dataField3LengthBuf)
 
 			dataField3 := make([]byte, dataField3Length)
-			_, err = reader.Read(dataField3)
+			_, err = io.ReadFull(reader, dataField3)
 			if err != nil {
 				fmt.Println("Error reading data field 3:", err)
 				return
@@ -170,78 +399,244 @@ func receiveAndParseMessages(conn net.Conn) {
 
 			fmt.Printf("Received data packet: Data Field 1: %d, Data Field 2: %f, Data Field 3: %s\n", dataField1, dataField2, string(dataField3))
 
+		case 0x04:
+			senderLengthBuf := make([]byte, 4)
+			_, err := io.ReadFull(reader, senderLengthBuf)
+			if err != nil {
+				fmt.Println("Error reading sender length:", err)
+				return
+			}
+			senderLength := binary.BigEndian.Uint32(senderLengthBuf)
+
+			sender := make([]byte, senderLength)
+			_, err = io.ReadFull(reader, sender)
+			if err != nil {
+				fmt.Println("Error reading sender:", err)
+				return
+			}
+
+			textLengthBuf := make([]byte, 4)
+			_, err = io.ReadFull(reader, textLengthBuf)
+			if err != nil {
+				fmt.Println("Error reading text length:", err)
+				return
+			}
+			textLength := binary.BigEndian.Uint32(textLengthBuf)
+
+			text := make([]byte, textLength)
+			_, err = io.ReadFull(reader, text)
+			if err != nil {
+				fmt.Println("Error reading text:", err)
+				return
+			}
+
+			fmt.Printf("Received direct message from %s: %s\n", string(sender), string(text))
+
+		case 0x05:
+			lengthBuf := make([]byte, 4)
+			_, err := io.ReadFull(reader, lengthBuf)
+			if err != nil {
+				fmt.Println("Error reading response length:", err)
+				return
+			}
+			responseLength := binary.BigEndian.Uint32(lengthBuf)
+
+			response := make([]byte, responseLength)
+			_, err = io.ReadFull(reader, response)
+			if err != nil {
+				fmt.Println("Error reading response:", err)
+				return
+			}
+
+			fmt.Println("Server response:", string(response))
+
+		case 0x08:
+			countBuf := make([]byte, 4)
+			_, err := io.ReadFull(reader, countBuf)
+			if err != nil {
+				fmt.Println("Error reading subscription count:", err)
+				return
+			}
+			count := binary.BigEndian.Uint32(countBuf)
+
+			topics := make([]string, 0, count)
+			for i := uint32(0); i < count; i++ {
+				topicLengthBuf := make([]byte, 4)
+				_, err = io.ReadFull(reader, topicLengthBuf)
+				if err != nil {
+					fmt.Println("Error reading topic length:", err)
+					return
+				}
+				topic := make([]byte, binary.BigEndian.Uint32(topicLengthBuf))
+				_, err = io.ReadFull(reader, topic)
+				if err != nil {
+					fmt.Println("Error reading topic:", err)
+					return
+				}
+				topics = append(topics, string(topic))
+			}
+
+			fmt.Printf("Subscribed topics (%d): %s\n", count, strings.Join(topics, ", "))
+
+		case 0x17:
+			countBuf := make([]byte, 4)
+			_, err := io.ReadFull(reader, countBuf)
+			if err != nil {
+				fmt.Println("Error reading command count:", err)
+				return
+			}
+			count := binary.BigEndian.Uint32(countBuf)
+
+			names := make([]string, 0, count)
+			for i := uint32(0); i < count; i++ {
+				name, err := readLengthPrefixedString(reader)
+				if err != nil {
+					fmt.Println("Error reading command name:", err)
+					return
+				}
+				names = append(names, name)
+			}
+
+			fmt.Printf("Server commands (%d): %s\n", count, strings.Join(names, ", "))
+			select {
+			case serverCommandNames <- names:
+			default:
+			}
+
+		case 0x0B:
+			endBuf := make([]byte, 4+1+8)
+			_, err := io.ReadFull(reader, endBuf)
+			if err != nil {
+				fmt.Println("Error reading end of results:", err)
+				return
+			}
+			count := binary.BigEndian.Uint32(endBuf)
+			nextCursor := binary.BigEndian.Uint64(endBuf[5:])
+
+			if endBuf[4] != 0 {
+				fmt.Printf("End of results: %d data packets, more available from cursor %d\n", count, nextCursor)
+			} else {
+				fmt.Printf("End of results: %d data packets\n", count)
+			}
+
+		case 0x0D:
+			headerBuf := make([]byte, 4+8)
+			_, err := io.ReadFull(reader, headerBuf)
+			if err != nil {
+				fmt.Println("Error reading aggregation result:", err)
+				return
+			}
+			groupCount := binary.BigEndian.Uint32(headerBuf)
+			percentile := math.Float64frombits(binary.BigEndian.Uint64(headerBuf[4:]))
+
+			fmt.Printf("Aggregation result: %d groups\n", groupCount)
+			groupBuf := make([]byte, 8+4+8+8*4)
+			for i := uint32(0); i < groupCount; i++ {
+				_, err = io.ReadFull(reader, groupBuf)
+				if err != nil {
+					fmt.Println("Error reading aggregation group:", err)
+					return
+				}
+				bucketStart := int64(binary.BigEndian.Uint64(groupBuf))
+				dataField1 := binary.BigEndian.Uint32(groupBuf[8:])
+				count := binary.BigEndian.Uint64(groupBuf[12:])
+				minimum := math.Float64frombits(binary.BigEndian.Uint64(groupBuf[20:]))
+				maximum := math.Float64frombits(binary.BigEndian.Uint64(groupBuf[28:]))
+				mean := math.Float64frombits(binary.BigEndian.Uint64(groupBuf[36:]))
+				percentileValue := math.Float64frombits(binary.BigEndian.Uint64(groupBuf[44:]))
+
+				fmt.Printf("  Bucket: %s, Data Field 1: %d, Count: %d, Min: %f, Max: %f, Mean: %f, P%g: %f\n",
+					time.Unix(0, bucketStart).Format(time.RFC3339), dataField1, count, minimum, maximum, mean, percentile, percentileValue)
+			}
+
+		case 0x10:
+			schema, err := readSchemaDefinition(reader)
+			if err != nil {
+				fmt.Println("Error reading schema definition:", err)
+				return
+			}
+
+			fmt.Println("Received schema definition:", formatSchema(schema))
+			select {
+			case schemaDefinitions <- schema:
+			default:
+			}
+
+		case 0x14:
+			senderLengthBuf := make([]byte, 4)
+			_, err := io.ReadFull(reader, senderLengthBuf)
+			if err != nil {
+				fmt.Println("Error reading sender length:", err)
+				return
+			}
+			sender := make([]byte, binary.BigEndian.Uint32(senderLengthBuf))
+			_, err = io.ReadFull(reader, sender)
+			if err != nil {
+				fmt.Println("Error reading sender:", err)
+				return
+			}
+
+			dataFieldsBuf := make([]byte, 4+8+4)
+			_, err = io.ReadFull(reader, dataFieldsBuf)
+			if err != nil {
+				fmt.Println("Error reading data fields:", err)
+				return
+			}
+			dataField1 := binary.BigEndian.Uint32(dataFieldsBuf)
+			dataField2 := math.Float64frombits(binary.BigEndian.Uint64(dataFieldsBuf[4:]))
+			dataField3 := make([]byte, binary.BigEndian.Uint32(dataFieldsBuf[12:]))
+			_, err = io.ReadFull(reader, dataField3)
+			if err != nil {
+				fmt.Println("Error reading data field 3:", err)
+				return
+			}
+
+			fmt.Printf("Received direct data packet from %s: Data Field 1: %d, Data Field 2: %f, Data Field 3: %s\n", string(sender), dataField1, dataField2, string(dataField3))
+
+		case 0x15:
+			header := make([]byte, 8+8)
+			_, err := io.ReadFull(reader, header)
+			if err != nil {
+				fmt.Println("Error reading inbox item:", err)
+				return
+			}
+			inboxItem = binary.BigEndian.Uint64(header)
+			queuedAt := time.Unix(0, int64(binary.BigEndian.Uint64(header[8:])))
+			fmt.Printf("Delivering message queued while offline at %s:\n", queuedAt.Format(time.RFC3339))
+			continue
+
 		default:
 			fmt.Println("Unknown message type:", messageType)
 		}
+
+		if inboxItem != 0 {
+			// The queued frame has been handled
+			inboxAcks <- inboxItem
+			inboxItem = 0
+		}
 	}
 }
 
-func main() {
-	conn, err := net.Dial("tcp", "localhost:8080")
+const serverAddress = "localhost:8080"
+
+func printStateChange(state connState, err error) {
 	if err != nil {
-		fmt.Println("Error connecting:", err.Error())
+		fmt.Printf("Connection %s: %v\n", state, err)
 		return
 	}
-	defer conn.Close()
-
-	reader := bufio.NewReader(os.Stdin)
-
-	fmt.Print("Enter username: ")
-	username, _ := reader.ReadString('\n')
-	username = strings.TrimSpace(username)
-	fmt.Print("Enter password: ")
-	password, _ := reader.ReadString('\n')
-	password = strings.TrimSpace(password)
-	hashedPassword := hashPassword(password)
-	fmt.Println("Hashed password:", hashedPassword)
-
-	conn.Write([]byte(username + "\n"))
-	conn.Write([]byte(hashedPassword + "\n"))
-
-	authResponse, _ := bufio.NewReader(conn).ReadString('\n')
-	fmt.Println(authResponse)
+	fmt.Println("Connection", state)
+}
 
-	if strings.TrimSpace(authResponse) != "Authentication successful" {
-		fmt.Println("Authentication failed, exiting.")
+func main() {
+	o, args, err := parseOptions(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
 		return
 	}
-
-	go receiveAndParseMessages(conn)
-
-	for {
-		fmt.Println("Choose message type (1=Text, 2=Command, 3=Data Packet): ")
-		messageType, _ := reader.ReadString('\n')
-		messageType = strings.TrimSpace(messageType)
-
-		switch messageType {
-		case "1":
-			fmt.Print("Enter text message: ")
-			text, _ := reader.ReadString('\n')
-			text = strings.TrimSpace(text)
-			sendMessage(conn, 0x01, text)
-		case "2":
-			fmt.Print("Enter command: ")
-			command, _ := reader.ReadString('\n')
-			command = strings.TrimSpace(command)
-			fmt.Print("Enter parameter: ")
-			parameter, _ := reader.ReadString('\n')
-			parameter = strings.TrimSpace(parameter)
-			sendCommandMessage(conn, command, parameter)
-		case "3":
-			var dataField1 uint32
-			var dataField2 float64
-			var dataField3 string
-
-			fmt.Print("Enter data field 1 (integer): ")
-			fmt.Scanf("%d\n", &dataField1)
-			fmt.Print("Enter data field 2 (float): ")
-			fmt.Scanf("%f\n", &dataField2)
-			fmt.Print("Enter data field 3 (string): ")
-			dataField3, _ = reader.ReadString('\n')
-			dataField3 = strings.TrimSpace(dataField3)
-			sendDataPacket(conn, dataField1, dataField2, dataField3)
-		default:
-			fmt.Println("Unknown message type")
-		}
+	if err != nil {
+		os.Exit(exitUsage)
+	}
+	if len(args) > 0 {
+		os.Exit(runCommand(o, args))
 	}
+	os.Exit(runInteractive(o))
 }
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Reconnection waits between attempts grow exponentially up to
+// reconnectMaxDelay, each randomised to between half and all of the
+// current delay so that clients dropped together do not return together.
+const (
+	reconnectBaseDelay = 500 * time.Millisecond
+	reconnectMaxDelay  = 30 * time.Second
+)
+
+type connState int
+
+const (
+	stateConnected connState = iota
+	stateDisconnected
+	stateReconnecting
+	stateClosed
+)
+
+func (s connState) String() string {
+	switch s {
+	case stateConnected:
+		return "connected"
+	case stateDisconnected:
+		return "disconnected"
+	case stateReconnecting:
+		return "reconnecting"
+	}
+	return "closed"
+}
+
+// reconnectingConn is a connection to the server that survives drops. When
+// the connection is lost it dials again, authenticates with the same
+// credentials, subscribes to the same topics and sends the frames the
+// server had not acknowledged before any new ones. Writes wait while it is
+// reconnecting.
+//
+// Incoming frames are handed to receive, which is run once for each
+// connection and should return when its reader fails.
+type reconnectingConn struct {
+	addr          string
+	policy        credentialPolicy
+	username      string
+	passwordHash  string
+	receive       func(*bufio.Reader)
+	onStateChange func(connState, error)
+
+	mu      sync.Mutex
+	changed *sync.Cond
+	current *connection
+	state   connState
+	done    chan struct{}
+
+	// unsent holds the frames the next connection sends first, the ones
+	// the last connection never had acknowledged at the front.
+	unsent [][]byte
+
+	// topics are the topics subscribed to, in order.
+	topics []string
+
+	// resuming is held while a new connection sends the frames it took
+	// over, so that the next one takes over only those it could not send.
+	resuming sync.Mutex
+}
+
+// newReconnectingConn takes over an authenticated connection.
+func newReconnectingConn(c *connection, addr string, policy credentialPolicy, username, passwordHash string, receive func(*bufio.Reader), onStateChange func(connState, error)) *reconnectingConn {
+	r := &reconnectingConn{
+		addr:          addr,
+		policy:        policy,
+		username:      username,
+		passwordHash:  passwordHash,
+		receive:       receive,
+		onStateChange: onStateChange,
+		current:       c,
+		state:         stateConnected,
+		done:          make(chan struct{}),
+	}
+	r.changed = sync.NewCond(&r.mu)
+	go r.serve(c)
+	return r
+}
+
+func (r *reconnectingConn) serve(c *connection) {
+	r.receive(c.reader)
+	r.lost(c, errors.New("connection lost"), nil)
+}
+
+// setState records a state change and reports it. It is called with mu
+// held and returns with it held.
+func (r *reconnectingConn) setState(state connState, err error) {
+	r.state = state
+	r.changed.Broadcast()
+	if r.onStateChange != nil {
+		r.mu.Unlock()
+		r.onStateChange(state, err)
+		r.mu.Lock()
+	}
+}
+
+// lost starts reconnecting after c failed, unless that has already
+// happened. unsent holds frames that must follow the unacknowledged ones,
+// and is queued for the next connection either way.
+func (r *reconnectingConn) lost(c *connection, err error, unsent [][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state == stateClosed {
+		return
+	}
+	r.unsent = append(r.unsent, unsent...)
+	if r.current != c {
+		return
+	}
+	r.current = nil
+	r.unsent = append(c.close(), r.unsent...)
+	r.setState(stateDisconnected, err)
+	if r.state == stateDisconnected {
+		go r.reconnect()
+	}
+}
+
+func (r *reconnectingConn) reconnect() {
+	delay := reconnectBaseDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(delay/2 + rand.N(delay/2+1)):
+		case <-r.done:
+			return
+		}
+
+		r.mu.Lock()
+		if r.state == stateClosed {
+			r.mu.Unlock()
+			return
+		}
+		r.setState(stateReconnecting, nil)
+		r.mu.Unlock()
+
+		c, err := r.dial()
+		if err == nil {
+			r.resume(c)
+			return
+		}
+		fmt.Printf("Reconnect attempt %d failed: %v\n", attempt, err)
+		if errors.Is(err, errAuthenticationFailed) || errors.Is(err, errInsecureChannel) {
+			// Trying again will not change the answer
+			r.close(err)
+			return
+		}
+		delay = min(2*delay, reconnectMaxDelay)
+	}
+}
+
+func (r *reconnectingConn) dial() (*connection, error) {
+	raw, reader, sess, err := dialServer(r.addr, true, r.policy)
+	if err != nil {
+		return nil, err
+	}
+	return login(raw, reader, sess, r.username, r.passwordHash)
+}
+
+// resume makes c the current connection once it has subscribed to the
+// topics again and sent the pending frames, so that new writes follow them.
+func (r *reconnectingConn) resume(c *connection) {
+	r.resuming.Lock()
+	defer r.resuming.Unlock()
+
+	r.mu.Lock()
+	if r.state == stateClosed {
+		r.mu.Unlock()
+		c.close()
+		return
+	}
+	r.current = c
+	var frames [][]byte
+	for _, topic := range r.topics {
+		frames = append(frames, subscriptionFrame(0x06, topic))
+	}
+	subscriptions, pending := len(frames), r.unsent
+	frames = append(frames, pending...)
+	r.unsent = nil
+	r.mu.Unlock()
+
+	go r.serve(c)
+	if subscriptions > 0 {
+		fmt.Println("Subscribing again to", subscriptions, "topics")
+	}
+	if len(pending) > 0 {
+		fmt.Println("Resending", len(pending), "unacknowledged frames")
+	}
+	for i, frame := range frames {
+		if _, err := c.conn.Write(frame); err != nil {
+			if c.retransmitter != nil && !errors.Is(err, errRetransmitterClosed) {
+				// The frame is among the unacknowledged ones sent again
+				i++
+			}
+			// The next connection subscribes again anyway
+			r.lost(c, err, frames[max(i, subscriptions):])
+			return
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current == c && r.state == stateReconnecting {
+		r.setState(stateConnected, nil)
+	}
+}
+
+// noteSubscription keeps track of the topics subscribed to by frame.
+func (r *reconnectingConn) noteSubscription(frame []byte) {
+	if len(frame) < 1+4 || (frame[0] != 0x06 && frame[0] != 0x07) {
+		return
+	}
+	topicLength := binary.BigEndian.Uint32(frame[1:])
+	if uint64(topicLength) > uint64(len(frame)-1-4) {
+		return
+	}
+	topic := string(frame[1+4 : 1+4+topicLength])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.topics = slices.DeleteFunc(r.topics, func(t string) bool { return t == topic })
+	if frame[0] == 0x06 {
+		r.topics = append(r.topics, topic)
+	}
+}
+
+// connected waits until there is a connection to write to.
+func (r *reconnectingConn) connected() (*connection, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.state != stateConnected && r.state != stateClosed {
+		r.changed.Wait()
+	}
+	if r.state == stateClosed {
+		return nil, net.ErrClosed
+	}
+	return r.current, nil
+}
+
+// Write sends one frame. If the connection fails, the frame goes out on
+// the next one.
+func (r *reconnectingConn) Write(frame []byte) (int, error) {
+	for {
+		c, err := r.connected()
+		if err != nil {
+			return 0, err
+		}
+		n, err := c.conn.Write(frame)
+		switch {
+		case err == nil:
+			r.noteSubscription(frame)
+			return n, nil
+		case errors.Is(err, errFrameRejected):
+			return 0, err
+		case errors.Is(err, errRetransmitterClosed):
+			// The connection was lost before the frame was sent
+			continue
+		}
+		r.lost(c, err, nil)
+		if c.retransmitter != nil {
+			// The frame is among the unacknowledged ones sent again
+			r.noteSubscription(frame)
+			return len(frame), nil
+		}
+	}
+}
+
+// Read is not supported: frames arrive through receive.
+func (r *reconnectingConn) Read([]byte) (int, error) {
+	return 0, errors.New("reconnectingConn delivers frames through its receive function")
+}
+
+func (r *reconnectingConn) Close() error {
+	r.close(nil)
+	return nil
+}
+
+func (r *reconnectingConn) close(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state == stateClosed {
+		return
+	}
+	close(r.done)
+	if r.current != nil {
+		r.current.close()
+		r.current = nil
+	}
+	r.setState(stateClosed, err)
+}
+
+// The remaining net.Conn methods apply to the current connection.
+
+func (r *reconnectingConn) currentConn() net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current == nil {
+		return nil
+	}
+	return r.current.raw
+}
+
+func (r *reconnectingConn) LocalAddr() net.Addr {
+	if c := r.currentConn(); c != nil {
+		return c.LocalAddr()
+	}
+	return nil
+}
+
+func (r *reconnectingConn) RemoteAddr() net.Addr {
+	if c := r.currentConn(); c != nil {
+		return c.RemoteAddr()
+	}
+	return nil
+}
+
+func (r *reconnectingConn) SetDeadline(t time.Time) error {
+	if c := r.currentConn(); c != nil {
+		return c.SetDeadline(t)
+	}
+	return net.ErrClosed
+}
+
+func (r *reconnectingConn) SetReadDeadline(t time.Time) error {
+	if c := r.currentConn(); c != nil {
+		return c.SetReadDeadline(t)
+	}
+	return net.ErrClosed
+}
+
+func (r *reconnectingConn) SetWriteDeadline(t time.Time) error {
+	if c := r.currentConn(); c != nil {
+		return c.SetWriteDeadline(t)
+	}
+	return net.ErrClosed
+}
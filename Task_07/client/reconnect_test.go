@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"../protocol"
+)
+
+// legacyServer accepts connections on a local listener, answers the hello
+// with version 7 and accepts any credentials. Each connection is passed to
+// serve after authentication.
+func legacyServer(t *testing.T, serve func(net.Conn, *bufio.Reader)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				header := make([]byte, len(helloMagic)+4)
+				if _, err := io.ReadFull(reader, header); err != nil {
+					return
+				}
+				if _, err := reader.Discard(int(binary.BigEndian.Uint32(header[len(helloMagic):])) + 4); err != nil {
+					return
+				}
+				body, _ := protocol.MarshalTLV(hello{MinVersion: 7, MaxVersion: 7, Version: 7, Identity: "test server"})
+				reply := binary.BigEndian.AppendUint32(append([]byte(nil), helloMagic...), uint32(len(body)))
+				conn.Write(appendChecksum(append(reply, body...)))
+				for range 2 {
+					if _, err := reader.ReadString('\n'); err != nil {
+						return
+					}
+				}
+				conn.Write([]byte("Authentication successful\n"))
+				serve(conn, reader)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func readFrame(t *testing.T, reader *bufio.Reader, size int) []byte {
+	t.Helper()
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		t.Error(err)
+	}
+	return frame
+}
+
+func TestReconnectSubscribesAgain(t *testing.T) {
+	subscribe := subscriptionFrame(0x06, "news")
+	frames := make(chan []byte, 4)
+	var dropped sync.Once
+	addr := legacyServer(t, func(conn net.Conn, reader *bufio.Reader) {
+		frames <- readFrame(t, reader, len(subscribe))
+		drop := false
+		// Drop the first connection once the client has subscribed
+		dropped.Do(func() { drop = true })
+		if !drop {
+			io.Copy(io.Discard, reader)
+		}
+	})
+
+	raw, reader, sess, err := dialServer(addr, true, allowPlainPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := login(raw, reader, sess, "user1", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newReconnectingConn(first, addr, allowPlainPassword, "user1", "hash", func(reader *bufio.Reader) { io.Copy(io.Discard, reader) }, nil)
+	defer r.Close()
+	if _, err := r.Write(subscribe); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 2 {
+		select {
+		case frame := <-frames:
+			if !bytes.Equal(frame, subscribe) {
+				t.Fatalf("connection %d received %x, want the subscription %x", i+1, frame, subscribe)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection %d received no subscription", i+1)
+		}
+	}
+}
+
+func TestLostRequeuesUnsentFrames(t *testing.T) {
+	// Another goroutine already saw the connection fail and a new one is
+	// being dialled; the frames still go to it
+	client, server := net.Pipe()
+	defer server.Close()
+	c := &connection{raw: client, conn: client}
+	r := &reconnectingConn{state: stateReconnecting, done: make(chan struct{})}
+	r.changed = sync.NewCond(&r.mu)
+
+	unsent := [][]byte{{0x01, 'a'}, {0x01, 'b'}}
+	r.lost(c, errors.New("write failed"), unsent)
+	if len(r.unsent) != 2 || !bytes.Equal(r.unsent[1], unsent[1]) {
+		t.Fatalf("unsent = %x, want %x", r.unsent, unsent)
+	}
+}
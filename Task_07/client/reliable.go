@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// When acknowledgements are negotiated the server answers every envelope
+// with 0x12 (received) or 0x13 (send again) followed by the envelope's
+// sequence number. The client keeps each envelope until it is acknowledged
+// and sends the same bytes again on a NACK or when no acknowledgement
+// arrives in time. Delivery is at least once; the server recognises a
+// retransmission by its sequence number and handles it only once.
+const (
+	frameAck  = 0x12
+	frameNack = 0x13
+)
+
+const (
+	// sendWindowSize bounds the unacknowledged envelopes. It must stay
+	// below the server's replay window so retransmissions are accepted.
+	sendWindowSize     = 32
+	retransmitTimeout  = 2 * time.Second
+	maxRetransmissions = 5
+)
+
+var errRetransmitterClosed = errors.New("retransmitter closed")
+
+type unacknowledged struct {
+	frame    []byte // as written, so it can be sent on a new connection
+	envelope []byte
+	sentAt   time.Time
+	attempts int
+}
+
+// retransmitter tracks the envelopes the server has not acknowledged. If
+// one is still unacknowledged after maxRetransmissions, it stops sending
+// and reports the failure to giveUp, keeping every frame for close to
+// return.
+type retransmitter struct {
+	send   func([]byte) error
+	giveUp func(error)
+
+	mu       sync.Mutex
+	space    *sync.Cond
+	pending  map[uint64]*unacknowledged
+	reserved int
+	failed   bool
+	closed   bool
+	done     chan struct{}
+}
+
+func newRetransmitter(send func([]byte) error, giveUp func(error)) *retransmitter {
+	r := &retransmitter{
+		send:    send,
+		giveUp:  giveUp,
+		pending: make(map[uint64]*unacknowledged),
+		done:    make(chan struct{}),
+	}
+	r.space = sync.NewCond(&r.mu)
+	go r.run()
+	return r
+}
+
+// reserve waits for room in the send window and claims it for the next
+// envelope.
+func (r *retransmitter) reserve() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for !r.closed && len(r.pending)+r.reserved >= sendWindowSize {
+		r.space.Wait()
+	}
+	if r.closed {
+		return errRetransmitterClosed
+	}
+	r.reserved++
+	return nil
+}
+
+// release gives back a reservation that was not used.
+func (r *retransmitter) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reserved--
+	r.space.Signal()
+}
+
+// track starts waiting for the acknowledgement of an envelope about to be
+// sent under a reservation.
+func (r *retransmitter) track(seq uint64, frame, envelope []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reserved--
+	if r.closed {
+		return errRetransmitterClosed
+	}
+	r.pending[seq] = &unacknowledged{
+		frame:    append([]byte(nil), frame...),
+		envelope: envelope,
+		sentAt:   time.Now(),
+		attempts: 1,
+	}
+	return nil
+}
+
+// acknowledged handles an ACK or NACK from the server.
+func (r *retransmitter) acknowledged(seq uint64, ok bool) {
+	r.mu.Lock()
+	frame, found := r.pending[seq]
+	if !found {
+		r.mu.Unlock()
+		return
+	}
+	if ok {
+		delete(r.pending, seq)
+		r.space.Signal()
+		r.mu.Unlock()
+		return
+	}
+	r.mu.Unlock()
+	fmt.Println("Server asked for frame", seq, "again")
+	r.retransmit(seq, frame)
+}
+
+// retransmit sends a frame again, or gives up on the connection after
+// maxRetransmissions attempts.
+func (r *retransmitter) retransmit(seq uint64, frame *unacknowledged) {
+	r.mu.Lock()
+	if r.failed {
+		r.mu.Unlock()
+		return
+	}
+	if frame.attempts > maxRetransmissions {
+		r.failed = true
+		r.mu.Unlock()
+		r.giveUp(fmt.Errorf("frame %d unacknowledged after %d attempts", seq, frame.attempts))
+		return
+	}
+	frame.attempts++
+	frame.sentAt = time.Now()
+	r.mu.Unlock()
+
+	if err := r.send(frame.envelope); err != nil {
+		fmt.Println("Error retransmitting frame:", err)
+	}
+}
+
+// run retransmits envelopes whose acknowledgement is overdue.
+func (r *retransmitter) run() {
+	ticker := time.NewTicker(retransmitTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			r.mu.Lock()
+			var overdue []uint64
+			for seq, frame := range r.pending {
+				if now.Sub(frame.sentAt) >= retransmitTimeout {
+					overdue = append(overdue, seq)
+				}
+			}
+			r.mu.Unlock()
+			for _, seq := range overdue {
+				r.mu.Lock()
+				frame, found := r.pending[seq]
+				r.mu.Unlock()
+				if found {
+					fmt.Println("No acknowledgement for frame", seq, "- sending it again")
+					r.retransmit(seq, frame)
+				}
+			}
+		}
+	}
+}
+
+// close stops retransmitting, wakes writers waiting for room and returns
+// the frames still unacknowledged, oldest first.
+func (r *retransmitter) close() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	r.space.Broadcast()
+
+	seqs := slices.Sorted(maps.Keys(r.pending))
+	frames := make([][]byte, len(seqs))
+	for i, seq := range seqs {
+		frames[i] = r.pending[seq].frame
+	}
+	r.pending = nil
+	return frames
+}
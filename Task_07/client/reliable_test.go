@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRetransmitterGivesUpAndKeepsFrame(t *testing.T) {
+	var sent int
+	var failures []error
+	r := newRetransmitter(func([]byte) error {
+		sent++
+		return nil
+	}, func(err error) {
+		failures = append(failures, err)
+	})
+	if err := r.reserve(); err != nil {
+		t.Fatal(err)
+	}
+	frame := []byte{0x01, 0, 0, 0, 1, 'a'}
+	if err := r.track(1, frame, []byte("envelope")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server keeps asking for the frame again
+	for range maxRetransmissions + 3 {
+		r.acknowledged(1, false)
+	}
+	if sent != maxRetransmissions || len(failures) != 1 {
+		t.Fatalf("%d retransmissions and %d failures, want %d and 1", sent, len(failures), maxRetransmissions)
+	}
+
+	// The frame is not lost: it goes to the next connection
+	unacked := r.close()
+	if len(unacked) != 1 || !bytes.Equal(unacked[0], frame) {
+		t.Fatalf("close returned %x, want the given up frame", unacked)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The REPL sends plain lines as text messages and starts everything else
+// with a slash. A line starting with "//" sends text starting with "/".
+// Commands with many fields, such as /query, ask for them one at a time;
+// ctrl-c or the end of input while answering cancels the command. The
+// history file keeps the last maxHistory lines.
+const (
+	replPrompt      = "> "
+	historyFileName = ".task07_history"
+	maxHistory      = 1000
+)
+
+var slashCommands = map[string]string{
+	"/cmd":       "/cmd <command> [parameter] - send a command message",
+	"/data":      "/data <field1> <field2> <field3> - send a data packet",
+	"/send":      "/send <schema ID> - send a data packet in a registered schema",
+	"/schema":    "/schema <name> <name:type, ...> - register a data packet schema",
+	"/msg":       "/msg <user> <text> - send a direct message",
+	"/ddata":     "/ddata <user> <field1> <field2> <field3> - send a direct data packet",
+	"/join":      "/join <topic> - subscribe to a topic",
+	"/leave":     "/leave <topic> - unsubscribe from a topic",
+	"/topics":    "/topics - list your subscriptions",
+	"/publish":   "/publish <topic> <field1> <field2> <field3> - publish a data packet to a topic",
+	"/query":     "/query - query stored data packets",
+	"/aggregate": "/aggregate - aggregate stored data packets",
+	"/who":       "/who - list the users online",
+	"/help":      "/help - show this list",
+	"/quit":      "/quit - leave the client",
+}
+
+// serverCommandNames receives the command names the server sends in 0x17
+// frames.
+var serverCommandNames = make(chan []string, 1)
+
+func sendListCommands(conn net.Conn) {
+	bufWithChecksum := appendChecksum([]byte{0x17})
+	conn.Write(bufWithChecksum)
+}
+
+type repl struct {
+	conn     net.Conn
+	commands []string
+	schemas  map[uint32]dataSchema
+
+	// ask prompts for one answer and sets cancelled if there is none.
+	ask       func(prompt string) string
+	cancelled bool
+}
+
+// runREPL reads lines from reader until /quit or the end of input. On a
+// terminal lines are edited in place and kept in historyPath between runs.
+func runREPL(conn net.Conn, reader *bufio.Reader, historyPath string) {
+	r := &repl{conn: conn, schemas: map[uint32]dataSchema{legacyDataPacketSchemaID: legacyDataPacketSchema}}
+	sendListCommands(conn)
+
+	restore, err := makeRaw()
+	if err != nil {
+		// Not a terminal: read plain lines
+		r.ask = func(prompt string) string {
+			fmt.Print(prompt)
+			answer, err := reader.ReadString('\n')
+			if err != nil && answer == "" {
+				r.cancelled = true
+			}
+			return strings.TrimSpace(answer)
+		}
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" && !r.handle(strings.TrimSpace(line)) {
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	defer restore()
+
+	editor := newLineEditor(reader, os.Stdout, r.complete)
+	stopCapture, err := editor.captureStdout()
+	if err != nil {
+		fmt.Println("Error capturing output:", err)
+		return
+	}
+	defer stopCapture()
+	r.ask = func(prompt string) string {
+		answer, err := editor.readLine(prompt)
+		if err != nil {
+			r.cancelled = true
+		}
+		return strings.TrimSpace(answer)
+	}
+
+	editor.history = loadHistory(historyPath)
+	saveFailed := false
+
+	fmt.Println("Type /help for commands.")
+	for {
+		line, err := editor.readLine(replPrompt)
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		editor.addHistory(line)
+		if err := saveHistory(historyPath, editor.history); err != nil && !saveFailed {
+			fmt.Println("Error saving history file:", err)
+			saveFailed = true
+		}
+		if !r.handle(line) {
+			return
+		}
+	}
+}
+
+// handle runs one line and reports whether to keep going.
+func (r *repl) handle(line string) bool {
+	if line == "" {
+		return true
+	}
+	if !strings.HasPrefix(line, "/") || strings.HasPrefix(line, "//") {
+		sendMessage(r.conn, 0x01, strings.TrimPrefix(line, "/"))
+		return true
+	}
+
+	name, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+	switch name {
+	case "/cmd":
+		command, parameter, _ := strings.Cut(rest, " ")
+		if command == "" {
+			fmt.Println("Usage:", slashCommands[name])
+			break
+		}
+		sendCommandMessage(r.conn, command, strings.TrimSpace(parameter))
+	case "/data":
+		fields := strings.SplitN(rest, " ", 3)
+		if len(fields) != 3 {
+			fmt.Println("Usage:", slashCommands[name])
+			break
+		}
+		dataField1, dataField2, err := parseDataFields(fields[0], fields[1])
+		if err != nil {
+			fmt.Println("Error:", err)
+			break
+		}
+		sendDataPacket(r.conn, dataField1, dataField2, fields[2])
+	case "/publish", "/ddata":
+		fields := strings.SplitN(rest, " ", 4)
+		if len(fields) != 4 {
+			fmt.Println("Usage:", slashCommands[name])
+			break
+		}
+		dataField1, dataField2, err := parseDataFields(fields[1], fields[2])
+		if err != nil {
+			fmt.Println("Error:", err)
+			break
+		}
+		if name == "/publish" {
+			sendPublish(r.conn, fields[0], dataField1, dataField2, fields[3])
+		} else {
+			sendDirectDataPacket(r.conn, fields[0], dataField1, dataField2, fields[3])
+		}
+	case "/send":
+		schemaID, err := strconv.ParseUint(rest, 10, 32)
+		if err != nil {
+			fmt.Println("Usage:", slashCommands[name])
+			break
+		}
+		schema, ok := r.schemas[uint32(schemaID)]
+		if !ok {
+			schema, err = fetchSchema(r.conn, uint32(schemaID))
+			if err != nil {
+				fmt.Println("Error:", err)
+				break
+			}
+			r.schemas[schema.id] = schema
+		}
+		r.cancelled = false
+		body, err := readSchemaPacket(r.ask, schema)
+		if r.cancelled {
+			fmt.Println("Cancelled")
+			break
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			break
+		}
+		if schema.id == legacyDataPacketSchemaID {
+			// The default layout is exactly the body of a 0x03 data packet
+			r.conn.Write(appendChecksum(append([]byte{0x03}, body...)))
+		} else {
+			sendSchemaPacket(r.conn, schema.id, body)
+		}
+	case "/schema":
+		schemaName, spec, _ := strings.Cut(rest, " ")
+		if schemaName == "" || strings.TrimSpace(spec) == "" {
+			fmt.Println("Usage:", slashCommands[name])
+			break
+		}
+		fields, err := parseSchemaFields(spec)
+		if err != nil {
+			fmt.Println("Error:", err)
+			break
+		}
+		sendRegisterSchema(r.conn, schemaName, fields)
+	case "/msg":
+		recipient, text, _ := strings.Cut(rest, " ")
+		if recipient == "" || strings.TrimSpace(text) == "" {
+			fmt.Println("Usage:", slashCommands[name])
+			break
+		}
+		sendDirectMessage(r.conn, recipient, strings.TrimSpace(text))
+	case "/topics":
+		sendListSubscriptions(r.conn)
+	case "/query":
+		r.cancelled = false
+		query, err := readQuery(r.ask)
+		if r.cancelled {
+			fmt.Println("Cancelled")
+			break
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			break
+		}
+		sendQuery(r.conn, query)
+	case "/aggregate":
+		r.cancelled = false
+		query, bucketWidth, percentile, err := readAggregation(r.ask)
+		if r.cancelled {
+			fmt.Println("Cancelled")
+			break
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			break
+		}
+		sendAggregation(r.conn, query, bucketWidth, percentile)
+	case "/join", "/leave":
+		if rest == "" {
+			fmt.Println("Usage:", slashCommands[name])
+			break
+		}
+		if name == "/join" {
+			sendSubscription(r.conn, 0x06, rest)
+		} else {
+			sendSubscription(r.conn, 0x07, rest)
+		}
+	case "/who":
+		sendCommandMessage(r.conn, "who", "")
+	case "/help":
+		names := make([]string, 0, len(slashCommands))
+		for name := range slashCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(slashCommands[name])
+		}
+	case "/quit":
+		return false
+	default:
+		fmt.Printf("Unknown command %s, type /help for the list\n", name)
+	}
+	return true
+}
+
+// parseDataFields parses data fields 1 and 2 of a slash command.
+func parseDataFields(field1, field2 string) (uint32, float64, error) {
+	dataField1, err := strconv.ParseUint(field1, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid data field 1 %q", field1)
+	}
+	dataField2, err := strconv.ParseFloat(field2, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid data field 2 %q", field2)
+	}
+	return uint32(dataField1), dataField2, nil
+}
+
+// complete returns the completions of the text before the cursor: slash
+// commands, and after /cmd the commands the server runs.
+func (r *repl) complete(before string) []string {
+	select {
+	case names := <-serverCommandNames:
+		r.commands = names
+	default:
+	}
+
+	var candidates []string
+	if strings.HasPrefix(before, "/cmd ") {
+		partial := strings.TrimPrefix(before, "/cmd ")
+		if strings.Contains(partial, " ") {
+			return nil
+		}
+		for _, name := range r.commands {
+			if strings.HasPrefix(name, partial) {
+				candidates = append(candidates, "/cmd "+name)
+			}
+		}
+	} else if strings.HasPrefix(before, "/") && !strings.Contains(before, " ") {
+		for name := range slashCommands {
+			if strings.HasPrefix(name, before) {
+				candidates = append(candidates, name)
+			}
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+// defaultHistoryPath is the history file in the user's home directory, or
+// in the working directory if there is none.
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return historyFileName
+	}
+	return filepath.Join(home, historyFileName)
+}
+
+// loadHistory returns the last lines of the history file.
+func loadHistory(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.EOF) {
+		fmt.Println("Error reading history file:", err)
+	}
+	if len(lines) > maxHistory {
+		lines = lines[len(lines)-maxHistory:]
+	}
+	return lines
+}
+
+// saveHistory replaces the history file with the last maxHistory lines.
+func saveHistory(path string, lines []string) error {
+	if len(lines) > maxHistory {
+		lines = lines[len(lines)-maxHistory:]
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
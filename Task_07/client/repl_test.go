@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// sent returns what send writes.
+func sent(send func(net.Conn)) []byte {
+	conn := &recordingConn{}
+	send(conn)
+	return conn.written
+}
+
+func TestREPLHandle(t *testing.T) {
+	registered := dataSchema{id: 9, name: "s", fields: []schemaField{{name: "ok", typ: fieldBool}}}
+	tests := []struct {
+		line    string
+		answers []string // for commands that ask; nil ends input
+		want    []byte   // nil when nothing must be sent
+	}{
+		{"hello", nil, sent(func(c net.Conn) { sendMessage(c, 0x01, "hello") })},
+		{"//slash", nil, sent(func(c net.Conn) { sendMessage(c, 0x01, "/slash") })},
+		{"/cmd echo a b", nil, sent(func(c net.Conn) { sendCommandMessage(c, "echo", "a b") })},
+		{"/who", nil, sent(func(c net.Conn) { sendCommandMessage(c, "who", "") })},
+		{"/data 7 1.5 three words", nil, sent(func(c net.Conn) { sendDataPacket(c, 7, 1.5, "three words") })},
+		{"/publish news 7 1.5 x", nil, sent(func(c net.Conn) { sendPublish(c, "news", 7, 1.5, "x") })},
+		{"/ddata user2 7 1.5 x", nil, sent(func(c net.Conn) { sendDirectDataPacket(c, "user2", 7, 1.5, "x") })},
+		{"/msg user2 hi there", nil, sent(func(c net.Conn) { sendDirectMessage(c, "user2", "hi there") })},
+		{"/join news", nil, sent(func(c net.Conn) { sendSubscription(c, 0x06, "news") })},
+		{"/leave news", nil, sent(func(c net.Conn) { sendSubscription(c, 0x07, "news") })},
+		{"/topics", nil, sent(sendListSubscriptions)},
+		{"/schema s ok:bool", nil, sent(func(c net.Conn) { sendRegisterSchema(c, "s", registered.fields) })},
+		{"/send 9", []string{"true"}, sent(func(c net.Conn) { sendSchemaPacket(c, 9, []byte{1}) })},
+		{"/send 1", []string{"7", "1.5", "x"}, sent(func(c net.Conn) { sendDataPacket(c, 7, 1.5, "x") })},
+		{"/query", []string{"5-10", "", "", "user2", "", "20", ""},
+			sent(func(c net.Conn) {
+				sendQuery(c, packetQuery{flags: queryByDataField1 | queryBySender, dataField1Min: 5, dataField1Max: 10, sender: "user2", limit: 20})
+			})},
+		{"/aggregate", []string{"", "", "", "", "", "1m", "50"},
+			sent(func(c net.Conn) { sendAggregation(c, packetQuery{}, time.Minute, 50) })},
+
+		{"/data 7 1.5", nil, nil},
+		{"/data x 1.5 y", nil, nil},
+		{"/publish news 7 many x", nil, nil},
+		{"/msg user2", nil, nil},
+		{"/cmd", nil, nil},
+		{"/schema s", nil, nil},
+		{"/schema s ok:maybe", nil, nil},
+		{"/send many", nil, nil},
+		{"/send 9", []string{"maybe"}, nil},
+		{"/query", []string{"5-10", ""}, nil},
+		{"/aggregate", []string{"", "", "", "", "", "-1m"}, nil},
+		{"/nosuch", nil, nil},
+	}
+	for _, tt := range tests {
+		conn := &recordingConn{}
+		r := &repl{conn: conn, schemas: map[uint32]dataSchema{legacyDataPacketSchemaID: legacyDataPacketSchema, 9: registered}}
+		answers := slices.Clone(tt.answers)
+		r.ask = func(string) string {
+			if len(answers) == 0 {
+				r.cancelled = true
+				return ""
+			}
+			answer := answers[0]
+			answers = answers[1:]
+			return answer
+		}
+		var keepGoing bool
+		output := captureOutput(t, &os.Stdout, func() { keepGoing = r.handle(tt.line) })
+		if !keepGoing {
+			t.Errorf("%q ended the REPL", tt.line)
+		}
+		if !bytes.Equal(conn.written, tt.want) {
+			t.Errorf("%q sent %x, want %x", tt.line, conn.written, tt.want)
+		}
+		if tt.want == nil && output == "" {
+			t.Errorf("%q sent nothing and said nothing", tt.line)
+		}
+	}
+
+	if (&repl{}).handle("/quit") {
+		t.Error("/quit did not end the REPL")
+	}
+}
+
+func TestSaveHistoryKeepsLastLines(t *testing.T) {
+	path := t.TempDir() + "/history"
+	var lines []string
+	for i := range maxHistory + 10 {
+		lines = append(lines, fmt.Sprint("line ", i))
+	}
+	if err := saveHistory(path, lines); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadHistory(path); !slices.Equal(got, lines[10:]) {
+		t.Fatalf("loaded %d lines from %q to %q, want the last %d", len(got), got[0], got[len(got)-1], maxHistory)
+	}
+
+	e := newLineEditor(nil, nil, nil)
+	for _, line := range lines {
+		e.addHistory(line)
+	}
+	if len(e.history) != maxHistory || e.history[0] != lines[10] {
+		t.Fatalf("editor keeps %d lines from %q", len(e.history), e.history[0])
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field types a schema can declare, matching the server's registry.
+const (
+	fieldInt8 byte = iota + 1
+	fieldInt16
+	fieldInt32
+	fieldInt64
+	fieldUint8
+	fieldUint16
+	fieldUint32
+	fieldUint64
+	fieldFloat32
+	fieldFloat64
+	fieldBool
+	fieldString
+	fieldBytes
+	fieldTimestamp
+	fieldList
+)
+
+var fieldTypeNames = map[byte]string{
+	fieldInt8:      "int8",
+	fieldInt16:     "int16",
+	fieldInt32:     "int32",
+	fieldInt64:     "int64",
+	fieldUint8:     "uint8",
+	fieldUint16:    "uint16",
+	fieldUint32:    "uint32",
+	fieldUint64:    "uint64",
+	fieldFloat32:   "float32",
+	fieldFloat64:   "float64",
+	fieldBool:      "bool",
+	fieldString:    "string",
+	fieldBytes:     "bytes",
+	fieldTimestamp: "timestamp",
+	fieldList:      "list",
+}
+
+const legacyDataPacketSchemaID = 1
+
+type schemaField struct {
+	name     string
+	typ      byte
+	elemType byte
+}
+
+func (f schemaField) typeName() string {
+	if f.typ == fieldList {
+		return "list<" + fieldTypeNames[f.elemType] + ">"
+	}
+	return fieldTypeNames[f.typ]
+}
+
+type dataSchema struct {
+	id     uint32
+	name   string
+	fields []schemaField
+}
+
+// legacyDataPacketSchema is the fixed layout of 0x03 data packets, which
+// the server registers under legacyDataPacketSchemaID.
+var legacyDataPacketSchema = dataSchema{
+	id:   legacyDataPacketSchemaID,
+	name: "data_packet",
+	fields: []schemaField{
+		{name: "dataField1", typ: fieldUint32},
+		{name: "dataField2", typ: fieldFloat64},
+		{name: "dataField3", typ: fieldString},
+	},
+}
+
+// schemaDefinitions receives the schemas the server sends in 0x10 frames.
+var schemaDefinitions = make(chan dataSchema, 1)
+
+func fieldTypeByName(name string) (byte, bool) {
+	for typ, typeName := range fieldTypeNames {
+		if typeName == name {
+			return typ, true
+		}
+	}
+	return 0, false
+}
+
+// parseSchemaFields parses a field list such as
+// "temp:float64, tags:list<string>, at:timestamp".
+func parseSchemaFields(spec string) ([]schemaField, error) {
+	var fields []schemaField
+	for _, part := range strings.Split(spec, ",") {
+		name, typeName, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected name:type, got %q", part)
+		}
+		field := schemaField{name: name}
+		typeName = strings.TrimSpace(typeName)
+		if elemName, isList := strings.CutPrefix(typeName, "list<"); isList {
+			elemType, ok := fieldTypeByName(strings.TrimSuffix(elemName, ">"))
+			if !ok || elemType == fieldList || !strings.HasSuffix(elemName, ">") {
+				return nil, fmt.Errorf("unsupported list type %q", typeName)
+			}
+			field.typ = fieldList
+			field.elemType = elemType
+		} else {
+			typ, ok := fieldTypeByName(typeName)
+			if !ok || typ == fieldList {
+				return nil, fmt.Errorf("unknown type %q", typeName)
+			}
+			field.typ = typ
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// sendRegisterSchema asks the server to register a schema. The server
+// assigns the ID and answers with the schema definition.
+func sendRegisterSchema(conn net.Conn, name string, fields []schemaField) {
+	buf := []byte{0x0E}
+	buf = binary.BigEndian.AppendUint32(buf, 0)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(name)))
+	buf = append(buf, name...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(fields)))
+	for _, f := range fields {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(f.name)))
+		buf = append(buf, f.name...)
+		buf = append(buf, f.typ, f.elemType)
+	}
+
+	bufWithChecksum := appendChecksum(buf)
+	conn.Write(bufWithChecksum)
+}
+
+func sendSchemaLookup(conn net.Conn, schemaID uint32) {
+	buf := binary.BigEndian.AppendUint32([]byte{0x0F}, schemaID)
+
+	bufWithChecksum := appendChecksum(buf)
+	conn.Write(bufWithChecksum)
+}
+
+func sendSchemaPacket(conn net.Conn, schemaID uint32, body []byte) {
+	buf := binary.BigEndian.AppendUint32([]byte{0x11}, schemaID)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(body)))
+	buf = append(buf, body...)
+
+	bufWithChecksum := appendChecksum(buf)
+	conn.Write(bufWithChecksum)
+}
+
+// readSchemaDefinition reads the body of a 0x10 schema definition frame.
+func readSchemaDefinition(reader *bufio.Reader) (dataSchema, error) {
+	var s dataSchema
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return s, err
+	}
+	s.id = binary.BigEndian.Uint32(header)
+
+	name, err := readLengthPrefixedString(reader)
+	if err != nil {
+		return s, err
+	}
+	s.name = name
+
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return s, err
+	}
+	count := binary.BigEndian.Uint32(header)
+	for i := uint32(0); i < count; i++ {
+		fieldName, err := readLengthPrefixedString(reader)
+		if err != nil {
+			return s, err
+		}
+		types := make([]byte, 2)
+		if _, err := io.ReadFull(reader, types); err != nil {
+			return s, err
+		}
+		s.fields = append(s.fields, schemaField{name: fieldName, typ: types[0], elemType: types[1]})
+	}
+	return s, nil
+}
+
+func readLengthPrefixedString(reader *bufio.Reader) (string, error) {
+	lengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, lengthBuf); err != nil {
+		return "", err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(lengthBuf))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// fetchSchema asks the server for a schema and waits for the definition
+// to arrive through the receive loop.
+func fetchSchema(conn net.Conn, schemaID uint32) (dataSchema, error) {
+	sendSchemaLookup(conn, schemaID)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case s := <-schemaDefinitions:
+			if s.id == schemaID {
+				return s, nil
+			}
+		case <-timeout:
+			return dataSchema{}, fmt.Errorf("schema %d not received", schemaID)
+		}
+	}
+}
+
+// readSchemaPacket asks for a value of every field of s and returns the
+// encoded packet body. List elements are separated by commas, bytes are
+// base64 and timestamps are RFC 3339.
+func readSchemaPacket(ask func(string) string, s dataSchema) ([]byte, error) {
+	var body []byte
+	for _, f := range s.fields {
+		answer := ask(fmt.Sprintf("Enter %s (%s): ", f.name, f.typeName()))
+		var err error
+		if f.typ == fieldList {
+			var items []string
+			if answer != "" {
+				items = strings.Split(answer, ",")
+			}
+			body = binary.BigEndian.AppendUint32(body, uint32(len(items)))
+			for _, item := range items {
+				body, err = appendSchemaValue(body, f.elemType, strings.TrimSpace(item))
+				if err != nil {
+					break
+				}
+			}
+		} else {
+			body, err = appendSchemaValue(body, f.typ, answer)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+	}
+	return body, nil
+}
+
+func appendSchemaValue(body []byte, fieldType byte, text string) ([]byte, error) {
+	switch fieldType {
+	case fieldInt8, fieldInt16, fieldInt32, fieldInt64:
+		bits := map[byte]int{fieldInt8: 8, fieldInt16: 16, fieldInt32: 32, fieldInt64: 64}[fieldType]
+		v, err := strconv.ParseInt(text, 10, bits)
+		if err != nil {
+			return nil, err
+		}
+		return appendUint(body, uint64(v), bits), nil
+	case fieldUint8, fieldUint16, fieldUint32, fieldUint64:
+		bits := map[byte]int{fieldUint8: 8, fieldUint16: 16, fieldUint32: 32, fieldUint64: 64}[fieldType]
+		v, err := strconv.ParseUint(text, 10, bits)
+		if err != nil {
+			return nil, err
+		}
+		return appendUint(body, v, bits), nil
+	case fieldFloat32:
+		v, err := strconv.ParseFloat(text, 32)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint32(body, math.Float32bits(float32(v))), nil
+	case fieldFloat64:
+		v, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(body, math.Float64bits(v)), nil
+	case fieldBool:
+		v, err := strconv.ParseBool(text)
+		if err != nil {
+			return nil, err
+		}
+		if v {
+			return append(body, 1), nil
+		}
+		return append(body, 0), nil
+	case fieldString:
+		body = binary.BigEndian.AppendUint32(body, uint32(len(text)))
+		return append(body, text...), nil
+	case fieldBytes:
+		data, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, err
+		}
+		body = binary.BigEndian.AppendUint32(body, uint32(len(data)))
+		return append(body, data...), nil
+	case fieldTimestamp:
+		t, err := time.Parse(time.RFC3339, text)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(body, uint64(t.UnixNano())), nil
+	}
+	return nil, fmt.Errorf("unknown field type %d", fieldType)
+}
+
+func appendUint(body []byte, v uint64, bits int) []byte {
+	switch bits {
+	case 8:
+		return append(body, byte(v))
+	case 16:
+		return binary.BigEndian.AppendUint16(body, uint16(v))
+	case 32:
+		return binary.BigEndian.AppendUint32(body, uint32(v))
+	}
+	return binary.BigEndian.AppendUint64(body, v)
+}
+
+func formatSchema(s dataSchema) string {
+	parts := make([]string, len(s.fields))
+	for i, f := range s.fields {
+		parts[i] = f.name + ":" + f.typeName()
+	}
+	return fmt.Sprintf("Schema %d (%s): %s", s.id, s.name, strings.Join(parts, ", "))
+}
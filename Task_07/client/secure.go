@@ -0,0 +1,29 @@
+package main
+
+import "../protocol"
+
+// Ciphers the client offers, in order of preference. How the channel and
+// the proof that stands in for the password hash work is described in the
+// protocol package.
+var supportedCiphers = []string{protocol.CipherAES256GCM, protocol.CipherChaCha20Poly1305}
+
+func (s *session) transcript() []byte {
+	return protocol.Transcript(s.clientHello, s.serverHello)
+}
+
+// authProof is the hex HMAC the client sends in place of the password hash.
+func authProof(passwordHash string, s *session) string {
+	return protocol.AuthProof(passwordHash, s.sharedSecret, s.transcript())
+}
+
+func (s *session) sessionKeys(purpose, passwordHash string) (clientKey, serverKey []byte, err error) {
+	return protocol.SessionKeys(purpose, passwordHash, s.sharedSecret, s.transcript())
+}
+
+func newSecureChannel(s *session, passwordHash string) (*protocol.SecureChannel, error) {
+	clientKey, serverKey, err := s.sessionKeys("encryption", passwordHash)
+	if err != nil {
+		return nil, err
+	}
+	return protocol.NewSecureChannel(s.features.ciphers[0], clientKey, serverKey)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// makeRaw puts the terminal on stdin into raw mode, so the line editor sees
+// each key as it is pressed, and returns a function that restores it. It
+// uses stty, so the client builds without platform specific code, and fails
+// if stdin is not a terminal or there is no stty.
+func makeRaw() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() { stty(strings.TrimSpace(saved)) }, nil
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
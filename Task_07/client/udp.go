@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"../protocol"
+)
+
+// dialUDP opens a UDP connection to address. The segments and the cookie
+// exchange that opens the connection are described in protocol/udp.go.
+func dialUDP(address string) (net.Conn, error) {
+	socket, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	idBuf := make([]byte, 4)
+	if _, err := rand.Read(idBuf); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	send := func(packet []byte, _ net.Addr) error {
+		_, err := socket.Write(packet)
+		return err
+	}
+	c := protocol.NewUDPConn(binary.BigEndian.Uint32(idBuf), nil, socket.LocalAddr(), socket.RemoteAddr(), send, func() { socket.Close() })
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := socket.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// An ICMP error for a lost packet; retransmission covers it
+				continue
+			}
+			c.Receive(buf[:n], socket.RemoteAddr())
+		}
+	}()
+	return c, nil
+}
@@ -0,0 +1,222 @@
+package protocol
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// ChaCha20-Poly1305 as specified in RFC 8439. The standard library does not
+// export it, so it is implemented here as a cipher.AEAD.
+
+const (
+	chachaKeySize   = 32
+	chachaNonceSize = 12
+	poly1305TagSize = 16
+)
+
+var errOpen = errors.New("message authentication failed")
+
+type chacha20Poly1305 struct {
+	key [chachaKeySize]byte
+}
+
+func newChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	if len(key) != chachaKeySize {
+		return nil, errors.New("chacha20poly1305: bad key length")
+	}
+	c := &chacha20Poly1305{}
+	copy(c.key[:], key)
+	return c, nil
+}
+
+func (c *chacha20Poly1305) NonceSize() int { return chachaNonceSize }
+
+func (c *chacha20Poly1305) Overhead() int { return poly1305TagSize }
+
+func (c *chacha20Poly1305) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != chachaNonceSize {
+		panic("chacha20poly1305: bad nonce length")
+	}
+	out := append(dst, make([]byte, len(plaintext)+poly1305TagSize)...)
+	ciphertext := out[len(dst) : len(dst)+len(plaintext)]
+	chachaXOR(ciphertext, plaintext, &c.key, nonce, 1)
+	tag := c.tag(nonce, ciphertext, additionalData)
+	copy(out[len(dst)+len(plaintext):], tag[:])
+	return out
+}
+
+func (c *chacha20Poly1305) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != chachaNonceSize {
+		panic("chacha20poly1305: bad nonce length")
+	}
+	if len(ciphertext) < poly1305TagSize {
+		return nil, errOpen
+	}
+	tag := ciphertext[len(ciphertext)-poly1305TagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-poly1305TagSize]
+	expected := c.tag(nonce, ciphertext, additionalData)
+	if subtle.ConstantTimeCompare(expected[:], tag) != 1 {
+		return nil, errOpen
+	}
+	out := append(dst, make([]byte, len(ciphertext))...)
+	chachaXOR(out[len(dst):], ciphertext, &c.key, nonce, 1)
+	return out, nil
+}
+
+// tag computes the Poly1305 tag over the additional data and ciphertext,
+// keyed with the first block of the key stream.
+func (c *chacha20Poly1305) tag(nonce, ciphertext, additionalData []byte) [poly1305TagSize]byte {
+	var block [64]byte
+	chachaBlock(&block, &c.key, nonce, 0)
+	mac := newPoly1305(block[:32])
+	mac.writePadded(additionalData)
+	mac.writePadded(ciphertext)
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(additionalData)))
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(ciphertext)))
+	mac.write(lengths[:])
+	return mac.sum()
+}
+
+func chachaQuarterRound(a, b, c, d uint32) (uint32, uint32, uint32, uint32) {
+	a += b
+	d = bits.RotateLeft32(d^a, 16)
+	c += d
+	b = bits.RotateLeft32(b^c, 12)
+	a += b
+	d = bits.RotateLeft32(d^a, 8)
+	c += d
+	b = bits.RotateLeft32(b^c, 7)
+	return a, b, c, d
+}
+
+func chachaBlock(out *[64]byte, key *[chachaKeySize]byte, nonce []byte, counter uint32) {
+	var s [16]uint32
+	s[0], s[1], s[2], s[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	for i := 0; i < 8; i++ {
+		s[4+i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+	s[12] = counter
+	s[13] = binary.LittleEndian.Uint32(nonce[0:])
+	s[14] = binary.LittleEndian.Uint32(nonce[4:])
+	s[15] = binary.LittleEndian.Uint32(nonce[8:])
+
+	x := s
+	for i := 0; i < 10; i++ {
+		x[0], x[4], x[8], x[12] = chachaQuarterRound(x[0], x[4], x[8], x[12])
+		x[1], x[5], x[9], x[13] = chachaQuarterRound(x[1], x[5], x[9], x[13])
+		x[2], x[6], x[10], x[14] = chachaQuarterRound(x[2], x[6], x[10], x[14])
+		x[3], x[7], x[11], x[15] = chachaQuarterRound(x[3], x[7], x[11], x[15])
+		x[0], x[5], x[10], x[15] = chachaQuarterRound(x[0], x[5], x[10], x[15])
+		x[1], x[6], x[11], x[12] = chachaQuarterRound(x[1], x[6], x[11], x[12])
+		x[2], x[7], x[8], x[13] = chachaQuarterRound(x[2], x[7], x[8], x[13])
+		x[3], x[4], x[9], x[14] = chachaQuarterRound(x[3], x[4], x[9], x[14])
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[4*i:], x[i]+s[i])
+	}
+}
+
+// chachaXOR XORs src with the key stream starting at block counter into dst.
+func chachaXOR(dst, src []byte, key *[chachaKeySize]byte, nonce []byte, counter uint32) {
+	var block [64]byte
+	for len(src) > 0 {
+		chachaBlock(&block, key, nonce, counter)
+		counter++
+		n := subtle.XORBytes(dst, src, block[:])
+		dst, src = dst[n:], src[n:]
+	}
+}
+
+// poly1305 accumulates h = (h + m) * r mod 2^130-5 over 16-byte blocks,
+// with h held in three 64-bit limbs.
+type poly1305 struct {
+	r0, r1     uint64
+	s0, s1     uint64
+	h0, h1, h2 uint64
+}
+
+func newPoly1305(key []byte) *poly1305 {
+	return &poly1305{
+		r0: binary.LittleEndian.Uint64(key[0:]) & 0x0FFFFFFC0FFFFFFF,
+		r1: binary.LittleEndian.Uint64(key[8:]) & 0x0FFFFFFC0FFFFFFC,
+		s0: binary.LittleEndian.Uint64(key[16:]),
+		s1: binary.LittleEndian.Uint64(key[24:]),
+	}
+}
+
+// writePadded absorbs data zero-padded to a multiple of 16 bytes.
+func (p *poly1305) writePadded(data []byte) {
+	full := len(data) &^ 15
+	p.write(data[:full])
+	if full < len(data) {
+		var block [16]byte
+		copy(block[:], data[full:])
+		p.write(block[:])
+	}
+}
+
+// write absorbs data, which must be a multiple of 16 bytes long.
+func (p *poly1305) write(data []byte) {
+	for len(data) >= 16 {
+		var c uint64
+		p.h0, c = bits.Add64(p.h0, binary.LittleEndian.Uint64(data[0:]), 0)
+		p.h1, c = bits.Add64(p.h1, binary.LittleEndian.Uint64(data[8:]), c)
+		p.h2 += c + 1
+		p.multiply()
+		data = data[16:]
+	}
+}
+
+func (p *poly1305) multiply() {
+	h0r0hi, h0r0lo := bits.Mul64(p.h0, p.r0)
+	h1r0hi, h1r0lo := bits.Mul64(p.h1, p.r0)
+	h0r1hi, h0r1lo := bits.Mul64(p.h0, p.r1)
+	h1r1hi, h1r1lo := bits.Mul64(p.h1, p.r1)
+	h2r0 := p.h2 * p.r0
+	h2r1 := p.h2 * p.r1
+
+	// m1 = h1*r0 + h0*r1, m2 = h2*r0 + h1*r1, m3 = h2*r1
+	m1lo, c := bits.Add64(h1r0lo, h0r1lo, 0)
+	m1hi, _ := bits.Add64(h1r0hi, h0r1hi, c)
+	m2lo, c := bits.Add64(h2r0, h1r1lo, 0)
+	m2hi, _ := bits.Add64(0, h1r1hi, c)
+
+	t0 := h0r0lo
+	t1, c := bits.Add64(h0r0hi, m1lo, 0)
+	t2, c := bits.Add64(m1hi, m2lo, c)
+	t3, _ := bits.Add64(m2hi, h2r1, c)
+
+	// Fold everything above 2^130 back in, times 5.
+	p.h0, p.h1, p.h2 = t0, t1, t2&3
+	cclo, cchi := t2&^3, t3
+	p.h0, c = bits.Add64(p.h0, cclo, 0)
+	p.h1, c = bits.Add64(p.h1, cchi, c)
+	p.h2 += c
+	cclo, cchi = cclo>>2|cchi<<62, cchi>>2
+	p.h0, c = bits.Add64(p.h0, cclo, 0)
+	p.h1, c = bits.Add64(p.h1, cchi, c)
+	p.h2 += c
+}
+
+func (p *poly1305) sum() [poly1305TagSize]byte {
+	// Subtract 2^130-5 if h is at least that large.
+	t0, b := bits.Sub64(p.h0, 0xFFFFFFFFFFFFFFFB, 0)
+	t1, b := bits.Sub64(p.h1, 0xFFFFFFFFFFFFFFFF, b)
+	_, b = bits.Sub64(p.h2, 3, b)
+	h0, h1 := p.h0, p.h1
+	if b == 0 {
+		h0, h1 = t0, t1
+	}
+
+	var c uint64
+	h0, c = bits.Add64(h0, p.s0, 0)
+	h1, _ = bits.Add64(h1, p.s1, c)
+	var tag [poly1305TagSize]byte
+	binary.LittleEndian.PutUint64(tag[0:], h0)
+	binary.LittleEndian.PutUint64(tag[8:], h1)
+	return tag
+}
@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Test vectors from RFC 8439.
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+const sunscreen = "Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it."
+
+func TestChaChaQuarterRound(t *testing.T) {
+	// Section 2.1.1
+	a, b, c, d := chachaQuarterRound(0x11111111, 0x01020304, 0x9b8d6f43, 0x01234567)
+	if a != 0xea2a92f4 || b != 0xcb1cf8ce || c != 0x4581472e || d != 0x5881c4bb {
+		t.Fatalf("quarter round = %08x %08x %08x %08x", a, b, c, d)
+	}
+}
+
+func TestChaCha20Encryption(t *testing.T) {
+	// Section 2.4.2
+	var key [chachaKeySize]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	nonce := unhex(t, "000000000000004a00000000")
+	want := unhex(t, `
+		6e2e359a2568f98041ba0728dd0d6981e97e7aec1d4360c20a27afccfd9fae0b
+		f91b65c5524733ab8f593dabcd62b3571639d624e65152ab8f530c359f0861d8
+		07ca0dbf500d6a6156a38e088a22b65e52bc514d16ccf806818ce91ab7793736
+		5af90bbf74a35be6b40b8eedf2785e42874d`)
+	got := make([]byte, len(sunscreen))
+	chachaXOR(got, []byte(sunscreen), &key, nonce, 1)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ciphertext = %x, want %x", got, want)
+	}
+}
+
+func TestChaCha20Poly1305Seal(t *testing.T) {
+	// Section 2.8.2
+	key := unhex(t, "808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+	nonce := unhex(t, "070000004041424344454647")
+	aad := unhex(t, "50515253c0c1c2c3c4c5c6c7")
+	want := unhex(t, `
+		d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d6
+		3dbea45e8ca9671282fafb69da92728b1a71de0a9e060b2905d6a5b67ecd3b36
+		92ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc
+		3ff4def08e4b7a9de576d26586cec64b6116
+		1ae10b594f09e26a7e902ecbd0600691`)
+
+	aead, err := newChaCha20Poly1305(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := aead.Seal(nil, nonce, []byte(sunscreen), aad)
+	if !bytes.Equal(sealed, want) {
+		t.Fatalf("sealed = %x, want %x", sealed, want)
+	}
+	opened, err := aead.Open(nil, nonce, sealed, aad)
+	if err != nil || string(opened) != sunscreen {
+		t.Fatalf("Open = %q, %v", opened, err)
+	}
+
+	for i := range sealed {
+		tampered := bytes.Clone(sealed)
+		tampered[i] ^= 0x80
+		if _, err := aead.Open(nil, nonce, tampered, aad); err == nil {
+			t.Fatalf("Open accepted a flipped bit in byte %d", i)
+		}
+	}
+	if _, err := aead.Open(nil, nonce, sealed, aad[1:]); err == nil {
+		t.Fatal("Open accepted different additional data")
+	}
+}
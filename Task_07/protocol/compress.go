@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Payloads at least CompressionThreshold bytes long are compressed when a
+// compression algorithm was negotiated, and sent compressed only if that
+// makes them smaller.
+const (
+	CompressionDeflate   = "deflate"
+	CompressionGzip      = "gzip"
+	CompressionThreshold = 512
+
+	// maxExpansionRatio bounds how much larger than its compressed form a
+	// payload may be, as a guard against decompression bombs.
+	maxExpansionRatio = 256
+)
+
+// Compress compresses payload with algorithm.
+func Compress(algorithm string, payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch algorithm {
+	case CompressionDeflate:
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = fw
+	case CompressionGzip:
+		w = gzip.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+	}
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress inflates payload, failing if the result would be
+// larger than limit bytes.
+func Decompress(algorithm string, payload []byte, limit uint32) ([]byte, error) {
+	var r io.ReadCloser
+	switch algorithm {
+	case CompressionDeflate:
+		r = flate.NewReader(bytes.NewReader(payload))
+	case CompressionGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) > uint64(limit) {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", limit)
+	}
+	return data, nil
+}
+
+// DecompressionLimit is the most a compressed payload of n bytes may
+// inflate to.
+func DecompressionLimit(n int, maxFrameSize uint32) uint32 {
+	return uint32(min(uint64(n)*maxExpansionRatio, uint64(maxFrameSize)))
+}
@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.Read(random)
+	payloads := map[string][]byte{
+		"empty":        {},
+		"short":        []byte("hello"),
+		"compressible": bytes.Repeat([]byte("all work and no play "), 1000),
+		"random":       random,
+	}
+	for _, algorithm := range []string{CompressionDeflate, CompressionGzip} {
+		for name, payload := range payloads {
+			compressed, err := Compress(algorithm, payload)
+			if err != nil {
+				t.Fatalf("%s %s: Compress: %v", algorithm, name, err)
+			}
+			got, err := Decompress(algorithm, compressed, uint32(len(payload)))
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Fatalf("%s %s: Decompress = %d bytes, %v, want the %d bytes compressed", algorithm, name, len(got), err, len(payload))
+			}
+		}
+	}
+}
+
+func TestDecompressRefusesBombs(t *testing.T) {
+	// A megabyte of zeros compresses to about a kilobyte
+	bomb := make([]byte, 1<<20)
+	for _, algorithm := range []string{CompressionDeflate, CompressionGzip} {
+		compressed, err := Compress(algorithm, bomb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			name  string
+			limit uint32
+			ok    bool
+		}{
+			{"exact limit", uint32(len(bomb)), true},
+			{"one byte short", uint32(len(bomb)) - 1, false},
+			{"expansion ratio", DecompressionLimit(len(compressed), 1<<30), false},
+			{"maximum frame size", DecompressionLimit(len(compressed)*1024, 1<<16), false},
+		}
+		for _, tt := range tests {
+			got, err := Decompress(algorithm, compressed, tt.limit)
+			if tt.ok != (err == nil) {
+				t.Errorf("%s %s: Decompress with limit %d = %d bytes, %v", algorithm, tt.name, tt.limit, len(got), err)
+			}
+		}
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	tests := []struct {
+		n            int
+		maxFrameSize uint32
+		want         uint32
+	}{
+		{0, 1024, 0},
+		{1, 1024, maxExpansionRatio},
+		{4, 1024, 1024},
+		{1 << 30, 1 << 24, 1 << 24}, // must not overflow
+	}
+	for _, tt := range tests {
+		if got := DecompressionLimit(tt.n, tt.maxFrameSize); got != tt.want {
+			t.Errorf("DecompressionLimit(%d, %d) = %d, want %d", tt.n, tt.maxFrameSize, got, tt.want)
+		}
+	}
+}
+
+func TestDecompressRejectsBadInput(t *testing.T) {
+	compressed, err := Compress(CompressionGzip, []byte("some text to compress"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		algorithm string
+		payload   []byte
+	}{
+		{"unknown algorithm", "lz4", compressed},
+		{"truncated", CompressionGzip, compressed[:len(compressed)-6]},
+		{"not gzip", CompressionGzip, []byte("plain text")},
+		{"wrong algorithm", CompressionDeflate, compressed},
+	}
+	for _, tt := range tests {
+		if got, err := Decompress(tt.algorithm, tt.payload, 1024); err == nil {
+			t.Errorf("%s: Decompress = %q", tt.name, got)
+		}
+	}
+	if _, err := Compress("lz4", []byte("x")); err == nil {
+		t.Error("Compress accepted an unknown algorithm")
+	}
+}
@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIntegritySealVerify(t *testing.T) {
+	data := []byte("envelope header and payload")
+	tampered := append(bytes.Clone(data[:len(data)-1]), '!')
+	key := bytes.Repeat([]byte{1}, 32)
+	tests := []struct {
+		algorithm string
+		size      int
+	}{
+		{ChecksumCRC32IEEE, 4},
+		{ChecksumCRC32C, 4},
+		{ChecksumHMACSHA256, 32},
+	}
+	for _, tt := range tests {
+		sender := Integrity{Algorithm: tt.algorithm, SendKey: key}
+		receiver := Integrity{Algorithm: tt.algorithm, RecvKey: key}
+		trailer := sender.Seal(data)
+		if len(trailer) != tt.size || sender.Size() != tt.size {
+			t.Errorf("%s: trailer of %d bytes, Size %d, want %d", tt.algorithm, len(trailer), sender.Size(), tt.size)
+		}
+		if !receiver.Verify(data, trailer) {
+			t.Errorf("%s: trailer does not verify", tt.algorithm)
+		}
+		if receiver.Verify(tampered, trailer) {
+			t.Errorf("%s: tampered data verifies", tt.algorithm)
+		}
+	}
+
+	// The two CRCs must not be mistaken for each other
+	ieee := Integrity{Algorithm: ChecksumCRC32IEEE}
+	if (Integrity{Algorithm: ChecksumCRC32C}).Verify(data, ieee.Seal(data)) {
+		t.Error("CRC32C accepts a CRC32-IEEE trailer")
+	}
+
+	// Anyone can recompute a CRC, but not an HMAC without the key
+	forger := Integrity{Algorithm: ChecksumHMACSHA256, SendKey: bytes.Repeat([]byte{2}, 32)}
+	if (Integrity{Algorithm: ChecksumHMACSHA256, RecvKey: key}).Verify(tampered, forger.Seal(tampered)) {
+		t.Error("HMAC-SHA256 accepts a trailer sealed with another key")
+	}
+}
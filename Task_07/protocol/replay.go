@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// From protocol version 9 every envelope carries a sequence number, which
+// the integrity check covers. Each direction numbers its frames from 1. The
+// receiver accepts a frame only if its number is new and no more than
+// ReplayWindowSize behind the highest number seen, so a captured frame
+// cannot be sent again on the same session.
+const ReplayWindowSize = 64
+
+// ReplayWindow remembers which of the last ReplayWindowSize sequence
+// numbers have been received. Bit i of seen stands for highest-i.
+type ReplayWindow struct {
+	highest uint64
+	seen    uint64
+}
+
+// NewReplayWindow returns a window in which 0, never a valid sequence
+// number, counts as received.
+func NewReplayWindow() *ReplayWindow {
+	return &ReplayWindow{seen: 1}
+}
+
+// ReplayError reports a frame rejected by the replay window.
+type ReplayError struct {
+	Seq       uint64
+	Reason    string
+	Duplicate bool
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("sequence number %d %s", e.Seq, e.Reason)
+}
+
+// Accept records seq, or rejects it if it is a duplicate or too old.
+func (w *ReplayWindow) Accept(seq uint64) error {
+	if seq > w.highest {
+		shift := seq - w.highest
+		if shift >= ReplayWindowSize {
+			w.seen = 1
+		} else {
+			w.seen = w.seen<<shift | 1
+		}
+		w.highest = seq
+		return nil
+	}
+	if w.highest-seq >= ReplayWindowSize {
+		return &ReplayError{Seq: seq, Reason: fmt.Sprintf("is outside the replay window ending at %d", w.highest)}
+	}
+	bit := uint64(1) << (w.highest - seq)
+	if w.seen&bit != 0 {
+		return &ReplayError{Seq: seq, Reason: "was already received", Duplicate: true}
+	}
+	w.seen |= bit
+	return nil
+}
+
+// DroppedFrame reports whether err means that one frame was discarded and
+// the stream can still be read.
+func DroppedFrame(err error) bool {
+	var integrityErr *IntegrityError
+	var replayErr *ReplayError
+	return errors.As(err, &integrityErr) || errors.As(err, &replayErr)
+}
@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	w := NewReplayWindow()
+	steps := []struct {
+		seq       uint64
+		ok        bool
+		duplicate bool
+	}{
+		{0, false, true},
+		{1, true, false},
+		{3, true, false},
+		{2, true, false}, // reordered within the window
+		{3, false, true},
+		{100, true, false},
+		{100 - ReplayWindowSize + 1, true, false},
+		{100 - ReplayWindowSize + 1, false, true},
+		{100 - ReplayWindowSize, false, false}, // too old
+		{50, true, false},
+		{99, true, false},
+	}
+	for _, step := range steps {
+		err := w.Accept(step.seq)
+		if (err == nil) != step.ok {
+			t.Fatalf("Accept(%d) = %v, want ok %v", step.seq, err, step.ok)
+		}
+		var replayErr *ReplayError
+		if err != nil && (!errors.As(err, &replayErr) || replayErr.Duplicate != step.duplicate) {
+			t.Fatalf("Accept(%d) = %v, want duplicate %v", step.seq, err, step.duplicate)
+		}
+	}
+}
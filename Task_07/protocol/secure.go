@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// When both peers agree on a cipher, the hellos carry ephemeral X25519
+// public keys. The shared secret, salted with the user's password hash,
+// yields one key per direction, and every envelope payload is sealed with
+// the agreed AEAD. The nonce of a frame is its sequence number in that
+// direction: counted on both sides in version 8, where a frame that is
+// replayed, reordered or dropped fails to open, and sent in the envelope
+// from version 9, where the replay window guards against reuse.
+//
+// Authentication on such a channel, or on one with HMAC integrity, whose
+// keys derive the same way, never sends the password hash. The client
+// proves knowledge of it with an HMAC over the shared secret and the
+// handshake transcript, which also binds the key exchange to the user: a
+// relay without the password hash can neither forge the proof nor derive
+// the keys.
+const (
+	CipherAES256GCM        = "aes-256-gcm"
+	CipherChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+const channelKeySize = 32
+
+// NewAEAD returns the named cipher keyed with key.
+func NewAEAD(name string, key []byte) (cipher.AEAD, error) {
+	switch name {
+	case CipherAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return newChaCha20Poly1305(key)
+	}
+	return nil, fmt.Errorf("unknown cipher %q", name)
+}
+
+// Transcript is what the handshake contributed to the channel: a hash of
+// both hellos as sent. A relay that alters either leaves the peers with
+// different transcripts, so the proof fails and the keys differ. That
+// only helps once a proof is sent: a relay that strips every cipher, key
+// share and HMAC checksum from the client hello leaves nothing to prove
+// with, so the client must then refuse to send the password hash rather
+// than fall back to it.
+func Transcript(clientHello, serverHello []byte) []byte {
+	h := sha256.New()
+	for _, part := range [][]byte{clientHello, serverHello} {
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(part))))
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// AuthProof is the hex HMAC the client sends in place of the password
+// hash.
+func AuthProof(passwordHash string, sharedSecret, transcript []byte) string {
+	mac := hmac.New(sha256.New, []byte(passwordHash))
+	mac.Write([]byte("authentication"))
+	mac.Write(sharedSecret)
+	mac.Write(transcript)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SessionKeys derives one key per direction for purpose from the shared
+// secret, salted with the password hash and bound to the transcript.
+func SessionKeys(purpose, passwordHash string, sharedSecret, transcript []byte) (clientKey, serverKey []byte, err error) {
+	keys := make([][]byte, 2)
+	for i, direction := range []string{"client to server", "server to client"} {
+		info := purpose + " " + direction + string(transcript)
+		keys[i], err = hkdf.Key(sha256.New, sharedSecret, []byte(passwordHash), info, channelKeySize)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return keys[0], keys[1], nil
+}
+
+// SecureChannel seals and opens envelope payloads with one key per
+// direction.
+type SecureChannel struct {
+	Name string
+	send cipher.AEAD
+	recv cipher.AEAD
+}
+
+func NewSecureChannel(name string, sendKey, recvKey []byte) (*SecureChannel, error) {
+	send, err := NewAEAD(name, sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := NewAEAD(name, recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureChannel{Name: name, send: send, recv: recv}, nil
+}
+
+// Overhead is the length of the tag that follows every sealed payload.
+func (c *SecureChannel) Overhead() int {
+	return c.send.Overhead()
+}
+
+func channelNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+// Seal appends the encrypted payload and its tag to header, which it
+// authenticates. seq must never repeat.
+func (c *SecureChannel) Seal(header []byte, seq uint64, payload []byte) []byte {
+	return c.send.Seal(header, channelNonce(c.send, seq), payload, header)
+}
+
+// Open decrypts a payload followed by its tag.
+func (c *SecureChannel) Open(header []byte, seq uint64, sealed []byte) ([]byte, bool) {
+	payload, err := c.recv.Open(nil, channelNonce(c.recv, seq), sealed, header)
+	return payload, err == nil
+}
@@ -0,0 +1,294 @@
+// Package protocol holds the encodings that the client and the server
+// share.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message bodies can be encoded as a sequence of tag-length-value items:
+//
+//	[tag uint16][length uint32][value]
+//
+// A decoder skips tags it does not know, so new optional fields can be
+// added without breaking older peers. A tag may repeat to carry a list.
+//
+// Go structs map to TLV through field tags such as `tlv:"1"` or
+// `tlv:"2,omitempty"`. Integers are big-endian and sized by their Go type
+// on encode, but any of 1, 2, 4 or 8 bytes is accepted on decode so that a
+// field can be widened later. Floats are IEEE 754, bools one byte, strings
+// and []byte raw, time.Time int64 unix nanoseconds, nested structs a
+// nested TLV body and other slices one item per element.
+
+const tlvHeaderSize = 2 + 4
+
+// ErrMalformedTLV reports a body whose items overrun it or whose values
+// do not fit their fields.
+var ErrMalformedTLV = errors.New("malformed TLV")
+
+// TLVField is one item of a TLV body.
+type TLVField struct {
+	Tag   uint16
+	Value []byte
+}
+
+// AppendTLV appends one item to buf.
+func AppendTLV(buf []byte, tag uint16, value []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, tag)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(value)))
+	return append(buf, value...)
+}
+
+// ParseTLV splits a TLV body into its items. The values alias data.
+func ParseTLV(data []byte) ([]TLVField, error) {
+	var fields []TLVField
+	for len(data) > 0 {
+		if len(data) < tlvHeaderSize {
+			return nil, ErrMalformedTLV
+		}
+		tag := binary.BigEndian.Uint16(data)
+		length := binary.BigEndian.Uint32(data[2:])
+		data = data[tlvHeaderSize:]
+		if uint64(length) > uint64(len(data)) {
+			return nil, ErrMalformedTLV
+		}
+		fields = append(fields, TLVField{Tag: tag, Value: data[:length]})
+		data = data[length:]
+	}
+	return fields, nil
+}
+
+type tlvStructField struct {
+	index     int
+	tag       uint16
+	omitEmpty bool
+}
+
+func tlvStructFields(t reflect.Type) ([]tlvStructField, error) {
+	var fields []tlvStructField
+	seen := make(map[uint16]string)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		spec, ok := f.Tag.Lookup("tlv")
+		if !ok || spec == "-" {
+			continue
+		}
+		tagText, options, _ := strings.Cut(spec, ",")
+		tag, err := strconv.ParseUint(tagText, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("tlv: field %s.%s has invalid tag %q", t.Name(), f.Name, tagText)
+		}
+		if other, dup := seen[uint16(tag)]; dup {
+			return nil, fmt.Errorf("tlv: fields %s and %s of %s share tag %d", other, f.Name, t.Name(), tag)
+		}
+		seen[uint16(tag)] = f.Name
+		fields = append(fields, tlvStructField{index: i, tag: uint16(tag), omitEmpty: options == "omitempty"})
+	}
+	return fields, nil
+}
+
+// MarshalTLV encodes a struct, or a pointer to one, as a TLV body.
+func MarshalTLV(v any) ([]byte, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("tlv: cannot marshal %T", v)
+	}
+	return appendTLVStruct(nil, rv)
+}
+
+func appendTLVStruct(buf []byte, rv reflect.Value) ([]byte, error) {
+	fields, err := tlvStructFields(rv.Type())
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		fv := rv.Field(f.index)
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 {
+			for i := 0; i < fv.Len(); i++ {
+				value, err := encodeTLVValue(fv.Index(i))
+				if err != nil {
+					return nil, fmt.Errorf("tlv: tag %d: %w", f.tag, err)
+				}
+				buf = AppendTLV(buf, f.tag, value)
+			}
+			continue
+		}
+		value, err := encodeTLVValue(fv)
+		if err != nil {
+			return nil, fmt.Errorf("tlv: tag %d: %w", f.tag, err)
+		}
+		buf = AppendTLV(buf, f.tag, value)
+	}
+	return buf, nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func encodeTLVValue(v reflect.Value) ([]byte, error) {
+	if v.Type() == timeType {
+		return binary.BigEndian.AppendUint64(nil, uint64(v.Interface().(time.Time).UnixNano())), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+		return encodeTLVUint(uint64(v.Int()), v.Type().Size()), nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+		return encodeTLVUint(v.Uint(), v.Type().Size()), nil
+	case reflect.Float32:
+		return binary.BigEndian.AppendUint32(nil, math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		return binary.BigEndian.AppendUint64(nil, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return []byte(v.String()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append([]byte(nil), v.Bytes()...), nil
+		}
+	case reflect.Struct:
+		return appendTLVStruct(nil, v)
+	}
+	return nil, fmt.Errorf("unsupported type %s", v.Type())
+}
+
+func encodeTLVUint(u uint64, size uintptr) []byte {
+	switch size {
+	case 1:
+		return []byte{byte(u)}
+	case 2:
+		return binary.BigEndian.AppendUint16(nil, uint16(u))
+	case 4:
+		return binary.BigEndian.AppendUint32(nil, uint32(u))
+	}
+	return binary.BigEndian.AppendUint64(nil, u)
+}
+
+// UnmarshalTLV decodes a TLV body into the struct v points to. Unknown tags
+// are skipped and fields without an item keep their current value.
+func UnmarshalTLV(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("tlv: cannot unmarshal into %T", v)
+	}
+	return decodeTLVStruct(data, rv.Elem())
+}
+
+func decodeTLVStruct(data []byte, rv reflect.Value) error {
+	items, err := ParseTLV(data)
+	if err != nil {
+		return err
+	}
+	fields, err := tlvStructFields(rv.Type())
+	if err != nil {
+		return err
+	}
+	byTag := make(map[uint16]reflect.Value, len(fields))
+	for _, f := range fields {
+		byTag[f.tag] = rv.Field(f.index)
+	}
+
+	for _, item := range items {
+		fv, ok := byTag[item.Tag]
+		if !ok {
+			continue
+		}
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 {
+			elem := reflect.New(fv.Type().Elem()).Elem()
+			if err := decodeTLVValue(item.Value, elem); err != nil {
+				return fmt.Errorf("tlv: tag %d: %w", item.Tag, err)
+			}
+			fv.Set(reflect.Append(fv, elem))
+			continue
+		}
+		if err := decodeTLVValue(item.Value, fv); err != nil {
+			return fmt.Errorf("tlv: tag %d: %w", item.Tag, err)
+		}
+	}
+	return nil
+}
+
+func decodeTLVValue(value []byte, v reflect.Value) error {
+	if v.Type() == timeType {
+		if len(value) != 8 {
+			return ErrMalformedTLV
+		}
+		v.Set(reflect.ValueOf(time.Unix(0, int64(binary.BigEndian.Uint64(value)))))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if len(value) != 1 || value[0] > 1 {
+			return ErrMalformedTLV
+		}
+		v.SetBool(value[0] == 1)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+		u, err := decodeTLVUint(value)
+		if err != nil {
+			return err
+		}
+		// Sign-extend from the encoded width.
+		shift := 64 - 8*len(value)
+		i := int64(u<<shift) >> shift
+		if v.OverflowInt(i) {
+			return fmt.Errorf("value %d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+		u, err := decodeTLVUint(value)
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(u) {
+			return fmt.Errorf("value %d overflows %s", u, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch len(value) {
+		case 4:
+			v.SetFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(value))))
+		case 8:
+			v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(value)))
+		default:
+			return ErrMalformedTLV
+		}
+	case reflect.String:
+		v.SetString(string(value))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		v.SetBytes(append([]byte(nil), value...))
+	case reflect.Struct:
+		return decodeTLVStruct(value, v)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func decodeTLVUint(value []byte) (uint64, error) {
+	switch len(value) {
+	case 1:
+		return uint64(value[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(value)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(value)), nil
+	case 8:
+		return binary.BigEndian.Uint64(value), nil
+	}
+	return 0, ErrMalformedTLV
+}
@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type tlvInner struct {
+	Level uint8  `tlv:"1"`
+	Name  string `tlv:"2"`
+}
+
+type tlvOuter struct {
+	Small   int16     `tlv:"1"`
+	Names   []string  `tlv:"2"`
+	Inner   tlvInner  `tlv:"3"`
+	At      time.Time `tlv:"4"`
+	Ratio   float32   `tlv:"5"`
+	Raw     []byte    `tlv:"6,omitempty"`
+	Enabled bool      `tlv:"7"`
+	Counts  []uint32  `tlv:"8"`
+}
+
+// tlvOlder is what a peer that knows fewer tags and a wider Small decodes.
+type tlvOlder struct {
+	Small int64    `tlv:"1"`
+	Inner tlvInner `tlv:"3"`
+}
+
+func TestTLVRoundTrip(t *testing.T) {
+	in := tlvOuter{
+		Small:   -5,
+		Names:   []string{"a", "b"},
+		Inner:   tlvInner{Level: 7, Name: "q"},
+		At:      time.Unix(0, 123),
+		Ratio:   1.5,
+		Enabled: true,
+		Counts:  []uint32{1, 2},
+	}
+	data, err := MarshalTLV(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out tlvOuter
+	if err := UnmarshalTLV(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip gave %+v, want %+v", out, in)
+	}
+
+	var older tlvOlder
+	if err := UnmarshalTLV(data, &older); err != nil {
+		t.Fatal(err)
+	}
+	if older.Small != -5 || older.Inner != in.Inner {
+		t.Fatalf("older peer decoded %+v", older)
+	}
+}
+
+func TestTLVOmitEmpty(t *testing.T) {
+	data, err := MarshalTLV(tlvOuter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := ParseTLV(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fields {
+		if f.Tag == 6 {
+			t.Fatal("omitempty field was encoded")
+		}
+	}
+}
+
+func TestTLVMalformed(t *testing.T) {
+	valid := AppendTLV(nil, 2, []byte("name"))
+	overlong := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint16(nil, 2), 0xFFFFFFFF)
+	cases := map[string][]byte{
+		"short header":     valid[:3],
+		"short value":      valid[:len(valid)-1],
+		"overlong length":  append(overlong, 'x'),
+		"bad integer size": AppendTLV(nil, 1, []byte{1, 2, 3}),
+	}
+	for name, data := range cases {
+		var out tlvInner
+		if err := UnmarshalTLV(data, &out); !errors.Is(err, ErrMalformedTLV) {
+			t.Errorf("%s: error = %v, want ErrMalformedTLV", name, err)
+		}
+	}
+}
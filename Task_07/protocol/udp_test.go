@@ -0,0 +1,172 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testUDPKey = bytes.Repeat([]byte{5}, UDPCookieSize)
+
+// udpLink joins two connections in memory. It drops a share of the
+// packets and delays the rest by a random amount, so they also arrive out
+// of order.
+type udpLink struct {
+	mu   sync.Mutex
+	rng  *rand.Rand
+	loss float64
+}
+
+func (l *udpLink) to(peer func() *UDPConn, from net.Addr) func([]byte, net.Addr) error {
+	return func(packet []byte, _ net.Addr) error {
+		l.mu.Lock()
+		drop := l.rng.Float64() < l.loss
+		delay := time.Duration(l.rng.IntN(5)) * time.Millisecond
+		l.mu.Unlock()
+		if drop {
+			return nil
+		}
+		packet = bytes.Clone(packet)
+		time.AfterFunc(delay, func() { peer().Receive(packet, from) })
+		return nil
+	}
+}
+
+func udpPair(loss float64) (*UDPConn, *UDPConn) {
+	link := &udpLink{rng: rand.New(rand.NewPCG(1, 2)), loss: loss}
+	addrA := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	addrB := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	var a, b *UDPConn
+	a = NewUDPConn(7, testUDPKey, addrA, addrB, link.to(func() *UDPConn { return b }, addrA), nil)
+	b = NewUDPConn(7, testUDPKey, addrB, addrA, link.to(func() *UDPConn { return a }, addrB), nil)
+	return a, b
+}
+
+func TestUDPConnLossyLink(t *testing.T) {
+	a, b := udpPair(0.3)
+	defer b.Close()
+
+	want := make([]byte, 30*UDPMaxPayload+123)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	go func() {
+		a.Write(want)
+		a.Close()
+	}()
+	b.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("received %d bytes that differ from the %d sent", len(got), len(want))
+	}
+}
+
+func unackedSegments(c *UDPConn) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.unacked)
+}
+
+func TestUDPConnIgnoresAckForUnsentSegment(t *testing.T) {
+	sent := make(chan []byte, 16)
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	c := NewUDPConn(7, testUDPKey, nil, remote, func(packet []byte, _ net.Addr) error {
+		sent <- packet
+		return nil
+	}, nil)
+	defer c.Stop()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	<-sent
+
+	c.Receive(EncodeUDPPacket(UDPPacket{Kind: UDPAck, ID: 7, Ack: 2}, testUDPKey), remote)
+	if n := unackedSegments(c); n != 1 {
+		t.Fatalf("%d segments unacknowledged after an ack for segment 2, want 1", n)
+	}
+	c.Receive(EncodeUDPPacket(UDPPacket{Kind: UDPAck, ID: 7, Ack: 1}, testUDPKey), remote)
+	if n := unackedSegments(c); n != 0 {
+		t.Fatalf("%d segments unacknowledged after an ack for segment 1, want 0", n)
+	}
+}
+
+func TestUDPConnFollowsPeerOnlyOnNewSegment(t *testing.T) {
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	spoofed := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3}
+	moved := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4}
+	c := NewUDPConn(7, testUDPKey, nil, remote, func([]byte, net.Addr) error { return nil }, nil)
+	defer c.Stop()
+
+	keyed := func(p UDPPacket) []byte { return EncodeUDPPacket(p, testUDPKey) }
+	c.Receive(keyed(UDPPacket{Kind: UDPData, ID: 7, Seq: 1, Payload: []byte("a")}), remote)
+	steps := []struct {
+		name string
+		data []byte
+		from net.Addr
+		want net.Addr
+	}{
+		{"duplicate", keyed(UDPPacket{Kind: UDPData, ID: 7, Seq: 1, Payload: []byte("a")}), spoofed, remote},
+		{"early", keyed(UDPPacket{Kind: UDPData, ID: 7, Seq: 3, Payload: []byte("c")}), spoofed, remote},
+		{"ack", keyed(UDPPacket{Kind: UDPAck, ID: 7}), spoofed, remote},
+		// Without the cookie the next segment cannot be forged
+		{"unkeyed", EncodeUDPPacket(UDPPacket{Kind: UDPData, ID: 7, Seq: 2, Payload: []byte("x")}, nil), spoofed, remote},
+		{"other key", EncodeUDPPacket(UDPPacket{Kind: UDPData, ID: 7, Seq: 2, Payload: []byte("x")}, bytes.Repeat([]byte{9}, UDPCookieSize)), spoofed, remote},
+		{"next", keyed(UDPPacket{Kind: UDPData, ID: 7, Seq: 2, Payload: []byte("b")}), moved, moved},
+	}
+	for _, step := range steps {
+		c.Receive(step.data, step.from)
+		if got := c.RemoteAddr(); got.String() != step.want.String() {
+			t.Fatalf("%s: remote %v, want %v", step.name, got, step.want)
+		}
+	}
+	c.SetReadDeadline(time.Now())
+	got := make([]byte, 8)
+	if n, _ := c.Read(got); string(got[:n]) != "abc" {
+		t.Fatalf("read %q, want %q", got[:n], "abc")
+	}
+}
+
+func TestUDPConnTakesKeyFromCookie(t *testing.T) {
+	var sent []UDPPacket
+	var keys [][]byte
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	c := NewUDPConn(7, nil, nil, remote, func(packet []byte, _ net.Addr) error {
+		for _, key := range [][]byte{nil, testUDPKey} {
+			if p, ok := DecodeUDPPacket(packet, key); ok {
+				sent, keys = append(sent, p), append(keys, key)
+			}
+		}
+		return nil
+	}, nil)
+	defer c.Stop()
+	if _, err := c.Write([]byte("first segment")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing but the cookie is taken before there is a key
+	c.Receive(EncodeUDPPacket(UDPPacket{Kind: UDPAck, ID: 7, Ack: 1}, nil), remote)
+	if n := unackedSegments(c); n != 1 {
+		t.Fatalf("unkeyed ack taken before the cookie")
+	}
+	c.Receive(EncodeUDPPacket(UDPPacket{Kind: UDPCookie, ID: 7, Payload: testUDPKey}, nil), remote)
+	if len(sent) != 3 || sent[1].Kind != UDPCookieEcho || keys[1] != nil || sent[2].Seq != 1 || keys[2] == nil {
+		t.Fatalf("sent %+v, want the first segment, the echo, then the first segment keyed", sent)
+	}
+
+	// Once a keyed packet arrives, cookies are ignored
+	c.Receive(EncodeUDPPacket(UDPPacket{Kind: UDPAck, ID: 7, Ack: 1}, testUDPKey), remote)
+	if n := unackedSegments(c); n != 0 {
+		t.Fatalf("%d segments unacknowledged after a keyed ack", n)
+	}
+	c.Receive(EncodeUDPPacket(UDPPacket{Kind: UDPCookie, ID: 7, Payload: make([]byte, UDPCookieSize)}, nil), remote)
+	if len(sent) != 3 {
+		t.Fatalf("answered a cookie after the connection opened: %+v", sent[3:])
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"../protocol"
+)
+
+// When acknowledgements are negotiated the server answers every envelope
+// it receives with one of these frames, naming the envelope's sequence
+// number:
+//
+//	[0x12 or 0x13][sequence uint64]
+//
+// 0x12 confirms the frame arrived intact, 0x13 asks for it to be sent
+// again. A retransmitted frame the server already has is acknowledged again
+// and not handled twice.
+const (
+	frameAck  = 0x12
+	frameNack = 0x13
+)
+
+func acknowledge(s *session, seq uint64, ok bool) {
+	messageType := byte(frameAck)
+	if !ok {
+		messageType = frameNack
+	}
+	s.write(binary.BigEndian.AppendUint64([]byte{messageType}, seq))
+}
+
+// reportDroppedFrame tells the client about a frame the envelope reader
+// discarded.
+func reportDroppedFrame(s *session, err error) {
+	var replayErr *protocol.ReplayError
+	var integrityErr *protocol.IntegrityError
+	if errors.As(err, &integrityErr) {
+		checksumFailures.with(frameTypeLabel(integrityErr.MessageType)).inc()
+	}
+	switch {
+	case errors.As(err, &replayErr) && replayErr.Duplicate && s.features.acknowledgements:
+		// A retransmission whose acknowledgement was lost
+		fmt.Println("Acknowledging duplicate frame", replayErr.Seq)
+		acknowledge(s, replayErr.Seq, true)
+	case errors.As(err, &replayErr):
+		fmt.Printf("Potential replay attempt from %s: %v\n", s.username, err)
+		sendResponse(s, "Replayed frame rejected: "+err.Error())
+	case errors.As(err, &integrityErr) && s.features.acknowledgements:
+		fmt.Println("Received invalid frame, requesting retransmission:", err)
+		acknowledge(s, integrityErr.Seq, false)
+	default:
+		fmt.Println("Received invalid frame:", err)
+		sendResponse(s, "Invalid frame: "+err.Error())
+	}
+}
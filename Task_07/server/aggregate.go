@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// aggregationRequest is a decoded 0x0C request. Stored packets matching
+// the filters are grouped by dataField1 and by time bucket, and dataField2
+// is summarized for each group.
+type aggregationRequest struct {
+	filters     packetQuery
+	bucketWidth int64   // nanoseconds; 0 puts every packet in one bucket
+	percentile  float64 // in [0, 100]
+}
+
+// aggregationGroup summarizes dataField2 over one dataField1 value in one
+// time bucket.
+type aggregationGroup struct {
+	bucketStart int64
+	dataField1  uint32
+	count       uint64
+	min         float64
+	max         float64
+	mean        float64
+	percentile  float64
+}
+
+// readAggregationRequest reads the body of a 0x0C aggregation request,
+// which is the query filters followed by
+//
+//	[bucket width nanoseconds uint64][percentile float64]
+//
+// The raw message, without the checksum, is returned for validation.
+func readAggregationRequest(reader *frameReader) (aggregationRequest, []byte, error) {
+	var req aggregationRequest
+	filters, message, err := readQueryFilters(reader, []byte{0x0C})
+	if err != nil {
+		return req, nil, err
+	}
+	req.filters = filters
+
+	options := make([]byte, 8+8)
+	if _, err := io.ReadFull(reader, options); err != nil {
+		return req, nil, err
+	}
+	message = append(message, options...)
+	req.bucketWidth = int64(binary.BigEndian.Uint64(options))
+	req.percentile = math.Float64frombits(binary.BigEndian.Uint64(options[8:]))
+	return req, message, nil
+}
+
+// aggregate computes the groups for req from the stored packets. Groups are
+// ordered by bucket, then by dataField1.
+func (s *packetStore) aggregate(req aggregationRequest) ([]aggregationGroup, error) {
+	type groupKey struct {
+		bucketStart int64
+		dataField1  uint32
+	}
+
+	view, ids := s.view(req.filters)
+	values := make(map[groupKey][]float64)
+	for _, id := range ids {
+		entry := view.entries[id]
+		if math.IsNaN(entry.dataField2) || math.IsInf(entry.dataField2, 0) {
+			// Stored before such values were refused
+			continue
+		}
+		if req.filters.flags&queryByDataField3 != 0 {
+			packet, err := view.read(id)
+			if err != nil {
+				return nil, err
+			}
+			if !strings.Contains(packet.dataField3, req.filters.dataField3) {
+				continue
+			}
+		}
+
+		key := groupKey{dataField1: entry.dataField1}
+		if req.bucketWidth > 0 {
+			key.bucketStart = entry.receivedAt - mod(entry.receivedAt, req.bucketWidth)
+		}
+		values[key] = append(values[key], entry.dataField2)
+	}
+
+	groups := make([]aggregationGroup, 0, len(values))
+	for key, groupValues := range values {
+		sort.Float64s(groupValues)
+		sum := 0.0
+		for _, v := range groupValues {
+			sum += v
+		}
+		groups = append(groups, aggregationGroup{
+			bucketStart: key.bucketStart,
+			dataField1:  key.dataField1,
+			count:       uint64(len(groupValues)),
+			min:         groupValues[0],
+			max:         groupValues[len(groupValues)-1],
+			mean:        sum / float64(len(groupValues)),
+			percentile:  percentileOf(groupValues, req.percentile),
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].bucketStart != groups[j].bucketStart {
+			return groups[i].bucketStart < groups[j].bucketStart
+		}
+		return groups[i].dataField1 < groups[j].dataField1
+	})
+	return groups, nil
+}
+
+// mod returns a modulo b with the sign of b, so that buckets before the
+// epoch start at or below the timestamp.
+func mod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
+
+// percentileOf returns the p-th percentile of sorted, interpolating
+// linearly between the closest ranks.
+func percentileOf(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	weight := rank - float64(lower)
+	return sorted[lower]*(1-weight) + sorted[upper]*weight
+}
+
+// buildAggregationResult builds the 0x0D aggregation result frame:
+//
+//	[group count uint32][percentile float64]
+//	per group: [bucket start int64][dataField1 uint32][count uint64]
+//	           [min float64][max float64][mean float64][percentile value float64]
+func buildAggregationResult(percentile float64, groups []aggregationGroup) []byte {
+	buf := make([]byte, 0, 1+4+8+len(groups)*(8+4+8+8*4))
+	buf = append(buf, 0x0D)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(groups)))
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(percentile))
+	for _, g := range groups {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(g.bucketStart))
+		buf = binary.BigEndian.AppendUint32(buf, g.dataField1)
+		buf = binary.BigEndian.AppendUint64(buf, g.count)
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(g.min))
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(g.max))
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(g.mean))
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(g.percentile))
+	}
+	return buf
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAggregateWithOutOfOrderTimes(t *testing.T) {
+	store := openTestStore(t, []storedPacket{
+		packetAt(30, 1, "keep"),
+		packetAt(10, 1, "keep"),
+		packetAt(20, 2, "keep"),
+		packetAt(50, 1, "keep"),
+		packetAt(40, 1, "drop"),
+		packetAt(25, 1, "keep"),
+	})
+
+	filters := packetQuery{flags: queryByTime | queryByDataField3, from: 20, to: 50, dataField3: "keep"}
+	groups, err := store.aggregate(aggregationRequest{filters: filters, bucketWidth: 20, percentile: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []aggregationGroup{
+		{bucketStart: 20, dataField1: 1, count: 2, min: 25, max: 30, mean: 27.5, percentile: 27.5},
+		{bucketStart: 20, dataField1: 2, count: 1, min: 20, max: 20, mean: 20, percentile: 20},
+	}
+	if len(groups) != len(want) {
+		t.Fatalf("aggregate = %+v, want %+v", groups, want)
+	}
+	for i := range want {
+		if groups[i] != want[i] {
+			t.Errorf("group %d = %+v, want %+v", i, groups[i], want[i])
+		}
+	}
+}
+
+func TestAggregateSkipsNonFiniteValues(t *testing.T) {
+	packets := []storedPacket{packetAt(10, 1, ""), packetAt(30, 1, ""), packetAt(20, 1, ""), packetAt(40, 1, "")}
+	packets[2].dataField2 = math.NaN()
+	packets[3].dataField2 = math.Inf(-1)
+	store := openTestStore(t, packets)
+
+	groups, err := store.aggregate(aggregationRequest{percentile: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := aggregationGroup{dataField1: 1, count: 2, min: 10, max: 30, mean: 20, percentile: 20}
+	if len(groups) != 1 || groups[0] != want {
+		t.Fatalf("aggregate = %+v, want %+v", groups, want)
+	}
+}
+
+func TestDataPacketRefusesNonFiniteDataField2(t *testing.T) {
+	saved := dataPackets
+	dataPackets = openTestStore(t, nil)
+	defer func() { dataPackets = saved }()
+
+	tests := []struct {
+		dataField2 float64
+		want       string
+	}{
+		{math.NaN(), "Invalid data packet: data field 2 must be a finite number"},
+		{math.Inf(1), "Invalid data packet: data field 2 must be a finite number"},
+		{math.Inf(-1), "Invalid data packet: data field 2 must be a finite number"},
+		{2.5, replyDataReceived},
+	}
+	for _, tt := range tests {
+		if response := dataResponse(storedUsername, 1, tt.dataField2, "x"); response != tt.want {
+			t.Errorf("data field 2 %v: response %q, want %q", tt.dataField2, response, tt.want)
+		}
+	}
+	if got := len(dataPackets.index.entries); got != 1 {
+		t.Fatalf("stored %d packets, want 1", got)
+	}
+}
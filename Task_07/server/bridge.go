@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The HTTP bridge lets clients without the binary protocol send messages as
+// JSON. Each request is authenticated with HTTP basic auth (a username and
+// password from the user store, over HTTPS only) or a bearer token and
+// answered by the handlers of the 0x01, 0x02 or 0x03 frame a client would
+// send; the text of their 0x05 reply becomes the JSON response. A request
+// opens no connection or session, so it is neither counted as a connection
+// nor listed by "who":
+//
+//	POST /v1/text      {"text": "hello"}
+//	POST /v1/commands  {"command": "who", "parameter": ""}
+//	POST /v1/data      {"field1": 1, "field2": 2.5, "field3": "three"}
+//	-> 200 {"accepted": true, "response": "Text message received successfully"}
+//
+// GET /v1/events streams the frames pushed to the user as server-sent
+// events: direct messages, direct data packets, and data packets on the
+// topics named by topic query parameters. A client that falls
+// eventBufferSize events behind, or takes longer than eventWriteTimeout to
+// take one, is disconnected rather than left holding up the senders.
+//
+// The stream is a streaming session like any other, so it can own the
+// user's inbox (see inbox.go). The items waiting there are sent as events
+// whose SSE id is the item ID and whose data carries queued_at, and stay
+// in the inbox until confirmed:
+//
+//	POST /v1/inbox/ack  {"id": 42}
+//	-> 200 {"accepted": true, "response": "Inbox item confirmed"}
+const (
+	bridgeReplyTimeout = 10 * time.Second
+	eventKeepAlive     = 15 * time.Second
+	eventBufferSize    = 64
+	eventWriteTimeout  = 10 * time.Second
+)
+
+type bridgeReply struct {
+	Accepted bool   `json:"accepted"`
+	Response string `json:"response"`
+}
+
+type bridgeError struct {
+	Error string `json:"error"`
+}
+
+type textRequest struct {
+	Text string `json:"text"`
+}
+
+type commandRequest struct {
+	Command   string `json:"command"`
+	Parameter string `json:"parameter"`
+}
+
+type dataRequest struct {
+	Field1 *uint32  `json:"field1"`
+	Field2 *float64 `json:"field2"`
+	Field3 string   `json:"field3"`
+}
+
+type inboxAckRequest struct {
+	ID *uint64 `json:"id"`
+}
+
+func registerBridge(mux *http.ServeMux) {
+	mux.HandleFunc("POST /v1/text", bridgeHandler(replyTextReceived, func(_ string, r textRequest) (string, error) {
+		return textResponse(r.Text), nil
+	}))
+	mux.HandleFunc("POST /v1/commands", bridgeHandler(replyCommandReceived, func(username string, r commandRequest) (string, error) {
+		if r.Command == "" {
+			return "", errors.New("command is required")
+		}
+		return commandResponse(&session{username: username}, r.Command, r.Parameter), nil
+	}))
+	mux.HandleFunc("POST /v1/data", bridgeHandler(replyDataReceived, func(username string, r dataRequest) (string, error) {
+		if r.Field1 == nil || r.Field2 == nil {
+			return "", errors.New("field1 and field2 are required")
+		}
+		return dataResponse(username, *r.Field1, *r.Field2, r.Field3), nil
+	}))
+	mux.HandleFunc("POST /v1/inbox/ack", bridgeHandler(replyInboxConfirmed, func(username string, r inboxAckRequest) (string, error) {
+		if r.ID == nil {
+			return "", errors.New("id is required")
+		}
+		removed, err := inboxes.remove(username, *r.ID)
+		if err != nil {
+			fmt.Println("Error removing inbox item:", err)
+		}
+		if !removed {
+			return "No such inbox item", nil
+		}
+		fmt.Printf("Inbox item %d delivered to %s\n", *r.ID, username)
+		return replyInboxConfirmed, nil
+	}))
+	mux.HandleFunc("GET /v1/events", serveEvents)
+}
+
+const replyInboxConfirmed = "Inbox item confirmed"
+
+// bridgeHandler decodes a JSON request of type T, has respond answer it
+// for the user and sends the response, which is accepted if it is success.
+func bridgeHandler[T any](success string, respond func(username string, r T) (string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := authenticateHTTP(w, r)
+		if !ok {
+			return
+		}
+
+		var request T
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(cfg.Limits.MaxFrameSize)))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			writeJSON(w, http.StatusBadRequest, bridgeError{"Invalid request: " + err.Error()})
+			return
+		}
+		response, err := respond(username, request)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, bridgeError{"Invalid request: " + err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, bridgeReply{Accepted: acceptedReply(response, success), Response: response})
+	}
+}
+
+// acceptedReply reports whether response is success, possibly followed by
+// output after ": ".
+func acceptedReply(response, success string) bool {
+	return response == success || strings.HasPrefix(response, success+": ")
+}
+
+// authenticateHTTP returns the user a request authenticates as, or answers
+// 401 and reports false. A password is refused without TLS, where it would
+// have crossed the network in the clear.
+func authenticateHTTP(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if username, password, ok := r.BasicAuth(); ok {
+		if r.TLS == nil {
+			fmt.Println("Bridge refused basic authentication without TLS for", username)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="task07"`)
+			writeJSON(w, http.StatusUnauthorized, bridgeError{"Basic authentication needs HTTPS; use a bearer token"})
+			return "", false
+		}
+		sum := sha256.Sum256([]byte(password))
+		if authenticate(username, hex.EncodeToString(sum[:])) {
+			return username, true
+		}
+		fmt.Println("Bridge authentication failed for", username)
+	} else if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if username, ok := tokenUser(strings.TrimSpace(token)); ok {
+			return username, true
+		}
+		fmt.Println("Bridge authentication failed for a bearer token")
+	}
+	if r.TLS != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="task07", charset="UTF-8"`)
+	}
+	w.Header().Add("WWW-Authenticate", `Bearer realm="task07"`)
+	writeJSON(w, http.StatusUnauthorized, bridgeError{"Authentication failed"})
+	return "", false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// serveEvents streams the frames pushed to the user as server-sent events
+// until the client goes away.
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	username, ok := authenticateHTTP(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		writeJSON(w, http.StatusInternalServerError, bridgeError{"Streaming is not supported"})
+		return
+	}
+
+	// Frames written to the session arrive on pushed
+	pushed, server := net.Pipe()
+	defer pushed.Close()
+	defer server.Close()
+	sess := &session{username: username, conn: server, version: minProtocolVersion, features: features{streaming: true}}
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	// Pushed frames are always read at once, so a slow client never
+	// blocks the senders; it is dropped when the buffer overflows. Inbox
+	// items wait for room instead, since the session owning the inbox is
+	// sent them all at once
+	events := make(chan pushedEvent, eventBufferSize)
+	overflow := make(chan struct{})
+	go func() {
+		defer close(events)
+		defer pushed.Close()
+		reader := bufio.NewReader(pushed)
+		for {
+			event, err := readPushedFrame(reader)
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+					fmt.Println("Error reading pushed frame for", username+":", err)
+				}
+				return
+			}
+			if event.id != 0 {
+				select {
+				case events <- event:
+				case <-stopped:
+					return
+				}
+				continue
+			}
+			select {
+			case events <- event:
+			default:
+				close(overflow)
+				return
+			}
+		}
+	}()
+
+	// Registering sends the inbox through the events, so it runs beside
+	// the loop that takes them
+	topics := r.URL.Query()["topic"]
+	for _, topic := range topics {
+		topicBroker.subscribe(sess, topic)
+	}
+	registered := make(chan struct{})
+	go func() {
+		defer close(registered)
+		registerSession(sess)
+	}()
+	defer func() {
+		// Closing the pipe ends a delivery the loop no longer takes
+		server.Close()
+		<-registered
+		unregisterSession(sess)
+	}()
+	defer topicBroker.unsubscribeAll(sess)
+	fmt.Printf("%s is streaming events, topics %v\n", username, topics)
+
+	controller := http.NewResponseController(w)
+	send := func(text string) error {
+		controller.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := io.WriteString(w, text); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := send(": connected\n\n"); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			fmt.Println(username, "stopped streaming events")
+			return
+		case <-overflow:
+			fmt.Println(username, "fell", eventBufferSize, "events behind, closing the event stream")
+			return
+		case <-keepAlive.C:
+			err = send(": keep-alive\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(event.data)
+			if event.id != 0 {
+				err = send(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", event.id, event.name, data))
+			} else {
+				err = send(fmt.Sprintf("event: %s\ndata: %s\n\n", event.name, data))
+			}
+		}
+		if err != nil {
+			fmt.Println("Error streaming events to", username+":", err)
+			return
+		}
+	}
+}
+
+// pushedEvent is one server-sent event. id is the inbox item it came
+// from, or 0.
+type pushedEvent struct {
+	name string
+	data any
+	id   uint64
+}
+
+type dataEvent struct {
+	From     string    `json:"from,omitempty"`
+	Field1   uint32    `json:"field1"`
+	Field2   float64   `json:"field2"`
+	Field3   string    `json:"field3"`
+	QueuedAt time.Time `json:"queued_at,omitzero"`
+}
+
+type messageEvent struct {
+	From     string    `json:"from"`
+	Text     string    `json:"text"`
+	QueuedAt time.Time `json:"queued_at,omitzero"`
+}
+
+// readPushedFrame decodes one of the frames the server pushes to a
+// streaming session.
+func readPushedFrame(reader *bufio.Reader) (pushedEvent, error) {
+	messageType, err := reader.ReadByte()
+	if err != nil {
+		return pushedEvent{}, err
+	}
+	readData := func(event *dataEvent) error {
+		var fields [12]byte
+		if _, err := io.ReadFull(reader, fields[:]); err != nil {
+			return err
+		}
+		_, field3, err := readLengthPrefixed(reader)
+		event.Field1 = binary.BigEndian.Uint32(fields[:4])
+		event.Field2 = math.Float64frombits(binary.BigEndian.Uint64(fields[4:]))
+		event.Field3 = string(field3)
+		return err
+	}
+
+	switch messageType {
+	case 0x03:
+		var event dataEvent
+		err := readData(&event)
+		return pushedEvent{"data", event, 0}, err
+	case 0x04:
+		_, sender, err := readLengthPrefixed(reader)
+		if err != nil {
+			return pushedEvent{}, err
+		}
+		_, text, err := readLengthPrefixed(reader)
+		return pushedEvent{"direct_message", messageEvent{From: string(sender), Text: string(text)}, 0}, err
+	case 0x14:
+		_, sender, err := readLengthPrefixed(reader)
+		if err != nil {
+			return pushedEvent{}, err
+		}
+		event := dataEvent{From: string(sender)}
+		err = readData(&event)
+		return pushedEvent{"direct_data", event, 0}, err
+	case 0x15:
+		var header [16]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return pushedEvent{}, err
+		}
+		event, err := readPushedFrame(reader)
+		if err != nil {
+			return pushedEvent{}, err
+		}
+		event.id = binary.BigEndian.Uint64(header[:8])
+		queuedAt := time.Unix(0, int64(binary.BigEndian.Uint64(header[8:])))
+		switch data := event.data.(type) {
+		case dataEvent:
+			data.QueuedAt = queuedAt
+			event.data = data
+		case messageEvent:
+			data.QueuedAt = queuedAt
+			event.data = data
+		}
+		return event, nil
+	}
+	return pushedEvent{}, fmt.Errorf("unexpected pushed frame of type 0x%02X", messageType)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcceptedReply(t *testing.T) {
+	tests := []struct {
+		response string
+		success  string
+		want     bool
+	}{
+		{replyTextReceived, replyTextReceived, true},
+		{replyCommandReceived + ": 3 users", replyCommandReceived, true},
+		{replyCommandReceived, replyTextReceived, false},
+		{"Text message received successfully, but not stored", replyTextReceived, false},
+		{"Not successfully received", replyTextReceived, false},
+		{"Invalid text message checksum", replyTextReceived, false},
+	}
+	for _, tt := range tests {
+		if got := acceptedReply(tt.response, tt.success); got != tt.want {
+			t.Errorf("acceptedReply(%q, %q) = %v, want %v", tt.response, tt.success, got, tt.want)
+		}
+	}
+}
+
+func bridgeServer(tls bool) *httptest.Server {
+	mux := http.NewServeMux()
+	registerBridge(mux)
+	if tls {
+		return httptest.NewTLSServer(mux)
+	}
+	return httptest.NewServer(mux)
+}
+
+func postText(t *testing.T, server *httptest.Server, authorize func(*http.Request)) (*http.Response, bridgeReply) {
+	t.Helper()
+	request, err := http.NewRequest(http.MethodPost, server.URL+"/v1/text", strings.NewReader(`{"text": "hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorize(request)
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var reply bridgeReply
+	json.NewDecoder(response.Body).Decode(&reply)
+	return response, reply
+}
+
+func TestBridgeBasicAuthNeedsTLS(t *testing.T) {
+	basic := func(r *http.Request) { r.SetBasicAuth(storedUsername, "password") }
+
+	plain := bridgeServer(false)
+	defer plain.Close()
+	response, _ := postText(t, plain, basic)
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("basic auth over HTTP: status %d, want 401", response.StatusCode)
+	}
+	for _, challenge := range response.Header.Values("WWW-Authenticate") {
+		if strings.HasPrefix(challenge, "Basic") {
+			t.Fatalf("HTTP response offers basic auth: %q", challenge)
+		}
+	}
+
+	secure := bridgeServer(true)
+	defer secure.Close()
+	response, reply := postText(t, secure, basic)
+	if response.StatusCode != http.StatusOK || !reply.Accepted || reply.Response != replyTextReceived {
+		t.Fatalf("basic auth over HTTPS: status %d, reply %+v", response.StatusCode, reply)
+	}
+}
+
+func TestBridgeBearerTokenOverHTTP(t *testing.T) {
+	// The hash of the token "test"
+	saved := tokens
+	tokens = map[string]string{"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08": storedUsername}
+	defer func() { tokens = saved }()
+
+	server := bridgeServer(false)
+	defer server.Close()
+	response, reply := postText(t, server, func(r *http.Request) { r.Header.Set("Authorization", "Bearer test") })
+	if response.StatusCode != http.StatusOK || !reply.Accepted {
+		t.Fatalf("status %d, reply %+v", response.StatusCode, reply)
+	}
+	response, _ = postText(t, server, func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") })
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unknown token: status %d, want 401", response.StatusCode)
+	}
+}
+
+// stalledWriter is an event stream whose client reads nothing until
+// released.
+type stalledWriter struct {
+	header   http.Header
+	released chan struct{}
+
+	mu      sync.Mutex
+	written strings.Builder
+}
+
+func (w *stalledWriter) Header() http.Header { return w.header }
+func (w *stalledWriter) WriteHeader(int)     {}
+func (w *stalledWriter) Flush()              {}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	<-w.released
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.written.Write(p)
+}
+
+func TestEventsDropSlowReader(t *testing.T) {
+	openTestInboxes(t)
+	saved := tokens
+	tokens = map[string]string{"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08": storedUsername}
+	defer func() { tokens = saved }()
+
+	w := &stalledWriter{header: http.Header{}, released: make(chan struct{})}
+	r := httptest.NewRequest(http.MethodGet, "/v1/events", nil)
+	r.Header.Set("Authorization", "Bearer test")
+	done := make(chan struct{})
+	go func() {
+		serveEvents(w, r)
+		close(done)
+	}()
+	for len(activeSessions.streamingSessionsFor(storedUsername)) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Senders are not held up by a client that reads nothing
+	pushed := make(chan error, 1)
+	go func() {
+		for range 2 * eventBufferSize {
+			sessions := activeSessions.streamingSessionsFor(storedUsername)
+			if len(sessions) > 0 && push(sessions, buildDirectMessage("user2", "hello")) == 0 {
+				pushed <- errors.New("push failed")
+				return
+			}
+		}
+		pushed <- nil
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pushing to a stalled event stream blocked")
+	}
+
+	// Once it reads again it finds the stream closed
+	close(w.released)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event stream of a client that fell behind was not closed")
+	}
+	if len(activeSessions.streamingSessionsFor(storedUsername)) != 0 {
+		t.Fatal("closed event stream still registered")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n := strings.Count(w.written.String(), "event: direct_message"); n > eventBufferSize {
+		t.Fatalf("%d events written, more than the buffer holds", n)
+	}
+}
+
+func TestBridgeOpensNoSession(t *testing.T) {
+	saved := tokens
+	tokens = map[string]string{"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08": storedUsername}
+	defer func() { tokens = saved }()
+	server := bridgeServer(false)
+	defer server.Close()
+
+	opened := connectionsOpened.with("bridge").value.Load()
+	succeeded := authentications.with("success").value.Load()
+	request, err := http.NewRequest(http.MethodPost, server.URL+"/v1/commands", strings.NewReader(`{"command": "who"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer test")
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var reply bridgeReply
+	json.NewDecoder(response.Body).Decode(&reply)
+	if !reply.Accepted || strings.Contains(reply.Response, storedUsername) {
+		t.Fatalf("who over the bridge: %+v, want no session for the request itself", reply)
+	}
+	if connectionsOpened.with("bridge").value.Load() != opened || authentications.with("success").value.Load() != succeeded {
+		t.Fatal("bridge request counted as a connection")
+	}
+}
+
+func TestEventsDeliverInbox(t *testing.T) {
+	openTestInboxes(t)
+	saved := tokens
+	tokens = map[string]string{"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08": storedUsername}
+	defer func() { tokens = saved }()
+	for _, text := range []string{"first", "second"} {
+		if got := deliverOrQueue(storedUsername, "user2", buildDirectMessage("user2", text)); got != "User offline, message queued" {
+			t.Fatalf("deliverOrQueue = %q", got)
+		}
+	}
+	server := bridgeServer(false)
+	defer server.Close()
+	authorized := func(method, path, body string) *http.Response {
+		t.Helper()
+		request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer test")
+		response, err := server.Client().Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	// Each waiting item arrives with its ID
+	stream := authorized(http.MethodGet, "/v1/events", "")
+	defer stream.Body.Close()
+	lines := bufio.NewScanner(stream.Body)
+	var ids []string
+	var events []messageEvent
+	for len(events) < 2 && lines.Scan() {
+		if id, ok := strings.CutPrefix(lines.Text(), "id: "); ok {
+			ids = append(ids, id)
+		} else if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			var event messageEvent
+			json.Unmarshal([]byte(data), &event)
+			events = append(events, event)
+		}
+	}
+	if len(ids) != 2 || len(events) != 2 || events[0].Text != "first" || events[1].Text != "second" || events[0].QueuedAt.IsZero() {
+		t.Fatalf("ids %v, events %+v, want both queued messages in order with their IDs", ids, events)
+	}
+
+	// They stay in the inbox until confirmed
+	for i, want := range []bool{true, false} {
+		response := authorized(http.MethodPost, "/v1/inbox/ack", fmt.Sprintf(`{"id": %s}`, ids[0]))
+		var reply bridgeReply
+		json.NewDecoder(response.Body).Decode(&reply)
+		response.Body.Close()
+		if reply.Accepted != want {
+			t.Fatalf("confirmation %d of item %s: %+v", i+1, ids[0], reply)
+		}
+	}
+	inboxes.mu.Lock()
+	waiting := len(inboxes.items[storedUsername])
+	inboxes.mu.Unlock()
+	if waiting != 1 {
+		t.Fatalf("%d items waiting, want the unconfirmed one", waiting)
+	}
+}
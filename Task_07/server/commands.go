@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// serverCommand is a command message the server runs itself. Its output
+// follows the usual acknowledgement in the response. Other commands are
+// acknowledged without being run.
+type serverCommand struct {
+	description string
+	run         func(sess *session, parameter string) string
+}
+
+var serverCommands map[string]serverCommand
+
+var startedAt = time.Now()
+
+func init() {
+	serverCommands = map[string]serverCommand{
+		"help": {"list the commands the server runs", func(*session, string) string {
+			lines := make([]string, 0, len(serverCommands))
+			for _, name := range commandNames() {
+				lines = append(lines, name+" - "+serverCommands[name].description)
+			}
+			return strings.Join(lines, "; ")
+		}},
+		"who": {"list the users online", func(*session, string) string {
+			return strings.Join(activeSessions.users(), ", ")
+		}},
+		"ping": {"check that the server is responding", func(*session, string) string {
+			return "pong"
+		}},
+		"time": {"show the server time", func(*session, string) string {
+			return time.Now().Format(time.RFC3339)
+		}},
+		"uptime": {"show how long the server has been running", func(*session, string) string {
+			return time.Since(startedAt).Round(time.Second).String()
+		}},
+	}
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(serverCommands))
+	for name := range serverCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandResponse is the response to a valid command message.
+func commandResponse(sess *session, command, parameter string) string {
+	cmd, ok := serverCommands[command]
+	if !ok {
+		return replyCommandReceived
+	}
+	fmt.Printf("Running command %s for %s\n", command, sess.username)
+	return replyCommandReceived + ": " + cmd.run(sess, parameter)
+}
+
+// buildCommandList builds the 0x17 response listing the commands the server
+// runs:
+//
+//	[0x17][count uint32]([name length uint32][name])*
+func buildCommandList(names []string) []byte {
+	buf := make([]byte, 1+4)
+	buf[0] = 0x17
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(names)))
+	for _, name := range names {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(name)))
+		buf = append(buf, name...)
+	}
+	return buf
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The server's settings come from the defaults below, then the file named
+// by -config or TASK07_CONFIG (JSON, or TOML if it ends in .toml), then
+// TASK07_* environment variables, then flags, each overriding the last.
+// For example:
+//
+//	{
+//	  "listeners": [
+//	    {"address": "localhost:8080"},
+//	    {"address": ":8443", "tls": true},
+//	    {"network": "unix", "address": "/run/task07.sock", "auth": "peercred", "peer_users": {"1000": "user1"}},
+//	    {"network": "udp", "address": ":8080"},
+//	    {"network": "http", "address": ":8081"}
+//	  ],
+//	  "tls": {"cert_file": "server.crt", "key_file": "server.key"},
+//	  "user_store": "users.json",
+//	  "data_dir": "data",
+//	  "limits": {"max_frame_size": 16777216, "max_connections": 100, "inbox_max_items": 100},
+//	  "timeouts": {"handshake": "10s", "idle": "5m", "inbox_retention": "168h"},
+//	  "logging": {"debug": false}
+//	}
+const (
+	configEnvPrefix         = "TASK07_"
+	defaultListenAddress    = "localhost:8080"
+	defaultHandshakeTimeout = 10 * time.Second
+	maxConfiguredFrameSize  = 1 << 30
+)
+
+type config struct {
+	Listeners []listenerConfig `json:"listeners"`
+	TLS       tlsConfig        `json:"tls"`
+	UserStore string           `json:"user_store"`
+	DataDir   string           `json:"data_dir"`
+	Limits    limitsConfig     `json:"limits"`
+	Timeouts  timeoutsConfig   `json:"timeouts"`
+	Logging   loggingConfig    `json:"logging"`
+
+	// RepairStore opens a damaged packet store, skipping the damaged
+	// records. It is only ever given for one run, as a flag.
+	RepairStore bool `json:"-"`
+}
+
+// listenerConfig is one address the server accepts connections on. Network
+// is "tcp" (the default), "udp" for the datagram transport in protocol/udp.go,
+// "http" for browsers using WebSocket and the JSON bridge, or "unix", in
+// which case Address is the socket's path. Auth is the authentication
+// policy: "password" (the default), or "peercred" for Unix sockets, with
+// PeerUsers mapping uids to users.
+type listenerConfig struct {
+	Network   string            `json:"network,omitempty"`
+	Address   string            `json:"address"`
+	TLS       bool              `json:"tls,omitempty"`
+	Auth      string            `json:"auth,omitempty"`
+	PeerUsers map[string]string `json:"peer_users,omitempty"`
+}
+
+// Listener authentication policies.
+const (
+	authPassword        = "password"
+	authPeerCredentials = "peercred"
+)
+
+func (l listenerConfig) network() string {
+	if l.Network == "" {
+		return "tcp"
+	}
+	return l.Network
+}
+
+func (l listenerConfig) describe() string {
+	auth := l.Auth
+	if auth == "" {
+		auth = authPassword
+	}
+	description := auth + " authentication"
+	if l.TLS {
+		description = "TLS, " + description
+	}
+	if l.network() == "http" {
+		description = "WebSocket at " + webSocketPath + ", JSON bridge at /v1, metrics at /metrics, " + description
+	}
+	return description
+}
+
+type tlsConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+type limitsConfig struct {
+	MaxFrameSize   uint32 `json:"max_frame_size"`
+	MaxConnections int    `json:"max_connections"` // 0 for no limit
+	InboxMaxItems  int    `json:"inbox_max_items"`
+}
+
+type timeoutsConfig struct {
+	Handshake      duration `json:"handshake"` // hello and authentication
+	Idle           duration `json:"idle"`      // between frames, 0 for none
+	InboxRetention duration `json:"inbox_retention"`
+}
+
+type loggingConfig struct {
+	// Debug prints every text, command and data packet frame received.
+	Debug bool `json:"debug"`
+}
+
+// duration is a time.Duration written as a string such as "30s".
+type duration struct {
+	time.Duration
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("durations are strings such as \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// cfg is the configuration the server is running with.
+var cfg = defaultConfig()
+
+func defaultConfig() config {
+	return config{
+		Listeners: []listenerConfig{{Address: defaultListenAddress}},
+		DataDir:   storeDir,
+		Limits: limitsConfig{
+			MaxFrameSize:  defaultMaxFrameSize,
+			InboxMaxItems: defaultInboxMaxItems,
+		},
+		Timeouts: timeoutsConfig{
+			Handshake:      duration{defaultHandshakeTimeout},
+			InboxRetention: duration{defaultInboxRetention},
+		},
+		Logging: loggingConfig{Debug: true},
+	}
+}
+
+// setting is a value that can be given in the environment or as a flag.
+type setting struct {
+	name  string // flag name; the variable is TASK07_ and the name in upper case with underscores
+	usage string
+	apply func(c *config, value string) error
+}
+
+var settings = []setting{
+	{"listen", "comma-separated listen addresses: host:port, tls://host:port, udp://host:port, http://host:port, https://host:port, unix:path or peercred:path", func(c *config, v string) error {
+		c.Listeners = nil
+		for _, address := range strings.Split(v, ",") {
+			c.Listeners = append(c.Listeners, parseListenAddress(strings.TrimSpace(address)))
+		}
+		return nil
+	}},
+	{"tls-cert", "TLS certificate file", func(c *config, v string) error { c.TLS.CertFile = v; return nil }},
+	{"tls-key", "TLS private key file", func(c *config, v string) error { c.TLS.KeyFile = v; return nil }},
+	{"user-store", "JSON file of users and their password hashes", func(c *config, v string) error { c.UserStore = v; return nil }},
+	{"data-dir", "directory for stored packets, schemas and inboxes", func(c *config, v string) error { c.DataDir = v; return nil }},
+	{"max-frame-size", "largest frame payload accepted, in bytes", func(c *config, v string) error {
+		n, err := strconv.ParseUint(v, 10, 32)
+		c.Limits.MaxFrameSize = uint32(n)
+		return err
+	}},
+	{"max-connections", "most connections served at once, 0 for no limit", func(c *config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Limits.MaxConnections = n
+		return err
+	}},
+	{"inbox-max-items", "maximum number of undelivered messages per user", func(c *config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Limits.InboxMaxItems = n
+		return err
+	}},
+	{"handshake-timeout", "time allowed for the hello and authentication", func(c *config, v string) error {
+		return setDuration(&c.Timeouts.Handshake, v)
+	}},
+	{"idle-timeout", "time a connection may go without a frame, 0 for no limit", func(c *config, v string) error {
+		return setDuration(&c.Timeouts.Idle, v)
+	}},
+	{"inbox-retention", "how long undelivered messages are kept", func(c *config, v string) error {
+		return setDuration(&c.Timeouts.InboxRetention, v)
+	}},
+	{"debug", "print every text, command and data packet frame received", func(c *config, v string) error {
+		debug, err := strconv.ParseBool(v)
+		c.Logging.Debug = debug
+		return err
+	}},
+}
+
+// parseListenAddress reads a listener from the -listen shorthand.
+// peercred:path is a Unix socket with peer credential authentication.
+func parseListenAddress(address string) listenerConfig {
+	if rest, ok := strings.CutPrefix(address, "tls://"); ok {
+		return listenerConfig{Address: rest, TLS: true}
+	}
+	if rest, ok := strings.CutPrefix(address, "http://"); ok {
+		return listenerConfig{Network: "http", Address: rest}
+	}
+	if rest, ok := strings.CutPrefix(address, "https://"); ok {
+		return listenerConfig{Network: "http", Address: rest, TLS: true}
+	}
+	if rest, ok := strings.CutPrefix(address, "udp://"); ok {
+		return listenerConfig{Network: "udp", Address: rest}
+	}
+	if rest, ok := strings.CutPrefix(address, "unix:"); ok {
+		return listenerConfig{Network: "unix", Address: rest}
+	}
+	if rest, ok := strings.CutPrefix(address, "peercred:"); ok {
+		return listenerConfig{Network: "unix", Address: rest, Auth: authPeerCredentials}
+	}
+	return listenerConfig{Address: address}
+}
+
+func setDuration(d *duration, value string) error {
+	parsed, err := time.ParseDuration(value)
+	d.Duration = parsed
+	return err
+}
+
+func (s setting) envName() string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+// loadConfig builds the configuration from the command line arguments and
+// reports whether only a check was asked for.
+func loadConfig(args []string) (config, bool, error) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(configEnvPrefix+"CONFIG"), "configuration file, JSON or TOML")
+	check := fs.Bool("check-config", false, "validate the configuration, print it and exit")
+	repair := fs.Bool("repair-store", false, "open a damaged packet store, skipping the damaged records")
+
+	// Flags are applied last, so their values wait until the file is read
+	type flagValue struct {
+		setting setting
+		value   string
+	}
+	var flagValues []flagValue
+	for _, s := range settings {
+		fs.Func(s.name, s.usage+" ($"+s.envName()+")", func(value string) error {
+			flagValues = append(flagValues, flagValue{s, value})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return config{}, false, err
+	}
+	if fs.NArg() > 0 {
+		return config{}, false, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	c := defaultConfig()
+	if *path != "" {
+		if err := c.readFile(*path); err != nil {
+			return config{}, *check, err
+		}
+	}
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.envName()); ok {
+			if err := s.apply(&c, value); err != nil {
+				return config{}, *check, fmt.Errorf("%s: %w", s.envName(), err)
+			}
+		}
+	}
+	for _, f := range flagValues {
+		if err := f.setting.apply(&c, f.value); err != nil {
+			return config{}, *check, fmt.Errorf("-%s: %w", f.setting.name, err)
+		}
+	}
+	c.RepairStore = *repair
+	return c, *check, c.validate()
+}
+
+// readFile merges the settings in a configuration file into c.
+func (c *config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		table, err := parseTOML(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		// The TOML tables have the same shape as the JSON document
+		if data, err = json.Marshal(table); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (c config) validate() error {
+	var problems []error
+	if len(c.Listeners) == 0 {
+		problems = append(problems, errors.New("no listeners"))
+	}
+	for i, l := range c.Listeners {
+		if l.Address == "" {
+			problems = append(problems, fmt.Errorf("listener %d has no address", i+1))
+		}
+		if l.TLS && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+			problems = append(problems, fmt.Errorf("listener %s uses TLS but no certificate and key are set", l.Address))
+		}
+		switch l.network() {
+		case "tcp", "http":
+			if l.Auth == authPeerCredentials {
+				problems = append(problems, fmt.Errorf("listener %s: peer credentials need a Unix socket", l.Address))
+			}
+		case "unix", "udp":
+			if l.TLS {
+				problems = append(problems, fmt.Errorf("listener %s: TLS is only for TCP listeners", l.Address))
+			}
+			if l.network() == "udp" && l.Auth == authPeerCredentials {
+				problems = append(problems, fmt.Errorf("listener %s: peer credentials need a Unix socket", l.Address))
+			}
+		default:
+			problems = append(problems, fmt.Errorf("listener %s: unknown network %q", l.Address, l.Network))
+		}
+		if l.Auth != "" && l.Auth != authPassword && l.Auth != authPeerCredentials {
+			problems = append(problems, fmt.Errorf("listener %s: unknown authentication %q", l.Address, l.Auth))
+		}
+		if len(l.PeerUsers) > 0 && l.Auth != authPeerCredentials {
+			problems = append(problems, fmt.Errorf("listener %s: peer_users needs peercred authentication", l.Address))
+		}
+	}
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile); err != nil {
+			problems = append(problems, fmt.Errorf("loading TLS certificate: %w", err))
+		}
+	}
+	if c.UserStore != "" {
+		if _, err := loadUserStore(c.UserStore); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if c.DataDir == "" {
+		problems = append(problems, errors.New("no data directory"))
+	}
+	if c.Limits.MaxFrameSize < minMaxFrameSize || c.Limits.MaxFrameSize > maxConfiguredFrameSize {
+		problems = append(problems, fmt.Errorf("max_frame_size %d is outside %d-%d", c.Limits.MaxFrameSize, minMaxFrameSize, maxConfiguredFrameSize))
+	}
+	if c.Limits.MaxConnections < 0 {
+		problems = append(problems, errors.New("max_connections is negative"))
+	}
+	if c.Limits.InboxMaxItems < 1 {
+		problems = append(problems, errors.New("inbox_max_items must be at least 1"))
+	}
+	if c.Timeouts.Handshake.Duration <= 0 {
+		problems = append(problems, errors.New("the handshake timeout must be positive"))
+	}
+	if c.Timeouts.Idle.Duration < 0 || c.Timeouts.InboxRetention.Duration <= 0 {
+		problems = append(problems, errors.New("timeouts cannot be negative and inbox retention must be positive"))
+	}
+	return errors.Join(problems...)
+}
+
+// tlsServerConfig loads the certificate for the TLS listeners.
+func (c config) tlsServerConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}, nil
+}
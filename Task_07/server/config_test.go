@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testTOMLConfig = `
+[[listeners]]
+address = "localhost:9090"
+[[listeners]]
+network = "udp"
+address = ":9090"
+[limits]
+max_frame_size = 2048
+inbox_max_items = 5
+[timeouts]
+idle = "1m"
+[logging]
+debug = false
+`
+
+const testJSONConfig = `{
+  "listeners": [{"address": "localhost:9090"}, {"network": "udp", "address": ":9090"}],
+  "limits": {"max_frame_size": 2048, "inbox_max_items": 5},
+  "timeouts": {"idle": "1m"},
+  "logging": {"debug": false}
+}`
+
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFileFormats(t *testing.T) {
+	toml := writeConfig(t, "server.toml", testTOMLConfig)
+	json := writeConfig(t, "server.json", testJSONConfig)
+	fromTOML, _, err := loadConfig([]string{"-config", toml})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, _, err := loadConfig([]string{"-config", json})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromTOML, fromJSON) {
+		t.Fatalf("TOML gives %+v, JSON %+v", fromTOML, fromJSON)
+	}
+	want := defaultConfig()
+	want.Listeners = []listenerConfig{{Address: "localhost:9090"}, {Network: "udp", Address: ":9090"}}
+	want.Limits.MaxFrameSize = 2048
+	want.Limits.InboxMaxItems = 5
+	want.Timeouts.Idle = duration{time.Minute}
+	want.Logging.Debug = false
+	if !reflect.DeepEqual(fromTOML, want) {
+		t.Fatalf("loaded %+v, want %+v", fromTOML, want)
+	}
+
+	// Unknown keys are mistakes, not extensions
+	for _, path := range []string{writeConfig(t, "unknown.toml", "max_frame = 1\n"+testTOMLConfig), writeConfig(t, "unknown.json", `{"limits": {"max_frame": 1}}`)} {
+		if _, _, err := loadConfig([]string{"-config", path}); err == nil {
+			t.Errorf("%s: loaded", filepath.Base(path))
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := writeConfig(t, "server.toml", "[limits]\nmax_frame_size = 2048\n[timeouts]\nidle = \"1m\"\n")
+	tests := []struct {
+		name         string
+		env          map[string]string
+		args         []string
+		maxFrameSize uint32
+		idle         time.Duration
+	}{
+		{"defaults", nil, nil, defaultMaxFrameSize, 0},
+		{"file", nil, []string{"-config", file}, 2048, time.Minute},
+		{"file named in the environment", map[string]string{"TASK07_CONFIG": file}, nil, 2048, time.Minute},
+		{"-config over TASK07_CONFIG", map[string]string{"TASK07_CONFIG": "/nonexistent.toml"}, []string{"-config", file}, 2048, time.Minute},
+		{"environment over file", map[string]string{"TASK07_MAX_FRAME_SIZE": "4096"}, []string{"-config", file}, 4096, time.Minute},
+		{"environment without file", map[string]string{"TASK07_IDLE_TIMEOUT": "2m"}, nil, defaultMaxFrameSize, 2 * time.Minute},
+		{"flags over environment", map[string]string{"TASK07_MAX_FRAME_SIZE": "4096", "TASK07_IDLE_TIMEOUT": "2m"},
+			[]string{"-config", file, "-max-frame-size", "8192"}, 8192, 2 * time.Minute},
+		{"last flag wins", nil, []string{"-idle-timeout", "3m", "-idle-timeout", "4m"}, defaultMaxFrameSize, 4 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			c, check, err := loadConfig(tt.args)
+			if err != nil || check {
+				t.Fatalf("loadConfig = %v, check %v", err, check)
+			}
+			if c.Limits.MaxFrameSize != tt.maxFrameSize || c.Timeouts.Idle.Duration != tt.idle {
+				t.Fatalf("max frame size %d, idle %v, want %d and %v", c.Limits.MaxFrameSize, c.Timeouts.Idle.Duration, tt.maxFrameSize, tt.idle)
+			}
+		})
+	}
+}
+
+func TestConfigRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check bool
+	}{
+		{"missing file", nil, []string{"-config", "/nonexistent.toml"}, false},
+		{"bad environment value", map[string]string{"TASK07_MAX_CONNECTIONS": "many"}, nil, false},
+		{"bad flag value", nil, []string{"-idle-timeout", "soon"}, false},
+		{"frame size below the minimum", nil, []string{"-max-frame-size", "100"}, false},
+		{"TLS without a certificate", nil, []string{"-listen", "localhost:0,tls://localhost:1"}, false},
+		{"argument", nil, []string{"extra"}, false},
+		{"checked", map[string]string{"TASK07_INBOX_MAX_ITEMS": "0"}, []string{"-check-config"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			if _, check, err := loadConfig(tt.args); err == nil || check != tt.check {
+				t.Fatalf("loadConfig = %v, check %v", err, check)
+			}
+		})
+	}
+}
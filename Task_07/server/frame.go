@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+
+	"../protocol"
+)
+
+// From protocol version 8 every frame after authentication travels in an
+// envelope:
+//
+//	[type uint8][flags uint8][payload length uint32][payload][trailer]
+//
+// Version 9 adds the frame's sequence number after the flags:
+//
+//	[type uint8][flags uint8][sequence uint64][payload length uint32][payload][trailer]
+//
+// The payload is the version 7 body of the frame without its own checksum.
+// The trailer is computed by the negotiated integrity algorithm, so its
+// length varies, and covers the header and the payload as sent, so a
+// compressed payload is checked before it is inflated. Flags mark optional
+// features, and a frame using a feature that was not negotiated is rejected.
+// On a secure channel the payload is encrypted in place and the AEAD tag is
+// the trailer.
+const envelopeHeaderSize = 1 + 1 + 4
+
+// Envelope flags.
+const (
+	flagCompressed = 1 << iota
+)
+
+// Features this server supports, in order of preference.
+var (
+	supportedCompression = []string{protocol.CompressionDeflate, protocol.CompressionGzip}
+	supportedChecksums   = []string{protocol.ChecksumHMACSHA256, protocol.ChecksumCRC32C, protocol.ChecksumCRC32IEEE}
+)
+
+const (
+	defaultMaxFrameSize = 16 * 1024 * 1024
+	minMaxFrameSize     = 1024
+)
+
+var errFrameRejected = errors.New("frame rejected")
+
+// features is the set of optional protocol features agreed with a peer.
+// Where several algorithms are agreed, the first is the one in use.
+type features struct {
+	compression  []string
+	checksums    []string
+	ciphers      []string
+	maxFrameSize uint32
+	streaming    bool
+
+	// acknowledgements has the server acknowledge every frame it receives.
+	// It needs the sequence numbers of version 9.
+	acknowledgements bool
+}
+
+// legacyFeatures describes a version 7 session, which predates feature
+// negotiation.
+var legacyFeatures = features{
+	checksums:    []string{protocol.ChecksumCRC32IEEE},
+	maxFrameSize: defaultMaxFrameSize,
+	streaming:    true,
+}
+
+// negotiateFeatures agrees on the features offered by the client that the
+// server also supports at the chosen version, keeping the client's order of
+// preference. Without a password, HMAC integrity and ciphers are left out,
+// since their keys are salted with the password hash. HMAC integrity also
+// needs the client's key share, and is left out when a cipher is agreed.
+func negotiateFeatures(clientHello hello, version uint16, passwordless bool) (features, error) {
+	f := features{
+		maxFrameSize:     cfg.Limits.MaxFrameSize,
+		streaming:        clientHello.Streaming,
+		acknowledgements: clientHello.Acks && version >= 9,
+	}
+	for _, algorithm := range clientHello.Compression {
+		if slices.Contains(supportedCompression, algorithm) {
+			f.compression = append(f.compression, algorithm)
+		}
+	}
+	for _, name := range clientHello.Ciphers {
+		if slices.Contains(supportedCiphers, name) && !passwordless {
+			f.ciphers = append(f.ciphers, name)
+		}
+	}
+	keyedIntegrity := !passwordless && len(clientHello.KeyShare) > 0 && !f.secure()
+	for _, algorithm := range clientHello.Checksums {
+		if slices.Contains(supportedChecksums, algorithm) && (keyedIntegrity || algorithm != protocol.ChecksumHMACSHA256) {
+			f.checksums = append(f.checksums, algorithm)
+		}
+	}
+	if len(f.checksums) == 0 {
+		return f, fmt.Errorf("no common checksum algorithm: client offers %v, server supports %v", clientHello.Checksums, supportedChecksums)
+	}
+	if clientHello.MaxFrameSize != 0 {
+		f.maxFrameSize = min(f.maxFrameSize, clientHello.MaxFrameSize)
+	}
+	if f.maxFrameSize < minMaxFrameSize {
+		return f, fmt.Errorf("maximum frame size %d is below %d", f.maxFrameSize, minMaxFrameSize)
+	}
+	return f, nil
+}
+
+// secure reports whether frames are encrypted.
+func (f features) secure() bool {
+	return len(f.ciphers) > 0
+}
+
+// keyed reports whether the hellos carry a key exchange, which both a
+// cipher and HMAC integrity need.
+func (f features) keyed() bool {
+	return f.secure() || f.checksums[0] == protocol.ChecksumHMACSHA256
+}
+
+// allowedFlags returns the envelope flags the negotiated features permit.
+func (f features) allowedFlags() byte {
+	var flags byte
+	if len(f.compression) > 0 {
+		flags |= flagCompressed
+	}
+	return flags
+}
+
+// frameCodec encodes and decodes envelopes under the negotiated features.
+// Frames must be encoded and decoded in the order they travel, since they
+// are numbered.
+type frameCodec struct {
+	features  features
+	integrity protocol.Integrity
+	channel   *protocol.SecureChannel
+	sequenced bool
+
+	sendSeq uint64
+	recvSeq uint64 // counts received frames when they carry no number
+	lastSeq uint64 // number of the last frame decoded
+	window  *protocol.ReplayWindow
+}
+
+// newFrameCodec returns the codec for a session once the user has
+// authenticated, which is when the session keys can be derived.
+func newFrameCodec(hs handshake, passwordHash string) (*frameCodec, error) {
+	check := protocol.Integrity{Algorithm: hs.features.checksums[0]}
+	if check.Algorithm == protocol.ChecksumHMACSHA256 {
+		clientKey, serverKey, err := hs.sessionKeys("integrity", passwordHash)
+		if err != nil {
+			return nil, err
+		}
+		check.SendKey, check.RecvKey = serverKey, clientKey
+	}
+	c := &frameCodec{
+		features:  hs.features,
+		integrity: check,
+		sequenced: hs.version >= 9,
+		window:    protocol.NewReplayWindow(),
+	}
+	if hs.features.secure() {
+		var err error
+		c.channel, err = newSecureChannel(hs, passwordHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *frameCodec) headerSize() int {
+	if c.sequenced {
+		return envelopeHeaderSize + 8
+	}
+	return envelopeHeaderSize
+}
+
+func (c *frameCodec) trailerSize() int {
+	if c.channel != nil {
+		return c.channel.Overhead()
+	}
+	return c.integrity.Size()
+}
+
+// encode wraps a frame, given as its type byte followed by its body, in an
+// envelope.
+func (c *frameCodec) encode(frame []byte) ([]byte, error) {
+	if len(frame) == 0 {
+		return nil, errors.New("empty frame")
+	}
+	payload := frame[1:]
+	if uint64(len(payload)) > uint64(c.features.maxFrameSize) {
+		return nil, fmt.Errorf("%w: payload of %d bytes exceeds the maximum frame size %d", errFrameRejected, len(payload), c.features.maxFrameSize)
+	}
+
+	var flags byte
+	if len(c.features.compression) > 0 && len(payload) >= protocol.CompressionThreshold {
+		compressed, err := protocol.Compress(c.features.compression[0], payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(payload) {
+			payload = compressed
+			flags |= flagCompressed
+		}
+	}
+
+	c.sendSeq++
+	buf := append(make([]byte, 0, c.headerSize()+len(payload)+c.trailerSize()), frame[0], flags)
+	if c.sequenced {
+		buf = binary.BigEndian.AppendUint64(buf, c.sendSeq)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	if c.channel != nil {
+		return c.channel.Seal(buf, c.sendSeq, payload), nil
+	}
+	buf = append(buf, payload...)
+	return append(buf, c.integrity.Seal(buf)...), nil
+}
+
+// decode reads one envelope and returns the frame type and payload. A
+// frame whose trailer fails the integrity check is consumed and reported
+// with an *protocol.IntegrityError, and one the replay window refuses with a
+// *protocol.ReplayError. Frames breaking the negotiated features are
+// rejected with errFrameRejected.
+func (c *frameCodec) decode(reader *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, c.headerSize())
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	messageType, flags := header[0], header[1]
+	if unsupported := flags &^ c.features.allowedFlags(); unsupported != 0 {
+		return 0, nil, fmt.Errorf("%w: unsupported flags %#02x", errFrameRejected, unsupported)
+	}
+	length := binary.BigEndian.Uint32(header[len(header)-4:])
+	if length > c.features.maxFrameSize {
+		return 0, nil, fmt.Errorf("%w: payload of %d bytes exceeds the maximum frame size %d", errFrameRejected, length, c.features.maxFrameSize)
+	}
+
+	rest := make([]byte, int(length)+c.trailerSize())
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return 0, nil, err
+	}
+	c.recvSeq++
+	seq := c.recvSeq
+	if c.sequenced {
+		seq = binary.BigEndian.Uint64(header[2:])
+	}
+	var payload []byte
+	if c.channel != nil {
+		var ok bool
+		payload, ok = c.channel.Open(header, seq, rest)
+		if !ok {
+			return 0, nil, &protocol.IntegrityError{Algorithm: c.channel.Name, MessageType: messageType, Seq: seq}
+		}
+	} else {
+		payload = rest[:length]
+		if !c.integrity.Verify(append(header, payload...), rest[length:]) {
+			return 0, nil, &protocol.IntegrityError{Algorithm: c.integrity.Algorithm, MessageType: messageType, Seq: seq}
+		}
+	}
+	if c.sequenced {
+		// Only numbers from frames that passed the check can move the window
+		if err := c.window.Accept(seq); err != nil {
+			return 0, nil, err
+		}
+	}
+	c.lastSeq = seq
+	if flags&flagCompressed != 0 {
+		var err error
+		payload, err = protocol.Decompress(c.features.compression[0], payload, protocol.DecompressionLimit(len(payload), c.features.maxFrameSize))
+		if err != nil {
+			return 0, nil, fmt.Errorf("%w: %v", errFrameRejected, err)
+		}
+	}
+	return messageType, payload, nil
+}
+
+// envelopeReader turns a stream of envelopes back into version 7 frames,
+// each with the CRC32 trailer handleConnection checks, so that it reads
+// every protocol version the same way. Frames failing their integrity
+// check or replayed never reach the handler; they are passed to onInvalid
+// instead. onAccepted, if set, learns the number of every other frame.
+type envelopeReader struct {
+	codec      *frameCodec
+	reader     *bufio.Reader
+	onInvalid  func(error)
+	onAccepted func(seq uint64)
+	pending    []byte
+}
+
+func (r *envelopeReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		messageType, payload, err := r.codec.decode(r.reader)
+		if protocol.DroppedFrame(err) {
+			r.onInvalid(err)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if r.onAccepted != nil {
+			r.onAccepted(r.codec.lastSeq)
+		}
+		frame := append([]byte{messageType}, payload...)
+		r.pending = binary.BigEndian.AppendUint32(frame, calculateCRC32(frame))
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// frameReader reads the fields of the frames handleConnection takes. A
+// length prefix larger than the maximum frame size, or inside an envelope
+// one that runs past the end of the frame, is refused before anything is
+// allocated for it, rather than read on into the frames that follow.
+type frameReader struct {
+	*bufio.Reader
+	envelopes *envelopeReader // nil before version 8
+}
+
+// checkLength refuses a length prefix longer than the maximum frame size
+// or than what is left of the frame.
+func (r *frameReader) checkLength(length uint64) error {
+	if length > uint64(cfg.Limits.MaxFrameSize) {
+		return fmt.Errorf("%w: length %d exceeds the maximum frame size %d", errFrameRejected, length, cfg.Limits.MaxFrameSize)
+	}
+	if r.envelopes == nil {
+		return nil
+	}
+	if left := r.Buffered() + len(r.envelopes.pending); length > uint64(left) {
+		return fmt.Errorf("%w: length %d exceeds the %d bytes left in the frame", errFrameRejected, length, left)
+	}
+	return nil
+}
+
+// readLengthPrefixed is readLengthPrefixed with the length checked first.
+func (r *frameReader) readLengthPrefixed() ([]byte, []byte, error) {
+	lengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, lengthBuf); err != nil {
+		return nil, nil, err
+	}
+	if err := r.checkLength(uint64(binary.BigEndian.Uint32(lengthBuf))); err != nil {
+		return nil, nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(lengthBuf))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, err
+	}
+	return lengthBuf, data, nil
+}
+
+// envelopeConn wraps every frame written to it in an envelope. Each Write
+// must carry exactly one frame.
+type envelopeConn struct {
+	net.Conn
+	codec *frameCodec
+}
+
+func (c *envelopeConn) Write(frame []byte) (int, error) {
+	buf, err := c.codec.encode(frame)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(frame), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"../protocol"
+)
+
+// codecPair returns a sending and a receiving codec for the same session.
+func codecPair(version uint16, f features) (*frameCodec, *frameCodec) {
+	key := bytes.Repeat([]byte{7}, 32)
+	codec := func() *frameCodec {
+		return &frameCodec{
+			features:  f,
+			integrity: protocol.Integrity{Algorithm: f.checksums[0], SendKey: key, RecvKey: key},
+			sequenced: version >= 9,
+			window:    protocol.NewReplayWindow(),
+		}
+	}
+	return codec(), codec()
+}
+
+func TestFrameCodecRoundTrip(t *testing.T) {
+	long := bytes.Repeat([]byte("compressible "), 200)
+	tests := []struct {
+		name    string
+		version uint16
+		f       features
+	}{
+		{"version 8", 8, features{checksums: []string{protocol.ChecksumCRC32IEEE}, maxFrameSize: 1 << 16}},
+		{"version 9", 9, features{checksums: []string{protocol.ChecksumCRC32IEEE}, maxFrameSize: 1 << 16}},
+		{"crc32c", 9, features{checksums: []string{protocol.ChecksumCRC32C}, maxFrameSize: 1 << 16}},
+		{"hmac-sha256", 9, features{checksums: []string{protocol.ChecksumHMACSHA256}, maxFrameSize: 1 << 16}},
+		{"compressed", 9, features{checksums: []string{protocol.ChecksumCRC32IEEE}, compression: []string{protocol.CompressionGzip}, maxFrameSize: 1 << 16}},
+	}
+	for _, tt := range tests {
+		sender, receiver := codecPair(tt.version, tt.f)
+		var wire bytes.Buffer
+		frames := [][]byte{{0x08}, append([]byte{0x01}, "short"...), append([]byte{0x01}, long...)}
+		for _, frame := range frames {
+			envelope, err := sender.encode(frame)
+			if err != nil {
+				t.Fatalf("%s: encode: %v", tt.name, err)
+			}
+			wire.Write(envelope)
+		}
+		reader := bufio.NewReader(&wire)
+		for i, frame := range frames {
+			messageType, payload, err := receiver.decode(reader)
+			if err != nil || messageType != frame[0] || !bytes.Equal(payload, frame[1:]) {
+				t.Fatalf("%s: frame %d decoded as %#02x %q, %v", tt.name, i, messageType, payload, err)
+			}
+		}
+	}
+}
+
+func TestFrameCodecRejects(t *testing.T) {
+	f := features{checksums: []string{protocol.ChecksumCRC32IEEE}, maxFrameSize: 1024}
+	sender, _ := codecPair(9, f)
+	valid, err := sender.encode(append([]byte{0x01}, "text"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flagged := bytes.Clone(valid)
+	flagged[1] = flagCompressed
+	oversized := bytes.Clone(valid)
+	binary.BigEndian.PutUint32(oversized[10:], 1025)
+	corrupted := bytes.Clone(valid)
+	corrupted[len(corrupted)-5] ^= 0x01
+
+	tests := []struct {
+		name     string
+		wire     []byte
+		rejected bool // errFrameRejected rather than a dropped frame
+	}{
+		{"flag not negotiated", flagged, true},
+		{"over the maximum frame size", oversized, true},
+		{"corrupted payload", corrupted, false},
+		{"replayed", append(bytes.Clone(valid), valid...), false},
+	}
+	for _, tt := range tests {
+		_, receiver := codecPair(9, f)
+		reader := bufio.NewReader(bytes.NewReader(tt.wire))
+		_, _, err := receiver.decode(reader)
+		if tt.name == "replayed" && err == nil {
+			_, _, err = receiver.decode(reader)
+		}
+		switch {
+		case tt.rejected && !errors.Is(err, errFrameRejected):
+			t.Errorf("%s: %v, want errFrameRejected", tt.name, err)
+		case !tt.rejected && !protocol.DroppedFrame(err):
+			t.Errorf("%s: %v, want a dropped frame", tt.name, err)
+		}
+	}
+}
+
+func TestFrameReaderRefusesOversizedLengths(t *testing.T) {
+	sender, receiver := codecPair(9, features{checksums: []string{protocol.ChecksumCRC32IEEE}, maxFrameSize: 1 << 16})
+	// A text frame claiming more text than its envelope carries, followed
+	// by a frame whose bytes it would otherwise swallow
+	short := binary.BigEndian.AppendUint32([]byte{0x01}, 100)
+	short = append(short, "only this"...)
+	var wire bytes.Buffer
+	for _, frame := range [][]byte{short, append([]byte{0x01}, bytes.Repeat([]byte{'x'}, 200)...)} {
+		envelope, err := sender.encode(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wire.Write(envelope)
+	}
+	envelopes := &envelopeReader{codec: receiver, reader: bufio.NewReader(&wire), onInvalid: func(error) {}}
+	reader := &frameReader{Reader: bufio.NewReader(envelopes), envelopes: envelopes}
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.checkLength(uint64(binary.BigEndian.Uint32(header[1:])) + 4); !errors.Is(err, errFrameRejected) {
+		t.Fatalf("checkLength: %v, want errFrameRejected", err)
+	}
+	if err := reader.checkLength(uint64(len("only this")) + 4); err != nil {
+		t.Fatalf("checkLength of what is left: %v", err)
+	}
+
+	// Without envelopes only the maximum frame size bounds the frame
+	plain := &frameReader{Reader: bufio.NewReader(bytes.NewReader(nil))}
+	tests := []struct {
+		length uint64
+		ok     bool
+	}{
+		{1 << 20, true},
+		{uint64(cfg.Limits.MaxFrameSize), true},
+		{uint64(cfg.Limits.MaxFrameSize) + 1, false},
+		{math.MaxUint32 + 4, false},
+	}
+	for _, tt := range tests {
+		if err := plain.checkLength(tt.length); (err == nil) != tt.ok || err != nil && !errors.Is(err, errFrameRejected) {
+			t.Errorf("checkLength(%d) outside an envelope: %v", tt.length, err)
+		}
+	}
+	if err := reader.checkLength(uint64(cfg.Limits.MaxFrameSize) + 1); !errors.Is(err, errFrameRejected) {
+		t.Errorf("checkLength past the maximum frame size in an envelope: %v", err)
+	}
+
+	// Nor may a length read on its own claim more than a frame
+	huge := binary.BigEndian.AppendUint32(nil, cfg.Limits.MaxFrameSize+1)
+	if _, _, err := readLengthPrefixed(bufio.NewReader(bytes.NewReader(huge))); !errors.Is(err, errFrameRejected) {
+		t.Errorf("readLengthPrefixed of %d bytes: %v", cfg.Limits.MaxFrameSize+1, err)
+	}
+}
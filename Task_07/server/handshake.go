@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"../protocol"
+)
+
+// Protocol versions are numbered after the task that introduced the wire
+// format, so version 7 is the Task_07 format: line-based authentication
+// followed by typed frames with a CRC32 trailer. Version 8 wraps those
+// frames in envelopes governed by negotiated features, and version 9
+// numbers the envelopes to stop replays.
+const (
+	minProtocolVersion = 7
+	maxProtocolVersion = 9
+	serverIdentity     = "Task_07 server"
+	maxHelloSize       = 64 * 1024
+)
+
+// helloMagic opens every hello so that a peer speaking some other protocol
+// is recognised before anything else is exchanged.
+var helloMagic = []byte("GSPH")
+
+var (
+	errIncompatibleVersion = errors.New("incompatible protocol version")
+	errInvalidChecksum     = errors.New("invalid checksum")
+)
+
+// hello is exchanged by both sides before authentication. The client sends
+// the range of versions it speaks and the optional features it supports;
+// the server answers with the version it chose and the features both
+// support, or with an error if they cannot agree. On the wire it is
+//
+//	[magic "GSPH"][body length uint32][TLV body][checksum uint32]
+type hello struct {
+	MinVersion   uint16   `tlv:"1"`
+	MaxVersion   uint16   `tlv:"2"`
+	Identity     string   `tlv:"3,omitempty"`
+	Version      uint16   `tlv:"4,omitempty"`
+	Error        string   `tlv:"5,omitempty"`
+	Compression  []string `tlv:"6"`
+	Checksums    []string `tlv:"7"`
+	MaxFrameSize uint32   `tlv:"8,omitempty"`
+	Streaming    bool     `tlv:"9,omitempty"`
+	Nonce        []byte   `tlv:"10,omitempty"`
+	Ciphers      []string `tlv:"11"`
+	KeyShare     []byte   `tlv:"12,omitempty"`
+	Acks         bool     `tlv:"13,omitempty"`
+
+	// Authenticated names the user the server identified by peer
+	// credentials. The client then sends no credentials.
+	Authenticated string `tlv:"14,omitempty"`
+}
+
+const helloNonceSize = 16
+
+// handshake is the outcome of the hello exchange.
+type handshake struct {
+	version  uint16
+	features features
+
+	// Both hellos as sent, nonces and key shares included, which the
+	// transcript covers.
+	clientHello []byte
+	serverHello []byte
+
+	// Set when a cipher or HMAC integrity was agreed.
+	sharedSecret []byte
+
+	// authenticatedAs is the user identified by peer credentials, if the
+	// client was told in the hello.
+	authenticatedAs string
+}
+
+// readHello reads a hello and also returns it as received.
+func readHello(reader *bufio.Reader) (hello, []byte, error) {
+	var h hello
+	magic := make([]byte, len(helloMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return h, nil, err
+	}
+	if !bytes.Equal(magic, helloMagic) {
+		return h, nil, fmt.Errorf("bad hello magic %q", magic)
+	}
+
+	bodyLengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, bodyLengthBuf); err != nil {
+		return h, nil, err
+	}
+	bodyLength := binary.BigEndian.Uint32(bodyLengthBuf)
+	if bodyLength > maxHelloSize {
+		return h, nil, fmt.Errorf("hello of %d bytes is too large", bodyLength)
+	}
+	rest := make([]byte, bodyLength+4)
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return h, nil, err
+	}
+	message := append(append(append([]byte(nil), magic...), bodyLengthBuf...), rest...)
+	if !validateChecksum(message) {
+		return h, nil, errInvalidChecksum
+	}
+	if err := protocol.UnmarshalTLV(rest[:bodyLength], &h); err != nil {
+		return h, nil, err
+	}
+	return h, message, nil
+}
+
+// writeHello sends a hello and also returns it as sent.
+func writeHello(conn net.Conn, h hello) ([]byte, error) {
+	body, err := protocol.MarshalTLV(h)
+	if err != nil {
+		return nil, err
+	}
+	buf := append([]byte(nil), helloMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(body)))
+	buf = append(buf, body...)
+	buf = binary.BigEndian.AppendUint32(buf, calculateCRC32(buf))
+	_, err = conn.Write(buf)
+	return buf, err
+}
+
+// negotiateVersion picks the highest version in both ranges.
+func negotiateVersion(clientMin, clientMax uint16) (uint16, error) {
+	version := min(clientMax, maxProtocolVersion)
+	if version < max(clientMin, minProtocolVersion) {
+		return 0, fmt.Errorf("%w: client speaks %d-%d, server speaks %d-%d",
+			errIncompatibleVersion, clientMin, clientMax, minProtocolVersion, maxProtocolVersion)
+	}
+	return version, nil
+}
+
+// startsLegacy reports whether the client started with something other
+// than a hello. It looks one byte at a time, since a version 7 client may
+// send a username shorter than the magic and then wait for an answer.
+func startsLegacy(reader *bufio.Reader) (bool, error) {
+	for i := 1; i <= len(helloMagic); i++ {
+		start, err := reader.Peek(i)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(start, helloMagic[:i]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// negotiateProtocol runs the server side of the hello exchange. A client
+// that starts straight with its username predates the handshake and is
+// taken to speak version 7. peerUser is the user identified by peer
+// credentials, or empty if the client must authenticate.
+func negotiateProtocol(conn net.Conn, reader *bufio.Reader, peerUser string) (handshake, error) {
+	legacy, err := startsLegacy(reader)
+	if err != nil {
+		return handshake{}, err
+	}
+	if legacy {
+		version, err := negotiateVersion(7, 7)
+		if err != nil {
+			conn.Write([]byte("Incompatible protocol version\n"))
+		}
+		return handshake{version: version, features: legacyFeatures}, err
+	}
+
+	clientHello, received, err := readHello(reader)
+	if err != nil {
+		return handshake{}, err
+	}
+	fmt.Printf("Client %q speaks protocol versions %d-%d\n", clientHello.Identity, clientHello.MinVersion, clientHello.MaxVersion)
+
+	reply := hello{
+		MinVersion:    minProtocolVersion,
+		MaxVersion:    maxProtocolVersion,
+		Identity:      serverIdentity,
+		Nonce:         make([]byte, helloNonceSize),
+		Authenticated: peerUser,
+	}
+	if _, err := rand.Read(reply.Nonce); err != nil {
+		return handshake{}, err
+	}
+	version, err := negotiateVersion(clientHello.MinVersion, clientHello.MaxVersion)
+	if err != nil {
+		reply.Error = err.Error()
+		writeHello(conn, reply)
+		return handshake{}, err
+	}
+	reply.Version = version
+
+	hs := handshake{
+		version:         version,
+		features:        legacyFeatures,
+		clientHello:     received,
+		authenticatedAs: peerUser,
+	}
+	if version >= 8 {
+		hs.features, err = negotiateFeatures(clientHello, version, peerUser != "")
+		if err != nil {
+			reply.Error = err.Error()
+			writeHello(conn, reply)
+			return handshake{}, err
+		}
+		reply.Compression = hs.features.compression
+		reply.Checksums = hs.features.checksums
+		reply.MaxFrameSize = hs.features.maxFrameSize
+		reply.Streaming = hs.features.streaming
+		reply.Acks = hs.features.acknowledgements
+		reply.Ciphers = hs.features.ciphers
+		if hs.features.keyed() {
+			reply.KeyShare, err = exchangeKeys(&hs, clientHello.KeyShare)
+			if err != nil {
+				reply.Error = err.Error()
+				writeHello(conn, reply)
+				return handshake{}, err
+			}
+		}
+	}
+	hs.serverHello, err = writeHello(conn, reply)
+	return hs, err
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"../protocol"
+)
+
+// clientHello encodes h the way a client sends it.
+func clientHello(t *testing.T, h hello) []byte {
+	t.Helper()
+	body, err := protocol.MarshalTLV(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := append([]byte(nil), helloMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(body)))
+	buf = append(buf, body...)
+	return binary.BigEndian.AppendUint32(buf, calculateCRC32(buf))
+}
+
+// tryHandshake sends sent to negotiateProtocol and returns the outcome and
+// the server hello as the client received it.
+func tryHandshake(t *testing.T, sent []byte) (handshake, hello, []byte, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	type result struct {
+		hs  handshake
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		hs, err := negotiateProtocol(server, bufio.NewReader(server), "")
+		done <- result{hs, err}
+	}()
+	if _, err := client.Write(sent); err != nil {
+		t.Fatal(err)
+	}
+	reply, received, err := readHello(bufio.NewReader(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	return r.hs, reply, received, r.err
+}
+
+// runHandshake is tryHandshake for an exchange that must succeed.
+func runHandshake(t *testing.T, sent []byte) (handshake, hello, []byte) {
+	t.Helper()
+	hs, reply, received, err := tryHandshake(t, sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hs, reply, received
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		clientMin, clientMax uint16
+		want                 uint16 // 0 when incompatible
+	}{
+		{7, 7, 7},
+		{7, 9, 9},
+		{8, 8, 8},
+		{8, 12, 9},
+		{2, 6, 0},
+		{10, 12, 0},
+		{9, 8, 0},
+	}
+	for _, tt := range tests {
+		version, err := negotiateVersion(tt.clientMin, tt.clientMax)
+		if tt.want == 0 {
+			if !errors.Is(err, errIncompatibleVersion) {
+				t.Errorf("negotiateVersion(%d, %d) = %d, %v, want errIncompatibleVersion", tt.clientMin, tt.clientMax, version, err)
+			}
+			continue
+		}
+		if err != nil || version != tt.want {
+			t.Errorf("negotiateVersion(%d, %d) = %d, %v, want %d", tt.clientMin, tt.clientMax, version, err, tt.want)
+		}
+	}
+}
+
+func TestReadHelloRejectsDamagedHellos(t *testing.T) {
+	valid := clientHello(t, hello{MinVersion: 7, MaxVersion: 9, Identity: "test"})
+	withChecksum := func(body []byte) []byte {
+		buf := append([]byte(nil), helloMagic...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(body)))
+		buf = append(buf, body...)
+		return binary.BigEndian.AppendUint32(buf, calculateCRC32(buf))
+	}
+	flipped := bytes.Clone(valid)
+	flipped[len(helloMagic)+5] ^= 0x01
+
+	tests := []struct {
+		name  string
+		hello []byte
+	}{
+		{"bad magic", append([]byte("HTTP"), valid[len(helloMagic):]...)},
+		{"too large", binary.BigEndian.AppendUint32(bytes.Clone(helloMagic), maxHelloSize+1)},
+		{"bad checksum", flipped},
+		{"truncated", valid[:len(valid)-1]},
+		{"malformed body", withChecksum([]byte{0, 1, 0, 0, 0, 9})},
+	}
+	if _, _, err := readHello(bufio.NewReader(bytes.NewReader(valid))); err != nil {
+		t.Fatalf("valid hello: %v", err)
+	}
+	for _, tt := range tests {
+		if h, _, err := readHello(bufio.NewReader(bytes.NewReader(tt.hello))); err == nil {
+			t.Errorf("%s: read %+v", tt.name, h)
+		}
+	}
+}
+
+func TestHandshakeIncompatibleVersion(t *testing.T) {
+	_, reply, _, err := tryHandshake(t, clientHello(t, hello{MinVersion: 10, MaxVersion: 12}))
+	if !errors.Is(err, errIncompatibleVersion) {
+		t.Fatalf("negotiateProtocol: %v, want errIncompatibleVersion", err)
+	}
+	if reply.Error == "" || reply.Version != 0 || reply.MinVersion != minProtocolVersion || reply.MaxVersion != maxProtocolVersion {
+		t.Fatalf("server replied %+v, want its range and an error", reply)
+	}
+}
+
+func TestHandshakeLegacyClient(t *testing.T) {
+	// Usernames shorter than the magic, or sharing its start, must not
+	// leave the server waiting for more
+	for _, first := range []string{"a\n", "GS\n", "user1\n"} {
+		client, server := net.Pipe()
+		done := make(chan error, 1)
+		var hs handshake
+		go func() {
+			var err error
+			hs, err = negotiateProtocol(server, bufio.NewReader(server), "")
+			done <- err
+		}()
+		go client.Write([]byte(first))
+		select {
+		case err := <-done:
+			if err != nil || hs.version != 7 || !reflect.DeepEqual(hs.features, legacyFeatures) {
+				t.Errorf("client starting %q: version %d, features %+v, %v", first, hs.version, hs.features, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("client starting %q: server still waiting", first)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestHandshakeTranscriptCoversHellos(t *testing.T) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := hello{
+		MinVersion: 8,
+		MaxVersion: 9,
+		Checksums:  supportedChecksums,
+		Nonce:      bytes.Repeat([]byte{1}, helloNonceSize),
+		Ciphers:    supportedCiphers,
+		KeyShare:   private.PublicKey().Bytes(),
+	}
+	sent := clientHello(t, offer)
+	hs, reply, received := runHandshake(t, sent)
+
+	if !hs.features.secure() || len(reply.KeyShare) == 0 {
+		t.Fatalf("no cipher agreed: %+v", reply)
+	}
+	if !bytes.Equal(hs.clientHello, sent) || !bytes.Equal(hs.serverHello, received) {
+		t.Fatal("handshake does not keep the hellos as sent")
+	}
+
+	// The client's view of the same exchange gives the same proof
+	peer, err := ecdh.X25519().NewPublicKey(reply.KeyShare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const passwordHash = "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"
+	clientView := handshake{clientHello: sent, serverHello: received, sharedSecret: secret}
+	if authProof(passwordHash, clientView) != authProof(passwordHash, hs) {
+		t.Fatal("client and server transcripts differ")
+	}
+
+	// A relay that strips the ciphers from the client hello changes the
+	// server's transcript, so the client's proof no longer matches
+	stripped := offer
+	stripped.Ciphers = nil
+	hs, _, _ = runHandshake(t, clientHello(t, stripped))
+	if hs.features.secure() {
+		t.Fatal("cipher agreed without ciphers offered")
+	}
+	hs.sharedSecret = secret
+	if authProof(passwordHash, clientView) == authProof(passwordHash, hs) {
+		t.Fatal("proof survives a changed client hello")
+	}
+}
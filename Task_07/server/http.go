@@ -0,0 +1,80 @@
+// The mux patterns name methods, which builds without a module's Go
+// version would otherwise ignore.
+//go:debug httpmuxgo121=0
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const webSocketPath = "/ws"
+
+// httpListener serves HTTP on a TCP listener. Browsers reach the protocol
+// through a WebSocket at webSocketPath, and Accept returns the upgraded
+// connections like any other listener's. The JSON bridge in bridge.go is
+// served under /v1, and metrics at /metrics.
+type httpListener struct {
+	listener net.Listener
+	server   *http.Server
+	mux      *http.ServeMux
+	accepted chan net.Conn
+
+	done    chan struct{}
+	doneErr error
+	once    sync.Once
+}
+
+func serveHTTP(listener net.Listener) *httpListener {
+	h := &httpListener{
+		listener: listener,
+		mux:      http.NewServeMux(),
+		accepted: make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	h.mux.HandleFunc(webSocketPath, h.serveWebSocket)
+	registerBridge(h.mux)
+	h.mux.HandleFunc("GET /metrics", serveMetrics)
+	h.server = &http.Server{Handler: h.mux, ReadHeaderTimeout: cfg.Timeouts.Handshake.Duration}
+	go func() {
+		err := h.server.Serve(listener)
+		h.once.Do(func() {
+			h.doneErr = err
+			close(h.done)
+		})
+	}()
+	return h
+}
+
+func (h *httpListener) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		fmt.Println("WebSocket upgrade from", r.RemoteAddr, "failed:", err)
+		return
+	}
+	select {
+	case h.accepted <- conn:
+	case <-h.done:
+		conn.Close()
+	}
+}
+
+func (h *httpListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-h.accepted:
+		return conn, nil
+	case <-h.done:
+		return nil, h.doneErr
+	}
+}
+
+func (h *httpListener) Close() error {
+	return h.server.Close()
+}
+
+func (h *httpListener) Addr() net.Addr {
+	return h.listener.Addr()
+}
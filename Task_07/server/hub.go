@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+// session is a single authenticated connection. A user may have several
+// sessions open at once, one per connected client.
+type session struct {
+	username string
+	conn     net.Conn
+	version  uint16
+	features features
+
+	// writeMu serializes writes, since frames routed from other
+	// connections can be written while this connection is replying.
+	writeMu sync.Mutex
+}
+
+func (s *session) write(data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.conn.Write(data)
+	return err
+}
+
+// hub tracks the active sessions of every connected user so that one
+// connection can reach another.
+type hub struct {
+	mu       sync.RWMutex
+	sessions map[string]map[*session]struct{}
+}
+
+var activeSessions = newHub()
+
+func newHub() *hub {
+	return &hub{sessions: make(map[string]map[*session]struct{})}
+}
+
+func (h *hub) register(s *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	userSessions, ok := h.sessions[s.username]
+	if !ok {
+		userSessions = make(map[*session]struct{})
+		h.sessions[s.username] = userSessions
+	}
+	userSessions[s] = struct{}{}
+}
+
+func (h *hub) unregister(s *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	userSessions, ok := h.sessions[s.username]
+	if !ok {
+		return
+	}
+	delete(userSessions, s)
+	if len(userSessions) == 0 {
+		delete(h.sessions, s.username)
+	}
+}
+
+// sessionsFor returns a snapshot of the active sessions of username.
+func (h *hub) sessionsFor(username string) []*session {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	userSessions := h.sessions[username]
+	result := make([]*session, 0, len(userSessions))
+	for s := range userSessions {
+		result = append(result, s)
+	}
+	return result
+}
+
+// streamingSessionsFor returns a snapshot of the active sessions of
+// username that accept pushed frames.
+func (h *hub) streamingSessionsFor(username string) []*session {
+	var result []*session
+	for _, s := range h.sessionsFor(username) {
+		if s.features.streaming {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// push writes data to sessions and reports how many received it.
+func push(sessions []*session, data []byte) int {
+	delivered := 0
+	for _, s := range sessions {
+		if err := s.write(data); err != nil {
+			continue
+		}
+		delivered++
+	}
+	return delivered
+}
+
+// users returns the names of the users with at least one active session,
+// sorted.
+func (h *hub) users() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	names := make([]string, 0, len(h.sessions))
+	for username := range h.sessions {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Direct messages and direct data packets for a user with no session that
+// accepts pushed frames are kept in the user's inbox and delivered, oldest
+// first and before any frame pushed to the new session, when the user next
+// authenticates. Each item goes out in a single write as
+//
+//	[0x15][item ID uint64][queued at int64 unix nanoseconds][queued frame]
+//
+// so that it travels in one envelope or WebSocket message, and stays in
+// the inbox until the client confirms it with
+//
+//	[0x16][item ID uint64][checksum uint32]
+//
+// Items older than the retention time are discarded.
+//
+// A user's inbox has one owner at a time, the newest of the user's
+// sessions that accept pushed frames. Only the owner is sent the waiting
+// items: when it registers, and when the owner before it ends without
+// confirming them all, the next newest session takes over and is sent what
+// is still waiting. An item is removed only once confirmed, from whichever
+// session, so one the previous owner had not confirmed is sent again.
+const (
+	inboxFile = "inbox.json"
+
+	defaultInboxRetention = 7 * 24 * time.Hour
+	defaultInboxMaxItems  = 100
+)
+
+var errInboxFull = errors.New("inbox is full")
+
+type inboxItem struct {
+	ID       uint64    `json:"id"`
+	Sender   string    `json:"sender"`
+	Frame    []byte    `json:"frame"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+type inboxStore struct {
+	mu        sync.Mutex
+	path      string
+	retention time.Duration
+	maxItems  int
+	items     map[string][]inboxItem
+	nextID    uint64
+
+	// owners holds the streaming sessions of each user in the order they
+	// registered. The last one owns the inbox.
+	owners map[string][]*session
+}
+
+type storedInboxes struct {
+	NextID uint64                 `json:"next_id"`
+	Items  map[string][]inboxItem `json:"items"`
+}
+
+var inboxes *inboxStore
+
+func openInboxStore(dir string, retention time.Duration, maxItems int) (*inboxStore, error) {
+	s := &inboxStore{
+		path:      filepath.Join(dir, inboxFile),
+		retention: retention,
+		maxItems:  maxItems,
+		items:     make(map[string][]inboxItem),
+		nextID:    1,
+		owners:    make(map[string][]*session),
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored storedInboxes
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", s.path, err)
+	}
+	if stored.Items != nil {
+		s.items = stored.Items
+	}
+	s.nextID = max(s.nextID, stored.NextID)
+	return s, nil
+}
+
+// enqueue adds frame, sent by sender, to the inbox of recipient.
+func (s *inboxStore) enqueue(recipient, sender string, frame []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enqueueLocked(recipient, sender, frame)
+}
+
+// enqueueUnlessStreaming queues frame like enqueue unless recipient has
+// sessions that accept pushed frames, which it returns instead. Sessions
+// register under the same lock, so a frame is either queued before a new
+// session reads the inbox or finds that session.
+func (s *inboxStore) enqueueUnlessStreaming(recipient, sender string, frame []byte) ([]*session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sessions := activeSessions.streamingSessionsFor(recipient); len(sessions) > 0 {
+		return sessions, nil
+	}
+	return nil, s.enqueueLocked(recipient, sender, frame)
+}
+
+func (s *inboxStore) enqueueLocked(recipient, sender string, frame []byte) error {
+	s.expireLocked(recipient)
+	if len(s.items[recipient]) >= s.maxItems {
+		return fmt.Errorf("%w: %d items waiting", errInboxFull, len(s.items[recipient]))
+	}
+	item := inboxItem{ID: s.nextID, Sender: sender, Frame: frame, QueuedAt: time.Now()}
+	s.items[recipient] = append(s.items[recipient], item)
+	s.nextID++
+	if err := s.saveLocked(); err != nil {
+		s.items[recipient] = s.items[recipient][:len(s.items[recipient])-1]
+		return err
+	}
+	return nil
+}
+
+// register adds sess to the active sessions, makes it the owner of its
+// user's inbox and returns the unexpired items waiting, oldest first.
+func (s *inboxStore) register(sess *session) []inboxItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	activeSessions.register(sess)
+	username := sess.username
+	s.owners[username] = append(s.owners[username], sess)
+	if s.expireLocked(username) {
+		if err := s.saveLocked(); err != nil {
+			fmt.Println("Error saving inbox:", err)
+		}
+	}
+	return append([]inboxItem(nil), s.items[username]...)
+}
+
+// unregister removes sess from the active sessions. If it owned its user's
+// inbox and another streaming session remains, it returns the newest of
+// those, which now owns the inbox, and the items still waiting.
+func (s *inboxStore) unregister(sess *session) (*session, []inboxItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	activeSessions.unregister(sess)
+	username := sess.username
+	owners := s.owners[username]
+	i := slices.Index(owners, sess)
+	if i < 0 {
+		return nil, nil
+	}
+	owners = slices.Delete(owners, i, i+1)
+	if len(owners) == 0 {
+		delete(s.owners, username)
+		return nil, nil
+	}
+	s.owners[username] = owners
+	if i < len(owners) || len(s.items[username]) == 0 {
+		return nil, nil
+	}
+	return owners[len(owners)-1], append([]inboxItem(nil), s.items[username]...)
+}
+
+// remove deletes a delivered item and reports whether it was waiting.
+func (s *inboxStore) remove(username string, id uint64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := s.items[username]
+	for i, item := range items {
+		if item.ID != id {
+			continue
+		}
+		s.items[username] = append(items[:i:i], items[i+1:]...)
+		if len(s.items[username]) == 0 {
+			delete(s.items, username)
+		}
+		return true, s.saveLocked()
+	}
+	return false, nil
+}
+
+// expireLocked drops the items of username older than the retention time
+// and reports whether there were any.
+func (s *inboxStore) expireLocked(username string) bool {
+	items := s.items[username]
+	cutoff := time.Now().Add(-s.retention)
+	expired := 0
+	for expired < len(items) && items[expired].QueuedAt.Before(cutoff) {
+		expired++
+	}
+	if expired == 0 {
+		return false
+	}
+	if expired == len(items) {
+		delete(s.items, username)
+	} else {
+		s.items[username] = items[expired:]
+	}
+	fmt.Printf("Discarded %d expired inbox items for %s\n", expired, username)
+	return true
+}
+
+func (s *inboxStore) saveLocked() error {
+	data, err := json.MarshalIndent(storedInboxes{NextID: s.nextID, Items: s.items}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(s.path, data)
+}
+
+// registerSession adds a newly authenticated session to the active
+// sessions and, if it accepts pushed frames, sends it the items waiting
+// for its user. Frames pushed to the session meanwhile wait for its write
+// lock, so they follow the queued ones.
+func registerSession(sess *session) {
+	if !sess.features.streaming {
+		activeSessions.register(sess)
+		return
+	}
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	deliverInboxLocked(sess, inboxes.register(sess))
+}
+
+// unregisterSession removes a session from the active sessions and, if it
+// owned its user's inbox, sends the items still waiting to the new owner.
+func unregisterSession(sess *session) {
+	if !sess.features.streaming {
+		activeSessions.unregister(sess)
+		return
+	}
+	owner, items := inboxes.unregister(sess)
+	if owner == nil {
+		return
+	}
+	owner.writeMu.Lock()
+	defer owner.writeMu.Unlock()
+	deliverInboxLocked(owner, items)
+}
+
+// deliverInboxLocked sends items to sess, each in one write. The caller
+// holds the session's write lock.
+func deliverInboxLocked(sess *session, items []inboxItem) {
+	if len(items) > 0 {
+		fmt.Printf("Delivering %d inbox items to %s\n", len(items), sess.username)
+	}
+	for _, item := range items {
+		buf := binary.BigEndian.AppendUint64([]byte{0x15}, item.ID)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(item.QueuedAt.UnixNano()))
+		if _, err := sess.conn.Write(append(buf, item.Frame...)); err != nil {
+			return
+		}
+	}
+}
+
+// deliverOrQueue sends frame to the streaming sessions of recipient, or
+// queues it in the recipient's inbox if there are none, and returns the
+// response for the sender.
+func deliverOrQueue(recipient, sender string, frame []byte) string {
+	if !userExists(recipient) {
+		return "Unknown user"
+	}
+	sessions, err := inboxes.enqueueUnlessStreaming(recipient, sender, frame)
+	if err == nil && len(sessions) > 0 {
+		if push(sessions, frame) > 0 {
+			return "Direct message delivered"
+		}
+		// Every session failed as the frame was written
+		err = inboxes.enqueue(recipient, sender, frame)
+	}
+	if err != nil {
+		fmt.Println("Error queueing message for", recipient+":", err)
+		return "User offline, message not queued: " + err.Error()
+	}
+	return "User offline, message queued"
+}
+
+// buildDirectDataPacket builds the 0x14 frame delivered to the recipient of
+// a direct data packet. It carries the sender instead of the recipient.
+func buildDirectDataPacket(sender string, dataField1 uint32, dataField2 float64, dataField3 string) []byte {
+	buf := binary.BigEndian.AppendUint32([]byte{0x14}, uint32(len(sender)))
+	buf = append(buf, sender...)
+	buf = binary.BigEndian.AppendUint32(buf, dataField1)
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(dataField2))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(dataField3)))
+	return append(buf, dataField3...)
+}
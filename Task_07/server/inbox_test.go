@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func openTestInboxes(t *testing.T) {
+	t.Helper()
+	store, err := openInboxStore(t.TempDir(), defaultInboxRetention, defaultInboxMaxItems)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := inboxes
+	inboxes = store
+	t.Cleanup(func() { inboxes = saved })
+}
+
+func TestInboxDeliveredBeforePushedFrames(t *testing.T) {
+	openTestInboxes(t)
+	for _, text := range []string{"first", "second"} {
+		if got := deliverOrQueue(storedUsername, "user2", buildDirectMessage("user2", text)); got != "User offline, message queued" {
+			t.Fatalf("deliverOrQueue = %q", got)
+		}
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	sess := &session{username: storedUsername, conn: server, version: 9, features: features{streaming: true}}
+	go registerSession(sess)
+	defer unregisterSession(sess)
+	for len(activeSessions.sessionsFor(storedUsername)) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Pushed while the inbox is being delivered
+	live := make(chan string, 1)
+	go func() { live <- deliverOrQueue(storedUsername, "user2", buildDirectMessage("user2", "live")) }()
+
+	// Each write arrives whole in one read
+	buf := make([]byte, 4096)
+	for i, text := range []string{"first", "second"} {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := buildDirectMessage("user2", text)
+		if n != 1+8+8+len(frame) || buf[0] != 0x15 || string(buf[1+8+8:n]) != string(frame) {
+			t.Fatalf("write %d = %x, want inbox item %q in one write", i, buf[:n], text)
+		}
+		if id := binary.BigEndian.Uint64(buf[1:]); id != uint64(i+1) {
+			t.Fatalf("write %d carries item %d", i, id)
+		}
+	}
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != string(buildDirectMessage("user2", "live")) {
+		t.Fatalf("third write = %x, want the live message", buf[:n])
+	}
+	if got := <-live; got != "Direct message delivered" {
+		t.Fatalf("live deliverOrQueue = %q", got)
+	}
+}
+
+func TestInboxOwnedByNewestSession(t *testing.T) {
+	openTestInboxes(t)
+	if got := deliverOrQueue(storedUsername, "user2", buildDirectMessage("user2", "waiting")); got != "User offline, message queued" {
+		t.Fatalf("deliverOrQueue = %q", got)
+	}
+	newSession := func() *session {
+		return &session{username: storedUsername, version: 9, features: features{streaming: true}}
+	}
+	first, second, third := newSession(), newSession(), newSession()
+	for i, sess := range []*session{first, second, third} {
+		if items := inboxes.register(sess); len(items) != 1 {
+			t.Fatalf("session %d was sent %d items on registering, want 1", i, len(items))
+		}
+	}
+
+	// Only the owner hands the inbox over as it ends
+	if owner, items := inboxes.unregister(second); owner != nil || items != nil {
+		t.Fatalf("ending an older session handed %d items to %p", len(items), owner)
+	}
+	owner, items := inboxes.unregister(third)
+	if owner != first || len(items) != 1 {
+		t.Fatalf("ending the owner handed %d items to %p, want 1 to the first session", len(items), owner)
+	}
+	if removed, err := inboxes.remove(storedUsername, items[0].ID); !removed || err != nil {
+		t.Fatalf("remove = %v, %v", removed, err)
+	}
+	if owner, items := inboxes.unregister(first); owner != nil || items != nil {
+		t.Fatalf("ending the last session handed %d items to %p", len(items), owner)
+	}
+	if sessions := activeSessions.sessionsFor(storedUsername); len(sessions) != 0 {
+		t.Fatalf("%d sessions left active", len(sessions))
+	}
+}
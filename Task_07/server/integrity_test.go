@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+
+	"../protocol"
+)
+
+func TestNegotiateHMACIntegrity(t *testing.T) {
+	share := bytes.Repeat([]byte{9}, 32)
+	tests := []struct {
+		name         string
+		keyShare     []byte
+		ciphers      []string
+		passwordless bool
+		wantHMAC     bool
+	}{
+		{"key share without cipher", share, nil, false, true},
+		{"key share with cipher", share, supportedCiphers, false, false},
+		{"no key share", nil, nil, false, false},
+		{"passwordless", share, nil, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientHello := hello{Checksums: supportedChecksums, Ciphers: tt.ciphers, KeyShare: tt.keyShare}
+			f, err := negotiateFeatures(clientHello, 9, tt.passwordless)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := slices.Contains(f.checksums, protocol.ChecksumHMACSHA256); got != tt.wantHMAC {
+				t.Fatalf("checksums = %v, want HMAC %v", f.checksums, tt.wantHMAC)
+			}
+			if f.keyed() != (tt.wantHMAC || f.secure()) {
+				t.Fatalf("keyed = %v with checksums %v and ciphers %v", f.keyed(), f.checksums, f.ciphers)
+			}
+		})
+	}
+}
+
+func hmacHandshake(secret byte) handshake {
+	return handshake{
+		version:      9,
+		features:     features{checksums: []string{protocol.ChecksumHMACSHA256}, maxFrameSize: defaultMaxFrameSize},
+		clientHello:  []byte("GSPH client hello"),
+		serverHello:  []byte("GSPH server hello"),
+		sharedSecret: bytes.Repeat([]byte{secret}, 32),
+	}
+}
+
+// peerCodec returns a codec that decodes what c encodes, as the client's
+// would.
+func peerCodec(t *testing.T, hs handshake, passwordHash string) *frameCodec {
+	t.Helper()
+	c, err := newFrameCodec(hs, passwordHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.integrity.SendKey, c.integrity.RecvKey = c.integrity.RecvKey, c.integrity.SendKey
+	return c
+}
+
+func TestHMACKeysDeriveFromSharedSecret(t *testing.T) {
+	const passwordHash = "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"
+	server, err := newFrameCodec(hmacHandshake(7), passwordHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := []byte{0x01, 0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}
+
+	decode := func(c *frameCodec) error {
+		envelope, err := server.encode(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = c.decode(bufio.NewReader(bytes.NewReader(envelope)))
+		return err
+	}
+	if err := decode(peerCodec(t, hmacHandshake(7), passwordHash)); err != nil {
+		t.Fatalf("peer with the same shared secret: %v", err)
+	}
+
+	// The password hash and everything in the hellos are not enough
+	var integrityErr *protocol.IntegrityError
+	if err := decode(peerCodec(t, hmacHandshake(8), passwordHash)); !errors.As(err, &integrityErr) {
+		t.Fatalf("peer with another shared secret: error %v, want integrity failure", err)
+	}
+
+	// Each direction has its own key, so a frame cannot be reflected
+	reflected, err := newFrameCodec(hmacHandshake(7), passwordHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decode(reflected); !errors.As(err, &integrityErr) {
+		t.Fatalf("reflected frame: error %v, want integrity failure", err)
+	}
+}
@@ -2,12 +2,19 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"math"
 	"net"
+	"os"
 	"strings"
+	"time"
 )
 
 var (
@@ -28,33 +35,213 @@ func validateChecksum(data []byte) bool {
 	return receivedChecksum == calculatedChecksum
 }
 
+// validateFrameChecksum validates a received frame, counting failures by
+// the frame's type.
+func validateFrameChecksum(frame []byte) bool {
+	if validateChecksum(frame) {
+		return true
+	}
+	if len(frame) > 0 {
+		checksumFailures.with(frameTypeLabel(frame[0])).inc()
+	}
+	return false
+}
+
 func authenticate(username, passwordHash string) bool {
-	return username == storedUsername && passwordHash == storedPasswordHash
+	stored, ok := passwordHashFor(username)
+	return ok && passwordHash == stored
+}
+
+func userExists(username string) bool {
+	_, ok := passwordHashFor(username)
+	return ok
+}
+
+// readLengthPrefixed reads a uint32 length, at most the maximum frame size,
+// followed by that many bytes. The length bytes are returned too so the
+// caller can rebuild the message for checksum validation.
+func readLengthPrefixed(reader *bufio.Reader) ([]byte, []byte, error) {
+	lengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, lengthBuf); err != nil {
+		return nil, nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBuf)
+	if length > cfg.Limits.MaxFrameSize {
+		return nil, nil, fmt.Errorf("%w: length %d exceeds the maximum frame size %d", errFrameRejected, length, cfg.Limits.MaxFrameSize)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, nil, err
+	}
+	return lengthBuf, data, nil
+}
+
+// Replies to the messages the server takes. A command's reply may be
+// followed by its output after ": ".
+const (
+	replyTextReceived    = "Text message received successfully"
+	replyCommandReceived = "Command message received successfully"
+	replyDataReceived    = "Data packet received successfully"
+)
+
+// checkDataField2 refuses the NaN and infinite values that would poison
+// every aggregate over the packets they are stored with.
+func checkDataField2(value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return errors.New("data field 2 must be a finite number")
+	}
+	return nil
+}
+
+// textResponse is the response to a valid text message.
+func textResponse(text string) string {
+	fmt.Println("Received valid text message:", text)
+	return replyTextReceived
+}
+
+// dataResponse stores and publishes a valid data packet from username and
+// returns the response.
+func dataResponse(username string, dataField1 uint32, dataField2 float64, dataField3 string) string {
+	if err := checkDataField2(dataField2); err != nil {
+		fmt.Println("Received invalid data packet:", err)
+		return "Invalid data packet: " + err.Error()
+	}
+	fmt.Printf("Received valid data packet: Data Field 1: %d, Data Field 2: %f, Data Field 3: %s\n", dataField1, dataField2, dataField3)
+	storeDataPacket(username, dataField1, dataField2, dataField3)
+	topicBroker.publish(topicForDataField1(dataField1), dataField1, dataField2, dataField3)
+	return replyDataReceived
+}
+
+// sendResponse writes a status response frame to the session.
+func sendResponse(s *session, text string) {
+	textBytes := []byte(text)
+
+	buf := make([]byte, 1+4+len(textBytes))
+	buf[0] = 0x05
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(textBytes)))
+	copy(buf[5:], textBytes)
+
+	s.write(buf)
 }
 
-func handleConnection(conn net.Conn) {
+// buildDirectMessage builds the frame delivered to the recipient of a
+// direct message. It carries the sender instead of the recipient.
+func buildDirectMessage(sender string, text string) []byte {
+	senderBytes := []byte(sender)
+	textBytes := []byte(text)
+
+	buf := make([]byte, 1+4+len(senderBytes)+4+len(textBytes))
+	buf[0] = 0x04
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(senderBytes)))
+	copy(buf[5:], senderBytes)
+	binary.BigEndian.PutUint32(buf[5+len(senderBytes):], uint32(len(textBytes)))
+	copy(buf[9+len(senderBytes):], textBytes)
+	return buf
+}
+
+// handleConnection serves one connection accepted on the listener l.
+func handleConnection(conn net.Conn, l listenerConfig) {
 	defer conn.Close()
-	reader := bufio.NewReader(conn)
+	connectionsOpened.with(l.network()).inc()
+	connectionsActive.add(1)
+	defer connectionsActive.add(-1)
+
+	// The hello and authentication must finish in time
+	conn.SetDeadline(time.Now().Add(cfg.Timeouts.Handshake.Duration))
 
-	// Simple Authentication
-	fmt.Println("Waiting for username...")
-	username, _ := reader.ReadString('\n')
-	fmt.Println("Waiting for password hash...")
-	passwordHash, _ := reader.ReadString('\n')
+	var peerUser string
+	if l.Auth == authPeerCredentials {
+		var err error
+		peerUser, err = peerUsername(conn, l)
+		if err != nil {
+			fmt.Println("Peer credential authentication failed:", err)
+			authentications.with("failure").inc()
+			return
+		}
+	}
+	conn = &meteredConn{Conn: conn}
+	reader := &frameReader{Reader: bufio.NewReader(conn)}
 
-	username = strings.TrimSpace(username)
-	passwordHash = strings.TrimSpace(passwordHash)
+	// Protocol version negotiation
+	hs, err := negotiateProtocol(conn, reader.Reader, peerUser)
+	if err != nil {
+		fmt.Println("Protocol negotiation failed:", err)
+		return
+	}
+	fmt.Println("Using protocol version", hs.version)
+
+	var username, passwordHash string
+	if hs.authenticatedAs == "" {
+		// Simple Authentication
+		fmt.Println("Waiting for username...")
+		username, _ = reader.ReadString('\n')
+		fmt.Println("Waiting for password hash...")
+		passwordHash, _ = reader.ReadString('\n')
+
+		username = strings.TrimSpace(username)
+		passwordHash = strings.TrimSpace(passwordHash)
+	}
 
-	if !authenticate(username, passwordHash) {
+	authenticated := false
+	if hs.authenticatedAs != "" {
+		// Identified by peer credentials in the hello
+		username = hs.authenticatedAs
+		passwordHash, authenticated = passwordHashFor(username)
+	} else if peerUser != "" {
+		// A version 7 client on a peer credential listener
+		authenticated = username == peerUser
+		passwordHash, _ = passwordHashFor(username)
+	} else if hs.features.keyed() {
+		// The client sent a proof instead of the password hash
+		authenticated = authenticateProof(username, passwordHash, hs)
+		passwordHash, _ = passwordHashFor(username)
+	} else {
+		authenticated = authenticate(username, passwordHash)
+	}
+	if !authenticated {
 		fmt.Println("Authentication failed for", username)
+		authentications.with("failure").inc()
 		conn.Write([]byte("Authentication failed\n"))
 		return
 	}
 
 	fmt.Println("Authentication successful for", username)
+	authentications.with("success").inc()
 	conn.Write([]byte("Authentication successful\n"))
+	conn.SetDeadline(time.Time{})
+
+	sess := &session{username: username, conn: conn, version: hs.version, features: hs.features}
+	if hs.version >= 8 {
+		// Frames travel in envelopes from here on
+		codec, err := newFrameCodec(hs, passwordHash)
+		if err != nil {
+			fmt.Println("Error setting up frame codec:", err)
+			return
+		}
+		sess.conn = &envelopeConn{Conn: conn, codec: codec}
+		envelopes := &envelopeReader{
+			codec:  codec,
+			reader: reader.Reader,
+			onInvalid: func(err error) {
+				reportDroppedFrame(sess, err)
+			},
+		}
+		if hs.features.acknowledgements {
+			envelopes.onAccepted = func(seq uint64) {
+				acknowledge(sess, seq, true)
+			}
+		}
+		reader = &frameReader{Reader: bufio.NewReader(envelopes), envelopes: envelopes}
+	}
+	registerSession(sess)
+	defer unregisterSession(sess)
+	defer topicBroker.unsubscribeAll(sess)
 
 	for {
+		if cfg.Timeouts.Idle.Duration > 0 {
+			conn.SetReadDeadline(time.Now().Add(cfg.Timeouts.Idle.Duration))
+		}
+
 		// Read message type
 		messageType, err := reader.ReadByte()
 		if err != nil {
@@ -62,15 +249,27 @@ func handleConnection(conn net.Conn) {
 				fmt.Println("Connection closed by client")
 				return
 			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				fmt.Println("Closing idle connection of", username)
+				return
+			}
+			if errors.Is(err, errFrameRejected) {
+				sendResponse(sess, err.Error())
+			}
 			fmt.Println("Error reading message type:", err)
 			return
 		}
+		frameType := frameTypeLabel(messageType)
+		framesReceived.with(frameType).inc()
+		// Each case starts the clock once it has read its whole frame, so
+		// time spent waiting on a slow client is not counted
+		var started time.Time
 
 		switch messageType {
 		case 0x01:
 			// Read the text length
 			lengthBuf := make([]byte, 4)
-			_, err := reader.Read(lengthBuf)
+			_, err := io.ReadFull(reader, lengthBuf)
 			if err != nil {
 				fmt.Println("Error reading text length:", err)
 				return
@@ -78,28 +277,34 @@ func handleConnection(conn net.Conn) {
 			textLength := binary.BigEndian.Uint32(lengthBuf)
 
 			// Read the message including the checksum
-			message := make([]byte, textLength+4)
-			_, err = reader.Read(message)
+			if err := reader.checkLength(uint64(textLength) + 4); err != nil {
+				fmt.Println("Error reading message:", err)
+				return
+			}
+			message := make([]byte, int(textLength)+4)
+			_, err = io.ReadFull(reader, message)
 			if err != nil {
 				fmt.Println("Error reading message:", err)
 				return
 			}
 
-			// Debug print statement
-			fmt.Printf("Received message: %x, %s, %T\n", message, string(message[:textLength]), message[:textLength])
+			if cfg.Logging.Debug {
+				fmt.Printf("Received message: %x, %s, %T\n", message, string(message[:textLength]), message[:textLength])
+			}
 
-			if validateChecksum(message) {
-				fmt.Println("Received valid text message:", string(message[:textLength]))
-				conn.Write([]byte("Text message received successfully\n"))
+			started = time.Now()
+			// The checksum covers the type and length as well as the text
+			if validateFrameChecksum(append(append([]byte{messageType}, lengthBuf...), message...)) {
+				sendResponse(sess, textResponse(string(message[:textLength])))
 			} else {
 				fmt.Println("Received invalid text message checksum")
-				conn.Write([]byte("Invalid text message checksum\n"))
+				sendResponse(sess, "Invalid text message checksum")
 			}
 
 		case 0x02:
 			// Read the command length
 			commandLengthBuf := make([]byte, 4)
-			_, err := reader.Read(commandLengthBuf)
+			_, err := io.ReadFull(reader, commandLengthBuf)
 			if err != nil {
 				fmt.Println("Error reading command length:", err)
 				return
@@ -107,8 +312,12 @@ func handleConnection(conn net.Conn) {
 			commandLength := binary.BigEndian.Uint32(commandLengthBuf)
 
 			// Read the command
+			if err := reader.checkLength(uint64(commandLength)); err != nil {
+				fmt.Println("Error reading command:", err)
+				return
+			}
 			command := make([]byte, commandLength)
-			_, err = reader.Read(command)
+			_, err = io.ReadFull(reader, command)
 			if err != nil {
 				fmt.Println("Error reading command:", err)
 				return
@@ -116,7 +325,7 @@ func handleConnection(conn net.Conn) {
 
 			// Read the parameter length
 			parameterLengthBuf := make([]byte, 4)
-			_, err = reader.Read(parameterLengthBuf)
+			_, err = io.ReadFull(reader, parameterLengthBuf)
 			if err != nil {
 				fmt.Println("Error reading parameter length:", err)
 				return
@@ -124,8 +333,12 @@ func handleConnection(conn net.Conn) {
 			parameterLength := binary.BigEndian.Uint32(parameterLengthBuf)
 
 			// Read the parameter
+			if err := reader.checkLength(uint64(parameterLength)); err != nil {
+				fmt.Println("Error reading parameter:", err)
+				return
+			}
 			parameter := make([]byte, parameterLength)
-			_, err = reader.Read(parameter)
+			_, err = io.ReadFull(reader, parameter)
 			if err != nil {
 				fmt.Println("Error reading parameter:", err)
 				return
@@ -133,7 +346,7 @@ func handleConnection(conn net.Conn) {
 
 			// Read the checksum
 			checksumBuf := make([]byte, 4)
-			_, err = reader.Read(checksumBuf)
+			_, err = io.ReadFull(reader, checksumBuf)
 			if err != nil {
 				fmt.Println("Error reading checksum:", err)
 				return
@@ -141,21 +354,23 @@ func handleConnection(conn net.Conn) {
 			message := append(append(append(append([]byte{messageType}, commandLengthBuf...), command...), parameterLengthBuf...), parameter...)
 			messageWithChecksum := append(message, checksumBuf...)
 
-			// Debug print statement
-			fmt.Printf("Received message: %x, %s, %s, %T\n", messageWithChecksum, string(command), string(parameter), messageWithChecksum)
+			if cfg.Logging.Debug {
+				fmt.Printf("Received message: %x, %s, %s, %T\n", messageWithChecksum, string(command), string(parameter), messageWithChecksum)
+			}
 
-			if validateChecksum(messageWithChecksum) {
+			started = time.Now()
+			if validateFrameChecksum(messageWithChecksum) {
 				fmt.Printf("Received valid command message: Command: %s, Parameter: %s\n", string(command), string(parameter))
-				conn.Write([]byte("Command message received successfully\n"))
+				sendResponse(sess, commandResponse(sess, string(command), string(parameter)))
 			} else {
 				fmt.Println("Received invalid command message checksum")
-				conn.Write([]byte("Invalid command message checksum\n"))
+				sendResponse(sess, "Invalid command message checksum")
 			}
 
 		case 0x03:
 			// Read data field 1 (integer)
 			dataField1Buf := make([]byte, 4)
-			_, err := reader.Read(dataField1Buf)
+			_, err := io.ReadFull(reader, dataField1Buf)
 			if err != nil {
 				fmt.Println("Error reading data field 1:", err)
 				return
@@ -164,7 +379,7 @@ func handleConnection(conn net.Conn) {
 
 			// Read data field 2 (float)
 			dataField2Buf := make([]byte, 8)
-			_, err = reader.Read(dataField2Buf)
+			_, err = io.ReadFull(reader, dataField2Buf)
 			if err != nil {
 				fmt.Println("Error reading data field 2:", err)
 				return
@@ -173,7 +388,7 @@ func handleConnection(conn net.Conn) {
 
 			// Read data field 3 length
 			dataField3LengthBuf := make([]byte, 4)
-			_, err = reader.Read(dataField3LengthBuf)
+			_, err = io.ReadFull(reader, dataField3LengthBuf)
 			if err != nil {
 				fmt.Println("Error reading data field 3 length:", err)
 				return
@@ -181,8 +396,12 @@ func handleConnection(conn net.Conn) {
 			dataField3Length := binary.BigEndian.Uint32(dataField3LengthBuf)
 
 			// Read data field 3 (string)
+			if err := reader.checkLength(uint64(dataField3Length)); err != nil {
+				fmt.Println("Error reading data field 3:", err)
+				return
+			}
 			dataField3 := make([]byte, dataField3Length)
-			_, err = reader.Read(dataField3)
+			_, err = io.ReadFull(reader, dataField3)
 			if err != nil {
 				fmt.Println("Error reading data field 3:", err)
 				return
@@ -190,51 +409,605 @@ func handleConnection(conn net.Conn) {
 
 			// Read the checksum
 			checksumBuf := make([]byte, 4)
-			_, err = reader.Read(checksumBuf)
+			_, err = io.ReadFull(reader, checksumBuf)
 			if err != nil {
 				fmt.Println("Error reading checksum:", err)
 				return
 			}
 			message := append(append(append(append(append([]byte{messageType}, dataField1Buf...), dataField2Buf...), dataField3LengthBuf...), dataField3...), checksumBuf...)
 
-			// Debug print statement
-			fmt.Printf("Received message: %x, %d, %f, %s, %T\n", message, dataField1, dataField2, string(dataField3), message)
+			if cfg.Logging.Debug {
+				fmt.Printf("Received message: %x, %d, %f, %s, %T\n", message, dataField1, dataField2, string(dataField3), message)
+			}
 
-			if validateChecksum(message) {
-				fmt.Printf("Received valid data packet: Data Field 1: %d, Data Field 2: %f, Data Field 3: %s\n", dataField1, dataField2, string(dataField3))
-				conn.Write([]byte("Data packet received successfully\n"))
+			started = time.Now()
+			if validateFrameChecksum(message) {
+				sendResponse(sess, dataResponse(username, dataField1, dataField2, string(dataField3)))
 			} else {
 				fmt.Println("Received invalid data packet checksum")
-				conn.Write([]byte("Invalid data packet checksum\n"))
+				sendResponse(sess, "Invalid data packet checksum")
+			}
+
+		case 0x04:
+			// Read the recipient length
+			recipientLengthBuf := make([]byte, 4)
+			_, err := io.ReadFull(reader, recipientLengthBuf)
+			if err != nil {
+				fmt.Println("Error reading recipient length:", err)
+				return
+			}
+			recipientLength := binary.BigEndian.Uint32(recipientLengthBuf)
+
+			// Read the recipient
+			if err := reader.checkLength(uint64(recipientLength)); err != nil {
+				fmt.Println("Error reading recipient:", err)
+				return
+			}
+			recipient := make([]byte, recipientLength)
+			_, err = io.ReadFull(reader, recipient)
+			if err != nil {
+				fmt.Println("Error reading recipient:", err)
+				return
+			}
+
+			// Read the text length
+			textLengthBuf := make([]byte, 4)
+			_, err = io.ReadFull(reader, textLengthBuf)
+			if err != nil {
+				fmt.Println("Error reading text length:", err)
+				return
+			}
+			textLength := binary.BigEndian.Uint32(textLengthBuf)
+
+			// Read the text
+			if err := reader.checkLength(uint64(textLength)); err != nil {
+				fmt.Println("Error reading text:", err)
+				return
+			}
+			text := make([]byte, textLength)
+			_, err = io.ReadFull(reader, text)
+			if err != nil {
+				fmt.Println("Error reading text:", err)
+				return
+			}
+
+			// Read the checksum
+			checksumBuf := make([]byte, 4)
+			_, err = io.ReadFull(reader, checksumBuf)
+			if err != nil {
+				fmt.Println("Error reading checksum:", err)
+				return
+			}
+			message := append(append(append(append(append([]byte{messageType}, recipientLengthBuf...), recipient...), textLengthBuf...), text...), checksumBuf...)
+
+			started = time.Now()
+			if !validateFrameChecksum(message) {
+				fmt.Println("Received invalid direct message checksum")
+				sendResponse(sess, "Invalid direct message checksum")
+				break
+			}
+
+			fmt.Printf("Received valid direct message: From: %s, To: %s, Text: %s\n", username, string(recipient), string(text))
+			sendResponse(sess, deliverOrQueue(string(recipient), username, buildDirectMessage(username, string(text))))
+
+		case 0x06, 0x07:
+			// Subscribe (0x06) or unsubscribe (0x07)
+			topicLengthBuf, topic, err := reader.readLengthPrefixed()
+			if err != nil {
+				fmt.Println("Error reading topic:", err)
+				return
+			}
+
+			checksumBuf := make([]byte, 4)
+			_, err = io.ReadFull(reader, checksumBuf)
+			if err != nil {
+				fmt.Println("Error reading checksum:", err)
+				return
+			}
+			message := append(append(append([]byte{messageType}, topicLengthBuf...), topic...), checksumBuf...)
+
+			started = time.Now()
+			if !validateFrameChecksum(message) {
+				fmt.Println("Received invalid subscription checksum")
+				sendResponse(sess, "Invalid subscription checksum")
+				break
 			}
 
+			if messageType == 0x06 && !sess.features.streaming {
+				sendResponse(sess, "Subscriptions need streaming, which was not negotiated")
+			} else if messageType == 0x06 {
+				topicBroker.subscribe(sess, string(topic))
+				fmt.Printf("%s subscribed to topic %s\n", username, string(topic))
+				sendResponse(sess, "Subscribed to "+string(topic))
+			} else if topicBroker.unsubscribe(sess, string(topic)) {
+				fmt.Printf("%s unsubscribed from topic %s\n", username, string(topic))
+				sendResponse(sess, "Unsubscribed from "+string(topic))
+			} else {
+				sendResponse(sess, "Not subscribed to "+string(topic))
+			}
+
+		case 0x08:
+			// List subscriptions
+			checksumBuf := make([]byte, 4)
+			_, err := io.ReadFull(reader, checksumBuf)
+			if err != nil {
+				fmt.Println("Error reading checksum:", err)
+				return
+			}
+
+			started = time.Now()
+			if !validateFrameChecksum(append([]byte{messageType}, checksumBuf...)) {
+				fmt.Println("Received invalid subscription list checksum")
+				sendResponse(sess, "Invalid subscription list checksum")
+				break
+			}
+			sess.write(buildSubscriptionList(topicBroker.subscriptions(sess)))
+
+		case 0x17:
+			// List the commands the server runs
+			checksumBuf := make([]byte, 4)
+			_, err := io.ReadFull(reader, checksumBuf)
+			if err != nil {
+				fmt.Println("Error reading checksum:", err)
+				return
+			}
+
+			started = time.Now()
+			if !validateFrameChecksum(append([]byte{messageType}, checksumBuf...)) {
+				fmt.Println("Received invalid command list checksum")
+				sendResponse(sess, "Invalid command list checksum")
+				break
+			}
+			sess.write(buildCommandList(commandNames()))
+
+		case 0x09:
+			// Publish a data packet to an explicit topic
+			topicLengthBuf, topic, err := reader.readLengthPrefixed()
+			if err != nil {
+				fmt.Println("Error reading topic:", err)
+				return
+			}
+
+			dataFieldsBuf := make([]byte, 4+8)
+			_, err = io.ReadFull(reader, dataFieldsBuf)
+			if err != nil {
+				fmt.Println("Error reading data fields 1 and 2:", err)
+				return
+			}
+			dataField1 := binary.BigEndian.Uint32(dataFieldsBuf[:4])
+			dataField2 := math.Float64frombits(binary.BigEndian.Uint64(dataFieldsBuf[4:]))
+
+			dataField3LengthBuf, dataField3, err := reader.readLengthPrefixed()
+			if err != nil {
+				fmt.Println("Error reading data field 3:", err)
+				return
+			}
+
+			checksumBuf := make([]byte, 4)
+			_, err = io.ReadFull(reader, checksumBuf)
+			if err != nil {
+				fmt.Println("Error reading checksum:", err)
+				return
+			}
+			message := append(append(append(append(append(append([]byte{messageType}, topicLengthBuf...), topic...), dataFieldsBuf...), dataField3LengthBuf...), dataField3...), checksumBuf...)
+
+			started = time.Now()
+			if !validateFrameChecksum(message) {
+				fmt.Println("Received invalid publish checksum")
+				sendResponse(sess, "Invalid publish checksum")
+				break
+			}
+			if err := checkDataField2(dataField2); err != nil {
+				sendResponse(sess, "Invalid publish: "+err.Error())
+				break
+			}
+
+			fmt.Printf("Received valid publish: Topic: %s, Data Field 1: %d, Data Field 2: %f, Data Field 3: %s\n", string(topic), dataField1, dataField2, string(dataField3))
+			storeDataPacket(username, dataField1, dataField2, string(dataField3))
+			delivered := topicBroker.publish(string(topic), dataField1, dataField2, string(dataField3))
+			sendResponse(sess, fmt.Sprintf("Data packet published to %d subscribers", delivered))
+
+		case 0x14:
+			// Direct data packet
+			recipientLengthBuf, recipient, err := reader.readLengthPrefixed()
+			if err != nil {
+				fmt.Println("Error reading recipient:", err)
+				return
+			}
+
+			dataFieldsBuf := make([]byte, 4+8)
+			_, err = io.ReadFull(reader, dataFieldsBuf)
+			if err != nil {
+				fmt.Println("Error reading data fields 1 and 2:", err)
+				return
+			}
+			dataField1 := binary.BigEndian.Uint32(dataFieldsBuf[:4])
+			dataField2 := math.Float64frombits(binary.BigEndian.Uint64(dataFieldsBuf[4:]))
+
+			dataField3LengthBuf, dataField3, err := reader.readLengthPrefixed()
+			if err != nil {
+				fmt.Println("Error reading data field 3:", err)
+				return
+			}
+
+			checksumBuf := make([]byte, 4)
+			_, err = io.ReadFull(reader, checksumBuf)
+			if err != nil {
+				fmt.Println("Error reading checksum:", err)
+				return
+			}
+			message := append(append(append(append(append(append([]byte{messageType}, recipientLengthBuf...), recipient...), dataFieldsBuf...), dataField3LengthBuf...), dataField3...), checksumBuf...)
+
+			started = time.Now()
+			if !validateFrameChecksum(message) {
+				fmt.Println("Received invalid direct data packet checksum")
+				sendResponse(sess, "Invalid direct data packet checksum")
+				break
+			}
+			if err := checkDataField2(dataField2); err != nil {
+				sendResponse(sess, "Invalid direct data packet: "+err.Error())
+				break
+			}
+
+			fmt.Printf("Received valid direct data packet: From: %s, To: %s, Data Field 1: %d, Data Field 2: %f, Data Field 3: %s\n", username, string(recipient), dataField1, dataField2, string(dataField3))
+			storeDataPacket(username, dataField1, dataField2, string(dataField3))
+			sendResponse(sess, deliverOrQueue(string(recipient), username, buildDirectDataPacket(username, dataField1, dataField2, string(dataField3))))
+
+		case 0x16:
+			// Inbox item delivered
+			message := make([]byte, 1+8+4)
+			message[0] = messageType
+			_, err := io.ReadFull(reader, message[1:])
+			if err != nil {
+				fmt.Println("Error reading inbox acknowledgement:", err)
+				return
+			}
+			started = time.Now()
+			if !validateFrameChecksum(message) {
+				fmt.Println("Received invalid inbox acknowledgement checksum")
+				sendResponse(sess, "Invalid inbox acknowledgement checksum")
+				break
+			}
+			itemID := binary.BigEndian.Uint64(message[1:])
+			removed, err := inboxes.remove(username, itemID)
+			if err != nil {
+				fmt.Println("Error removing inbox item:", err)
+			}
+			if removed {
+				fmt.Printf("Inbox item %d delivered to %s\n", itemID, username)
+			}
+
+		case 0x0A:
+			// Query stored data packets
+			query, message, err := readPacketQuery(reader)
+			if err != nil {
+				fmt.Println("Error reading query:", err)
+				return
+			}
+
+			checksumBuf := make([]byte, 4)
+			_, err = io.ReadFull(reader, checksumBuf)
+			if err != nil {
+				fmt.Println("Error reading checksum:", err)
+				return
+			}
+
+			started = time.Now()
+			if !validateFrameChecksum(append(message, checksumBuf...)) {
+				fmt.Println("Received invalid query checksum")
+				sendResponse(sess, "Invalid query checksum")
+				break
+			}
+
+			results, nextCursor, more, err := dataPackets.query(query)
+			if err != nil {
+				fmt.Println("Error running query:", err)
+				sendResponse(sess, "Query failed")
+				break
+			}
+			fmt.Printf("Query from %s returned %d data packets\n", username, len(results))
+			for _, packet := range results {
+				sess.write(buildDataPacket(packet.dataField1, packet.dataField2, packet.dataField3))
+			}
+			sess.write(buildEndOfResults(len(results), more, nextCursor))
+
+		case 0x0C:
+			// Aggregate stored data packets
+			request, message, err := readAggregationRequest(reader)
+			if err != nil {
+				fmt.Println("Error reading aggregation request:", err)
+				return
+			}
+
+			checksumBuf := make([]byte, 4)
+			_, err = io.ReadFull(reader, checksumBuf)
+			if err != nil {
+				fmt.Println("Error reading checksum:", err)
+				return
+			}
+
+			started = time.Now()
+			if !validateFrameChecksum(append(message, checksumBuf...)) {
+				fmt.Println("Received invalid aggregation checksum")
+				sendResponse(sess, "Invalid aggregation checksum")
+				break
+			}
+			if request.bucketWidth < 0 || math.IsNaN(request.percentile) || request.percentile < 0 || request.percentile > 100 {
+				sendResponse(sess, "Invalid aggregation request")
+				break
+			}
+
+			groups, err := dataPackets.aggregate(request)
+			if err != nil {
+				fmt.Println("Error running aggregation:", err)
+				sendResponse(sess, "Aggregation failed")
+				break
+			}
+			fmt.Printf("Aggregation from %s returned %d groups\n", username, len(groups))
+			sess.write(buildAggregationResult(request.percentile, groups))
+
+		case 0x0E:
+			// Register a schema
+			schema, raw, err := readSchema(reader)
+			if err != nil {
+				fmt.Println("Error reading schema:", err)
+				return
+			}
+
+			checksumBuf := make([]byte, 4)
+			_, err = io.ReadFull(reader, checksumBuf)
+			if err != nil {
+				fmt.Println("Error reading checksum:", err)
+				return
+			}
+
+			started = time.Now()
+			if !validateFrameChecksum(append(append([]byte{messageType}, raw...), checksumBuf...)) {
+				fmt.Println("Received invalid schema checksum")
+				sendResponse(sess, "Invalid schema checksum")
+				break
+			}
+
+			schema, err = schemas.register(schema)
+			if err != nil {
+				fmt.Println("Error registering schema:", err)
+				sendResponse(sess, "Schema rejected: "+err.Error())
+				break
+			}
+			fmt.Printf("%s registered schema %d (%s)\n", username, schema.ID, schema.Name)
+			sess.write(buildSchemaDefinition(schema))
+
+		case 0x0F:
+			// Look up a schema
+			schemaIDBuf := make([]byte, 4)
+			_, err := io.ReadFull(reader, schemaIDBuf)
+			if err != nil {
+				fmt.Println("Error reading schema ID:", err)
+				return
+			}
+
+			checksumBuf := make([]byte, 4)
+			_, err = io.ReadFull(reader, checksumBuf)
+			if err != nil {
+				fmt.Println("Error reading checksum:", err)
+				return
+			}
+
+			started = time.Now()
+			if !validateFrameChecksum(append(append([]byte{messageType}, schemaIDBuf...), checksumBuf...)) {
+				fmt.Println("Received invalid schema lookup checksum")
+				sendResponse(sess, "Invalid schema lookup checksum")
+				break
+			}
+
+			schemaID := binary.BigEndian.Uint32(schemaIDBuf)
+			schema, ok := schemas.lookup(schemaID)
+			if !ok {
+				sendResponse(sess, fmt.Sprintf("Unknown schema %d", schemaID))
+				break
+			}
+			sess.write(buildSchemaDefinition(schema))
+
+		case 0x11:
+			// Schema-based data packet
+			schemaIDBuf := make([]byte, 4)
+			_, err := io.ReadFull(reader, schemaIDBuf)
+			if err != nil {
+				fmt.Println("Error reading schema ID:", err)
+				return
+			}
+
+			bodyLengthBuf, body, err := reader.readLengthPrefixed()
+			if err != nil {
+				fmt.Println("Error reading schema data packet:", err)
+				return
+			}
+
+			checksumBuf := make([]byte, 4)
+			_, err = io.ReadFull(reader, checksumBuf)
+			if err != nil {
+				fmt.Println("Error reading checksum:", err)
+				return
+			}
+			message := append(append(append(append([]byte{messageType}, schemaIDBuf...), bodyLengthBuf...), body...), checksumBuf...)
+
+			started = time.Now()
+			if !validateFrameChecksum(message) {
+				fmt.Println("Received invalid schema data packet checksum")
+				sendResponse(sess, "Invalid schema data packet checksum")
+				break
+			}
+
+			schemaID := binary.BigEndian.Uint32(schemaIDBuf)
+			schema, ok := schemas.lookup(schemaID)
+			if !ok {
+				sendResponse(sess, fmt.Sprintf("Unknown schema %d", schemaID))
+				break
+			}
+			values, err := decodeSchemaPacket(schema, body)
+			if err == nil && schemaID == legacyDataPacketSchemaID {
+				err = checkDataField2(values[1].(float64))
+			}
+			if err != nil {
+				fmt.Printf("Received invalid schema data packet for schema %d: %v\n", schemaID, err)
+				sendResponse(sess, "Invalid schema data packet: "+err.Error())
+				break
+			}
+
+			fmt.Printf("Received valid schema data packet: Schema: %s, %s\n", schema.Name, formatSchemaPacket(schema, values))
+			if schemaID == legacyDataPacketSchemaID {
+				dataField1, dataField2, dataField3 := values[0].(uint32), values[1].(float64), values[2].(string)
+				storeDataPacket(username, dataField1, dataField2, dataField3)
+				topicBroker.publish(topicForDataField1(dataField1), dataField1, dataField2, dataField3)
+			}
+			sendResponse(sess, "Schema data packet received successfully")
+
 		default:
+			started = time.Now()
 			fmt.Println("Unknown message type:", messageType)
-			conn.Write([]byte("Unknown message type\n"))
+			unknownMessageTypes.with(frameType).inc()
+			sendResponse(sess, "Unknown message type")
 		}
+		handlerLatency.with(frameType).observe(time.Since(started).Seconds())
 	}
 }
 
-func main() {
-	// Start listening on port 8080
-	listener, err := net.Listen("tcp", "localhost:8080")
+// listen opens a configured listener.
+func listen(l listenerConfig) (net.Listener, error) {
+	switch l.network() {
+	case "unix":
+		// Remove the socket left behind by a previous run
+		if info, err := os.Lstat(l.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(l.Address)
+		}
+		return net.Listen("unix", l.Address)
+	case "udp":
+		return listenUDP(l.Address)
+	}
+	listener, err := net.Listen("tcp", l.Address)
 	if err != nil {
-		fmt.Println("Error listening:", err.Error())
-		return
+		return nil, err
 	}
-	defer listener.Close()
-	fmt.Println("Server is listening on port 8080...")
+	if l.TLS {
+		tlsConfig, err := cfg.tlsServerConfig()
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	if l.network() == "http" {
+		return serveHTTP(listener), nil
+	}
+	return listener, nil
+}
 
+// acceptConnections serves the connections arriving on listener until
+// accepting fails. slots, if not nil, holds one token per connection
+// being served; connections beyond its capacity are closed at once.
+func acceptConnections(listener net.Listener, l listenerConfig, slots chan struct{}) error {
 	for {
 		// Accept an incoming connection
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Error accepting:", err.Error())
-			return
+			return err
+		}
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				fmt.Println("Connection limit reached, closing connection from", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
 		}
 		fmt.Println("New connection established")
 
 		// Handle the connection
-		go handleConnection(conn)
+		go func() {
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			handleConnection(conn, l)
+		}()
+	}
+}
+
+func main() {
+	config, check, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if check {
+		if err != nil {
+			fmt.Println("Configuration is invalid:", err)
+			os.Exit(1)
+		}
+		out, _ := json.MarshalIndent(config, "", "  ")
+		fmt.Println(string(out))
+		fmt.Println("Configuration is valid")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading configuration:", err)
+		os.Exit(1)
+	}
+	cfg = config
+
+	if cfg.UserStore != "" {
+		store, err := loadUserStore(cfg.UserStore)
+		if err != nil {
+			fmt.Println("Error loading users:", err.Error())
+			return
+		}
+		users, tokens = store.Users, store.Tokens
+	}
+
+	// Open the data packet log, recovering from any torn final record
+	store, err := openPacketStore(cfg.DataDir, cfg.RepairStore)
+	if err != nil {
+		fmt.Println("Error opening data packet store:", err.Error())
+		return
+	}
+	defer store.close()
+	dataPackets = store
+
+	registry, err := openSchemaRegistry(cfg.DataDir)
+	if err != nil {
+		fmt.Println("Error opening schema registry:", err.Error())
+		return
+	}
+	schemas = registry
+
+	inboxStore, err := openInboxStore(cfg.DataDir, cfg.Timeouts.InboxRetention.Duration, cfg.Limits.InboxMaxItems)
+	if err != nil {
+		fmt.Println("Error opening inboxes:", err.Error())
+		return
+	}
+	inboxes = inboxStore
+
+	listeners := make([]net.Listener, 0, len(cfg.Listeners))
+	for _, l := range cfg.Listeners {
+		listener, err := listen(l)
+		if err != nil {
+			fmt.Println("Error listening:", err.Error())
+			return
+		}
+		defer listener.Close()
+		listeners = append(listeners, listener)
+		fmt.Printf("Server is listening on %s %s (%s)\n", l.network(), listener.Addr(), l.describe())
+	}
+
+	var slots chan struct{}
+	if cfg.Limits.MaxConnections > 0 {
+		slots = make(chan struct{}, cfg.Limits.MaxConnections)
+	}
+	failed := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		go func() {
+			failed <- acceptConnections(listener, cfg.Listeners[i], slots)
+		}()
 	}
+	err = <-failed
+	fmt.Println("Error accepting:", err.Error())
 }
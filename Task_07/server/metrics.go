@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics are served at /metrics on the HTTP listeners in the Prometheus
+// text exposition format (version 0.0.4).
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Upper bounds of the handler latency buckets, in seconds
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+type metric interface {
+	expose(w io.Writer)
+}
+
+// registry holds the metrics in the order they are exposed.
+var registry []metric
+
+func register[M metric](m M) M {
+	registry = append(registry, m)
+	return m
+}
+
+var (
+	connectionsOpened   = register(newCounterVec("task07_connections_opened_total", "Connections opened, by transport.", "transport"))
+	connectionsActive   = register(&gauge{name: "task07_connections_active", help: "Connections being served."})
+	authentications     = register(newCounterVec("task07_authentications_total", "Authentication attempts, by result.", "result"))
+	framesReceived      = register(newCounterVec("task07_frames_received_total", "Frames received, by message type.", "type"))
+	checksumFailures    = register(newCounterVec("task07_checksum_failures_total", "Frames that failed their checksum or integrity check, by message type.", "type"))
+	unknownMessageTypes = register(newCounterVec("task07_unknown_message_types_total", "Frames of unknown message types, by message type.", "type"))
+	bytesReceived       = register(&counter{name: "task07_received_bytes_total", help: "Bytes read from connections."})
+	bytesSent           = register(&counter{name: "task07_sent_bytes_total", help: "Bytes written to connections."})
+	handlerLatency      = register(newHistogramVec("task07_handler_duration_seconds", "Time spent handling a frame, by message type.", "type", latencyBuckets))
+)
+
+func frameTypeLabel(messageType byte) string {
+	return fmt.Sprintf("0x%02X", messageType)
+}
+
+type counter struct {
+	name, help string
+	value      atomic.Uint64
+}
+
+func (c *counter) add(n uint64) { c.value.Add(n) }
+
+func (c *counter) expose(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.value.Load())
+}
+
+type gauge struct {
+	name, help string
+	value      atomic.Int64
+}
+
+func (g *gauge) add(n int64) { g.value.Add(n) }
+
+func (g *gauge) expose(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.value.Load())
+}
+
+// counterVec is a counter for each value of one label.
+type counterVec struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	values map[string]*atomic.Uint64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]*atomic.Uint64)}
+}
+
+type labeledCounter struct{ value *atomic.Uint64 }
+
+func (c labeledCounter) inc() { c.value.Add(1) }
+
+func (v *counterVec) with(labelValue string) labeledCounter {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	value, ok := v.values[labelValue]
+	if !ok {
+		value = new(atomic.Uint64)
+		v.values[labelValue] = value
+	}
+	return labeledCounter{value}
+}
+
+func (v *counterVec) expose(w io.Writer) {
+	writeHeader(w, v.name, v.help, "counter")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, labelValue := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s{%s} %d\n", v.name, formatLabel(v.label, labelValue), v.values[labelValue].Load())
+	}
+}
+
+// histogramVec is a histogram for each value of one label.
+type histogramVec struct {
+	name, help, label string
+	buckets           []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+type labeledHistogram struct {
+	vec        *histogramVec
+	labelValue string
+}
+
+func (v *histogramVec) with(labelValue string) labeledHistogram {
+	return labeledHistogram{v, labelValue}
+}
+
+func (h labeledHistogram) observe(value float64) {
+	v := h.vec
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	hist, ok := v.values[h.labelValue]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(v.buckets)+1)}
+		v.values[h.labelValue] = hist
+	}
+	hist.counts[sort.SearchFloat64s(v.buckets, value)]++
+	hist.sum += value
+	hist.count++
+}
+
+func (v *histogramVec) expose(w io.Writer) {
+	writeHeader(w, v.name, v.help, "histogram")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, labelValue := range sortedKeys(v.values) {
+		hist := v.values[labelValue]
+		label := formatLabel(v.label, labelValue)
+		cumulative := uint64(0)
+		for i, count := range hist.counts {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(v.buckets) {
+				bound = v.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,%s} %d\n", v.name, label, formatLabel("le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", v.name, label, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", v.name, label, hist.count)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func formatLabel(name, value string) string {
+	return name + `="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	for _, m := range registry {
+		m.expose(w)
+	}
+}
+
+// meteredConn counts the bytes read from and written to a connection.
+type meteredConn struct {
+	net.Conn
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	bytesReceived.add(uint64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	bytesSent.add(uint64(n))
+	return n, err
+}
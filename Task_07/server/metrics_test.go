@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	frames := newCounterVec("test_frames_total", "Frames, by type.", "type")
+	frames.with("0x01").inc()
+	frames.with("0x01").inc()
+	frames.with(`a "quoted\" label` + "\n").inc()
+	active := &gauge{name: "test_active", help: "Help with a \\ and a\nnewline."}
+	active.add(3)
+	active.add(-1)
+	latency := newHistogramVec("test_seconds", "Latency.", "type", []float64{0.5, 1})
+	for _, value := range []float64{0.25, 0.5, 0.75, 2} {
+		latency.with("0x01").observe(value)
+	}
+
+	tests := []struct {
+		name   string
+		metric metric
+		want   string
+	}{
+		{"counter", frames, `# HELP test_frames_total Frames, by type.
+# TYPE test_frames_total counter
+test_frames_total{type="0x01"} 2
+test_frames_total{type="a \"quoted\\\" label\n"} 1
+`},
+		{"gauge", active, `# HELP test_active Help with a \\ and a\nnewline.
+# TYPE test_active gauge
+test_active 2
+`},
+		{"histogram", latency, `# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{type="0x01",le="0.5"} 2
+test_seconds_bucket{type="0x01",le="1"} 3
+test_seconds_bucket{type="0x01",le="+Inf"} 4
+test_seconds_sum{type="0x01"} 3.5
+test_seconds_count{type="0x01"} 4
+`},
+	}
+	for _, tt := range tests {
+		var got strings.Builder
+		tt.metric.expose(&got)
+		if got.String() != tt.want {
+			t.Errorf("%s exposed as\n%s\nwant\n%s", tt.name, got.String(), tt.want)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	connectionsOpened.with("tcp").inc()
+	handlerLatency.with("0x01").observe(0.001)
+
+	recorder := httptest.NewRecorder()
+	serveMetrics(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if got := recorder.Header().Get("Content-Type"); got != metricsContentType {
+		t.Fatalf("Content-Type %q, want %q", got, metricsContentType)
+	}
+
+	// Every sample follows the HELP and TYPE of its metric
+	header := regexp.MustCompile(`^# (HELP|TYPE) (\w+) (.*)$`)
+	sample := regexp.MustCompile(`^(\w+?)(_bucket|_sum|_count)?(\{\w+="(?:[^"\\]|\\.)*"(?:,\w+="(?:[^"\\]|\\.)*")*\})? (\S+)$`)
+	typed := make(map[string]string)
+	lines := bufio.NewScanner(recorder.Body)
+	for lines.Scan() {
+		line := lines.Text()
+		if m := header.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				typed[m[2]] = m[3]
+			}
+			continue
+		}
+		m := sample.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("malformed line %q", line)
+		}
+		name := m[1]
+		if _, ok := typed[name]; !ok {
+			name += m[2]
+		}
+		kind, ok := typed[name]
+		if !ok {
+			t.Fatalf("sample %q before the TYPE of its metric", line)
+		}
+		if m[2] != "" && kind != "histogram" {
+			t.Fatalf("%s sample %q on a %s", m[2], line, kind)
+		}
+	}
+	for _, m := range registry {
+		var name string
+		switch m := m.(type) {
+		case *counter:
+			name = m.name
+		case *gauge:
+			name = m.name
+		case *counterVec:
+			name = m.name
+		case *histogramVec:
+			name = m.name
+		}
+		if _, ok := typed[name]; !ok {
+			t.Errorf("registered metric %s not exposed", name)
+		}
+	}
+}
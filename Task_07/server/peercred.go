@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+)
+
+// A Unix socket listener with peer credential authentication identifies
+// the client by the uid of the process at the other end, which the kernel
+// reports, instead of asking for a password. The uid maps to a protocol
+// user through the listener's peer_users, or else through the name of the
+// system account, which must also be a protocol user.
+//
+// Clients that exchange hellos are told who they are in the server's hello
+// and send no credentials. Version 7 clients still send both lines; the
+// username must match and the password hash is not checked.
+
+// peerCredentials identify the process at the other end of a Unix socket.
+type peerCredentials struct {
+	pid int32
+	uid uint32
+	gid uint32
+}
+
+var errNoPeerCredentials = errors.New("peer credentials are only available on Unix sockets on Linux")
+
+// peerUsername returns the protocol user of the process at the other end
+// of conn.
+func peerUsername(conn net.Conn, l listenerConfig) (string, error) {
+	cred, err := readPeerCredentials(conn)
+	if err != nil {
+		return "", err
+	}
+	uid := strconv.FormatUint(uint64(cred.uid), 10)
+	username, ok := l.PeerUsers[uid]
+	if !ok {
+		account, err := user.LookupId(uid)
+		if err != nil {
+			return "", fmt.Errorf("uid %s: %w", uid, err)
+		}
+		username = account.Username
+	}
+	if !userExists(username) {
+		return "", fmt.Errorf("uid %s (pid %d) maps to unknown user %q", uid, cred.pid, username)
+	}
+	return username, nil
+}
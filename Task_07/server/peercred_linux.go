@@ -0,0 +1,31 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+func readPeerCredentials(conn net.Conn) (peerCredentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return peerCredentials{}, errNoPeerCredentials
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return peerCredentials{}, err
+	}
+	var ucred *syscall.Ucred
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return peerCredentials{}, err
+	}
+	if sockErr != nil {
+		return peerCredentials{}, sockErr
+	}
+	return peerCredentials{pid: ucred.Pid, uid: ucred.Uid, gid: ucred.Gid}, nil
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadPeerCredentials(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "peercred.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cred, err := readPeerCredentials(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(cred.pid) != os.Getpid() || int(cred.uid) != os.Getuid() || int(cred.gid) != os.Getgid() {
+		t.Fatalf("credentials %+v, want pid %d uid %d gid %d", cred, os.Getpid(), os.Getuid(), os.Getgid())
+	}
+
+	pipe, _ := net.Pipe()
+	if _, err := readPeerCredentials(pipe); !errors.Is(err, errNoPeerCredentials) {
+		t.Fatalf("pipe: error %v, want errNoPeerCredentials", err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+func readPeerCredentials(net.Conn) (peerCredentials, error) {
+	return peerCredentials{}, errNoPeerCredentials
+}
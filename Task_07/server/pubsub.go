@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// broker fans data packets out to the sessions subscribed to their topic.
+// Subscriptions belong to a session and end when it disconnects.
+type broker struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[*session]struct{}
+	topics      map[*session]map[string]struct{}
+}
+
+var topicBroker = newBroker()
+
+func newBroker() *broker {
+	return &broker{
+		subscribers: make(map[string]map[*session]struct{}),
+		topics:      make(map[*session]map[string]struct{}),
+	}
+}
+
+// topicForDataField1 derives the topic of a data packet published without
+// an explicit topic.
+func topicForDataField1(dataField1 uint32) string {
+	return fmt.Sprint(dataField1)
+}
+
+func (b *broker) subscribe(s *session, topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	topicSubscribers, ok := b.subscribers[topic]
+	if !ok {
+		topicSubscribers = make(map[*session]struct{})
+		b.subscribers[topic] = topicSubscribers
+	}
+	topicSubscribers[s] = struct{}{}
+
+	sessionTopics, ok := b.topics[s]
+	if !ok {
+		sessionTopics = make(map[string]struct{})
+		b.topics[s] = sessionTopics
+	}
+	sessionTopics[topic] = struct{}{}
+}
+
+// unsubscribe cancels a subscription and reports whether it existed.
+func (b *broker) unsubscribe(s *session, topic string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.removeLocked(s, topic)
+}
+
+// unsubscribeAll cancels every subscription of a session.
+func (b *broker) unsubscribeAll(s *session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for topic := range b.topics[s] {
+		b.removeLocked(s, topic)
+	}
+}
+
+func (b *broker) removeLocked(s *session, topic string) bool {
+	sessionTopics, ok := b.topics[s]
+	if !ok {
+		return false
+	}
+	if _, ok := sessionTopics[topic]; !ok {
+		return false
+	}
+	delete(sessionTopics, topic)
+	if len(sessionTopics) == 0 {
+		delete(b.topics, s)
+	}
+
+	topicSubscribers := b.subscribers[topic]
+	delete(topicSubscribers, s)
+	if len(topicSubscribers) == 0 {
+		delete(b.subscribers, topic)
+	}
+	return true
+}
+
+// subscriptions returns the topics a session is subscribed to, sorted.
+func (b *broker) subscriptions(s *session) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	result := make([]string, 0, len(b.topics[s]))
+	for topic := range b.topics[s] {
+		result = append(result, topic)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// publish writes a data packet to every subscriber of topic and reports how
+// many sessions received it.
+func (b *broker) publish(topic string, dataField1 uint32, dataField2 float64, dataField3 string) int {
+	b.mu.RLock()
+	targets := make([]*session, 0, len(b.subscribers[topic]))
+	for s := range b.subscribers[topic] {
+		targets = append(targets, s)
+	}
+	b.mu.RUnlock()
+
+	frame := buildDataPacket(dataField1, dataField2, dataField3)
+	delivered := 0
+	for _, s := range targets {
+		if err := s.write(frame); err != nil {
+			continue
+		}
+		delivered++
+	}
+	return delivered
+}
+
+// buildDataPacket builds a 0x03 data packet in the format the client decodes.
+func buildDataPacket(dataField1 uint32, dataField2 float64, dataField3 string) []byte {
+	dataField3Bytes := []byte(dataField3)
+
+	buf := make([]byte, 1+4+8+4+len(dataField3Bytes))
+	buf[0] = 0x03
+	binary.BigEndian.PutUint32(buf[1:], dataField1)
+	binary.BigEndian.PutUint64(buf[5:], math.Float64bits(dataField2))
+	binary.BigEndian.PutUint32(buf[13:], uint32(len(dataField3Bytes)))
+	copy(buf[17:], dataField3Bytes)
+	return buf
+}
+
+// buildSubscriptionList builds the 0x08 frame listing a session's topics.
+func buildSubscriptionList(topics []string) []byte {
+	buf := make([]byte, 1+4)
+	buf[0] = 0x08
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(topics)))
+	for _, topic := range topics {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(topic)))
+		buf = append(buf, topic...)
+	}
+	return buf
+}
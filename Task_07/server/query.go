@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	queryByDataField1 = 1 << iota
+	queryByTime
+	queryBySender
+	queryByDataField3
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// indexEntry locates a stored record and keeps the fields that queries can
+// select on without reading the record back.
+type indexEntry struct {
+	segment    uint64
+	offset     int64
+	receivedAt int64
+	sender     string
+	dataField1 uint32
+	dataField2 float64
+}
+
+// packetIndex is the in-memory index over the packet log. Entry ids are
+// positions in entries, which is append order, and double as query cursors.
+type packetIndex struct {
+	entries      []indexEntry
+	bySender     map[string][]int
+	byDataField1 []int // entry ids ordered by dataField1, then by id
+	byTime       []int // entry ids ordered by receive time, then by id
+}
+
+func newPacketIndex() *packetIndex {
+	return &packetIndex{bySender: make(map[string][]int)}
+}
+
+func (x *packetIndex) add(segment uint64, offset int64, packet storedPacket) {
+	id := len(x.entries)
+	x.entries = append(x.entries, indexEntry{
+		segment:    segment,
+		offset:     offset,
+		receivedAt: packet.receivedAt.UnixNano(),
+		sender:     packet.sender,
+		dataField1: packet.dataField1,
+		dataField2: packet.dataField2,
+	})
+	x.bySender[packet.sender] = append(x.bySender[packet.sender], id)
+
+	// Ids only grow, so the new entry goes after every equal key.
+	x.byDataField1 = insertSorted(x.byDataField1, id, func(other int) bool {
+		return x.entries[other].dataField1 > packet.dataField1
+	})
+	// Receive times usually ascend, but concurrent appends and clock steps
+	// can deliver them out of order.
+	x.byTime = insertSorted(x.byTime, id, func(other int) bool {
+		return x.entries[other].receivedAt > x.entries[id].receivedAt
+	})
+}
+
+// insertSorted inserts id into ids before the first entry for which after
+// is true.
+func insertSorted(ids []int, id int, after func(other int) bool) []int {
+	pos := sort.Search(len(ids), func(i int) bool { return after(ids[i]) })
+	ids = append(ids, 0)
+	copy(ids[pos+1:], ids[pos:])
+	ids[pos] = id
+	return ids
+}
+
+// candidates returns the ids, in append order and starting at q.cursor, of
+// the entries that may match q. It narrows the search with whichever index
+// applies; the dataField3 substring is checked later against the record.
+func (x *packetIndex) candidates(q packetQuery) []int {
+	var ids []int
+	switch {
+	case q.flags&queryBySender != 0:
+		ids = x.bySender[q.sender]
+	case q.flags&queryByDataField1 != 0:
+		low := sort.Search(len(x.byDataField1), func(i int) bool {
+			return x.entries[x.byDataField1[i]].dataField1 >= q.dataField1Min
+		})
+		high := sort.Search(len(x.byDataField1), func(i int) bool {
+			return x.entries[x.byDataField1[i]].dataField1 > q.dataField1Max
+		})
+		if low < high {
+			ids = append([]int(nil), x.byDataField1[low:high]...)
+			sort.Ints(ids)
+		}
+	case q.flags&queryByTime != 0:
+		low := sort.Search(len(x.byTime), func(i int) bool { return x.entries[x.byTime[i]].receivedAt >= q.from })
+		high := sort.Search(len(x.byTime), func(i int) bool { return x.entries[x.byTime[i]].receivedAt >= q.to })
+		if low < high {
+			ids = append([]int(nil), x.byTime[low:high]...)
+			sort.Ints(ids)
+		}
+	default:
+		ids = make([]int, len(x.entries))
+		for id := range ids {
+			ids[id] = id
+		}
+	}
+
+	start := sort.SearchInts(ids, int(min(q.cursor, uint64(len(x.entries)))))
+	result := make([]int, 0, len(ids)-start)
+	for _, id := range ids[start:] {
+		if q.matchesEntry(x.entries[id]) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// packetQuery is a decoded 0x0A query request. Only the filters selected
+// by flags apply.
+type packetQuery struct {
+	flags         byte
+	dataField1Min uint32
+	dataField1Max uint32
+	from          int64 // inclusive, unix nanoseconds
+	to            int64 // exclusive, unix nanoseconds
+	sender        string
+	dataField3    string
+	limit         uint32
+	cursor        uint64
+}
+
+func (q packetQuery) matchesEntry(e indexEntry) bool {
+	if q.flags&queryByDataField1 != 0 && (e.dataField1 < q.dataField1Min || e.dataField1 > q.dataField1Max) {
+		return false
+	}
+	if q.flags&queryByTime != 0 && (e.receivedAt < q.from || e.receivedAt >= q.to) {
+		return false
+	}
+	if q.flags&queryBySender != 0 && e.sender != q.sender {
+		return false
+	}
+	return true
+}
+
+// readQueryFilters reads the filters shared by query and aggregation
+// requests:
+//
+//	[flags uint8][dataField1 min uint32][dataField1 max uint32]
+//	[from int64][to int64][sender length uint32][sender]
+//	[dataField3 substring length uint32][substring]
+//
+// The bytes read are appended to message for checksum validation.
+func readQueryFilters(reader *frameReader, message []byte) (packetQuery, []byte, error) {
+	var q packetQuery
+
+	fixed := make([]byte, 1+4+4+8+8)
+	if _, err := io.ReadFull(reader, fixed); err != nil {
+		return q, nil, err
+	}
+	message = append(message, fixed...)
+	q.flags = fixed[0]
+	q.dataField1Min = binary.BigEndian.Uint32(fixed[1:])
+	q.dataField1Max = binary.BigEndian.Uint32(fixed[5:])
+	q.from = int64(binary.BigEndian.Uint64(fixed[9:]))
+	q.to = int64(binary.BigEndian.Uint64(fixed[17:]))
+
+	senderLengthBuf, sender, err := reader.readLengthPrefixed()
+	if err != nil {
+		return q, nil, err
+	}
+	message = append(append(message, senderLengthBuf...), sender...)
+	q.sender = string(sender)
+
+	substringLengthBuf, substring, err := reader.readLengthPrefixed()
+	if err != nil {
+		return q, nil, err
+	}
+	message = append(append(message, substringLengthBuf...), substring...)
+	q.dataField3 = string(substring)
+	return q, message, nil
+}
+
+// readPacketQuery reads the body of a 0x0A query request, which is the
+// query filters followed by
+//
+//	[limit uint32][cursor uint64]
+//
+// The raw message, without the checksum, is returned for validation.
+func readPacketQuery(reader *frameReader) (packetQuery, []byte, error) {
+	q, message, err := readQueryFilters(reader, []byte{0x0A})
+	if err != nil {
+		return q, nil, err
+	}
+
+	paging := make([]byte, 4+8)
+	if _, err := io.ReadFull(reader, paging); err != nil {
+		return q, nil, err
+	}
+	message = append(message, paging...)
+	q.limit = binary.BigEndian.Uint32(paging)
+	q.cursor = binary.BigEndian.Uint64(paging[4:])
+
+	if q.limit == 0 {
+		q.limit = defaultQueryLimit
+	}
+	q.limit = min(q.limit, maxQueryLimit)
+	return q, message, nil
+}
+
+// query returns up to q.limit stored packets matching q, in the order they
+// were received, along with the cursor to resume from and whether more
+// results remain. Records are read back without holding the store's lock.
+func (s *packetStore) query(q packetQuery) ([]storedPacket, uint64, bool, error) {
+	view, ids := s.view(q)
+
+	var results []storedPacket
+	nextCursor := q.cursor
+	for _, id := range ids {
+		full := uint32(len(results)) == q.limit
+		if full && q.flags&queryByDataField3 == 0 {
+			// Every candidate matches without the substring filter
+			return results, nextCursor, true, nil
+		}
+		packet, err := view.read(id)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if q.flags&queryByDataField3 != 0 && !strings.Contains(packet.dataField3, q.dataField3) {
+			nextCursor = uint64(id) + 1
+			continue
+		}
+		if full {
+			// Another match remains for the next page
+			return results, nextCursor, true, nil
+		}
+		nextCursor = uint64(id) + 1
+		results = append(results, packet)
+	}
+	return results, uint64(len(view.entries)), false, nil
+}
+
+// buildEndOfResults builds the 0x0B frame that terminates a query result
+// stream:
+//
+//	[result count uint32][more uint8][next cursor uint64]
+func buildEndOfResults(count int, more bool, nextCursor uint64) []byte {
+	buf := make([]byte, 1+4+1+8)
+	buf[0] = 0x0B
+	binary.BigEndian.PutUint32(buf[1:], uint32(count))
+	if more {
+		buf[5] = 1
+	}
+	binary.BigEndian.PutUint64(buf[6:], nextCursor)
+	return buf
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openTestStore opens a store in a temporary directory holding packets.
+func openTestStore(t *testing.T, packets []storedPacket) *packetStore {
+	t.Helper()
+	store, err := openPacketStore(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.close() })
+	for _, packet := range packets {
+		if err := store.append(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func packetAt(nanos int64, dataField1 uint32, dataField3 string) storedPacket {
+	return storedPacket{receivedAt: time.Unix(0, nanos), sender: "user1", dataField1: dataField1, dataField2: float64(nanos), dataField3: dataField3}
+}
+
+func TestTimeQueryWithOutOfOrderTimes(t *testing.T) {
+	// Appended out of time order, as concurrent appends or a clock step
+	// can leave them
+	store := openTestStore(t, []storedPacket{
+		packetAt(30, 1, ""),
+		packetAt(10, 1, ""),
+		packetAt(20, 1, ""),
+		packetAt(50, 1, ""),
+		packetAt(40, 1, ""),
+	})
+
+	q := packetQuery{flags: queryByTime, from: 20, to: 50, limit: defaultQueryLimit}
+	if got, want := store.index.candidates(q), []int{0, 2, 4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("candidates = %v, want %v", got, want)
+	}
+	results, _, more, err := store.query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || more {
+		t.Fatalf("query returned %d results, more %v; want 3, false", len(results), more)
+	}
+}
+
+func TestQueryPagingWithDataField3Filter(t *testing.T) {
+	store := openTestStore(t, []storedPacket{
+		packetAt(1, 1, "match"),
+		packetAt(2, 1, "other"),
+		packetAt(3, 1, "match"),
+		packetAt(4, 1, "other"),
+		packetAt(5, 1, "other"),
+	})
+
+	// The last page must not promise more when nothing else matches
+	q := packetQuery{flags: queryByDataField3, dataField3: "match", limit: 2}
+	results, _, more, err := store.query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || more {
+		t.Fatalf("query returned %d results, more %v; want 2, false", len(results), more)
+	}
+
+	q.limit = 1
+	var pages [][]storedPacket
+	for {
+		results, cursor, more, err := store.query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, results)
+		if !more {
+			break
+		}
+		q.cursor = cursor
+	}
+	if len(pages) != 2 || len(pages[0]) != 1 || len(pages[1]) != 1 || pages[1][0].receivedAt.UnixNano() != 3 {
+		t.Fatalf("pages = %v, want one match on each of two pages", pages)
+	}
+}
+
+func TestQueryPagingWithoutFilters(t *testing.T) {
+	store := openTestStore(t, []storedPacket{packetAt(1, 1, ""), packetAt(2, 2, ""), packetAt(3, 3, "")})
+	q := packetQuery{flags: queryByDataField1, dataField1Min: 2, dataField1Max: 3, limit: 1}
+	results, cursor, more, err := store.query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].dataField1 != 2 || !more || cursor != 2 {
+		t.Fatalf("first page: %d results, cursor %d, more %v", len(results), cursor, more)
+	}
+	q.cursor = cursor
+	results, _, more, err = store.query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].dataField1 != 3 || more {
+		t.Fatalf("second page: %d results, more %v", len(results), more)
+	}
+}
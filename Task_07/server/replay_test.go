@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"../protocol"
+)
+
+func TestCodecRejectsReplayedEnvelope(t *testing.T) {
+	hs := handshake{version: 9, features: features{checksums: []string{protocol.ChecksumCRC32C}, maxFrameSize: defaultMaxFrameSize}}
+	sender, err := newFrameCodec(hs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := newFrameCodec(hs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := sender.encode([]byte{0x01, 0, 0, 0, 1, 'a'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sender.encode([]byte{0x01, 0, 0, 0, 1, 'b'})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(bytes.Join([][]byte{second, first, second}, nil)))
+	for i, want := range []string{"b", "a"} {
+		_, payload, err := receiver.decode(reader)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if string(payload[4:]) != want {
+			t.Fatalf("frame %d = %q, want %q", i, payload[4:], want)
+		}
+	}
+	_, _, err = receiver.decode(reader)
+	if !protocol.DroppedFrame(err) {
+		t.Fatalf("replayed frame: error %v, want it dropped", err)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Field types a schema can declare. A list declares its element type
+// separately; lists of lists are not supported.
+const (
+	fieldInt8 byte = iota + 1
+	fieldInt16
+	fieldInt32
+	fieldInt64
+	fieldUint8
+	fieldUint16
+	fieldUint32
+	fieldUint64
+	fieldFloat32
+	fieldFloat64
+	fieldBool
+	fieldString
+	fieldBytes
+	fieldTimestamp // int64 unix nanoseconds
+	fieldList
+)
+
+var fieldTypeNames = map[byte]string{
+	fieldInt8:      "int8",
+	fieldInt16:     "int16",
+	fieldInt32:     "int32",
+	fieldInt64:     "int64",
+	fieldUint8:     "uint8",
+	fieldUint16:    "uint16",
+	fieldUint32:    "uint32",
+	fieldUint64:    "uint64",
+	fieldFloat32:   "float32",
+	fieldFloat64:   "float64",
+	fieldBool:      "bool",
+	fieldString:    "string",
+	fieldBytes:     "bytes",
+	fieldTimestamp: "timestamp",
+	fieldList:      "list",
+}
+
+const (
+	// legacyDataPacketSchemaID describes the fixed 0x03 data packet layout.
+	legacyDataPacketSchemaID = 1
+	schemaFile               = "schemas.json"
+	maxSchemaFields          = 256
+)
+
+var errInvalidSchema = errors.New("invalid schema")
+
+type schemaField struct {
+	Name     string `json:"name"`
+	Type     byte   `json:"type"`
+	ElemType byte   `json:"elemType,omitempty"`
+}
+
+func (f schemaField) typeName() string {
+	if f.Type == fieldList {
+		return "list<" + fieldTypeNames[f.ElemType] + ">"
+	}
+	return fieldTypeNames[f.Type]
+}
+
+// dataSchema declares the named, typed fields of a schema-based data
+// packet. Field values are encoded in declaration order.
+type dataSchema struct {
+	ID     uint32        `json:"id"`
+	Name   string        `json:"name"`
+	Fields []schemaField `json:"fields"`
+}
+
+func (s dataSchema) validate() error {
+	if s.Name == "" || len(s.Fields) == 0 || len(s.Fields) > maxSchemaFields {
+		return errInvalidSchema
+	}
+	names := make(map[string]bool, len(s.Fields))
+	for _, f := range s.Fields {
+		if f.Name == "" || names[f.Name] {
+			return fmt.Errorf("%w: duplicate or empty field name %q", errInvalidSchema, f.Name)
+		}
+		names[f.Name] = true
+		if _, ok := fieldTypeNames[f.Type]; !ok {
+			return fmt.Errorf("%w: field %s has unknown type %d", errInvalidSchema, f.Name, f.Type)
+		}
+		if f.Type == fieldList {
+			if _, ok := fieldTypeNames[f.ElemType]; !ok || f.ElemType == fieldList {
+				return fmt.Errorf("%w: field %s has unsupported element type %d", errInvalidSchema, f.Name, f.ElemType)
+			}
+		}
+	}
+	return nil
+}
+
+// encodeSchema encodes a schema definition:
+//
+//	[id uint32][name length uint32][name][field count uint32]
+//	per field: [name length uint32][name][type uint8][element type uint8]
+func encodeSchema(s dataSchema) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, s.ID)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s.Name)))
+	buf = append(buf, s.Name...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s.Fields)))
+	for _, f := range s.Fields {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(f.Name)))
+		buf = append(buf, f.Name...)
+		buf = append(buf, f.Type, f.ElemType)
+	}
+	return buf
+}
+
+// readSchema reads a schema definition and returns it along with the raw
+// bytes read, for checksum validation.
+func readSchema(reader *frameReader) (dataSchema, []byte, error) {
+	var s dataSchema
+	idBuf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, idBuf); err != nil {
+		return s, nil, err
+	}
+	s.ID = binary.BigEndian.Uint32(idBuf)
+	raw := idBuf
+
+	nameLengthBuf, name, err := reader.readLengthPrefixed()
+	if err != nil {
+		return s, nil, err
+	}
+	raw = append(append(raw, nameLengthBuf...), name...)
+	s.Name = string(name)
+
+	countBuf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, countBuf); err != nil {
+		return s, nil, err
+	}
+	raw = append(raw, countBuf...)
+	count := binary.BigEndian.Uint32(countBuf)
+	if count > maxSchemaFields {
+		return s, nil, errInvalidSchema
+	}
+
+	for i := uint32(0); i < count; i++ {
+		fieldNameLengthBuf, fieldName, err := reader.readLengthPrefixed()
+		if err != nil {
+			return s, nil, err
+		}
+		typesBuf := make([]byte, 2)
+		if _, err := io.ReadFull(reader, typesBuf); err != nil {
+			return s, nil, err
+		}
+		raw = append(append(append(raw, fieldNameLengthBuf...), fieldName...), typesBuf...)
+		s.Fields = append(s.Fields, schemaField{Name: string(fieldName), Type: typesBuf[0], ElemType: typesBuf[1]})
+	}
+	return s, raw, nil
+}
+
+// schemaRegistry holds the registered schemas and persists them as JSON in
+// the store directory.
+type schemaRegistry struct {
+	mu      sync.RWMutex
+	path    string
+	schemas map[uint32]dataSchema
+	nextID  uint32
+}
+
+var schemas *schemaRegistry
+
+func openSchemaRegistry(dir string) (*schemaRegistry, error) {
+	r := &schemaRegistry{
+		path:    filepath.Join(dir, schemaFile),
+		schemas: make(map[uint32]dataSchema),
+		nextID:  legacyDataPacketSchemaID + 1,
+	}
+	r.schemas[legacyDataPacketSchemaID] = dataSchema{
+		ID:   legacyDataPacketSchemaID,
+		Name: "data_packet",
+		Fields: []schemaField{
+			{Name: "dataField1", Type: fieldUint32},
+			{Name: "dataField2", Type: fieldFloat64},
+			{Name: "dataField3", Type: fieldString},
+		},
+	}
+
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored []dataSchema
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", r.path, err)
+	}
+	for _, s := range stored {
+		r.schemas[s.ID] = s
+		r.nextID = max(r.nextID, s.ID+1)
+	}
+	return r, nil
+}
+
+// register assigns the next ID to s, stores it and returns it with its ID.
+func (r *schemaRegistry) register(s dataSchema) (dataSchema, error) {
+	if err := s.validate(); err != nil {
+		return s, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.ID = r.nextID
+	r.schemas[s.ID] = s
+
+	if err := r.saveLocked(); err != nil {
+		delete(r.schemas, s.ID)
+		return s, err
+	}
+	r.nextID++
+	return s, nil
+}
+
+func (r *schemaRegistry) lookup(id uint32) (dataSchema, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.schemas[id]
+	return s, ok
+}
+
+func (r *schemaRegistry) saveLocked() error {
+	stored := make([]dataSchema, 0, len(r.schemas))
+	for id, s := range r.schemas {
+		if id != legacyDataPacketSchemaID {
+			stored = append(stored, s)
+		}
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].ID < stored[j].ID })
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(r.path, data)
+}
+
+// decodeSchemaPacket decodes body by the fields of s. The body must hold
+// exactly one value per field.
+func decodeSchemaPacket(s dataSchema, body []byte) ([]any, error) {
+	values := make([]any, 0, len(s.Fields))
+	for _, f := range s.Fields {
+		var value any
+		var err error
+		if f.Type == fieldList {
+			value, body, err = decodeSchemaList(f.ElemType, body)
+		} else {
+			value, body, err = decodeSchemaValue(f.Type, body)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("field %s (%s): %w", f.Name, f.typeName(), err)
+		}
+		values = append(values, value)
+	}
+	if len(body) != 0 {
+		return nil, fmt.Errorf("%d unexpected trailing bytes", len(body))
+	}
+	return values, nil
+}
+
+func decodeSchemaList(elemType byte, body []byte) ([]any, []byte, error) {
+	if len(body) < 4 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	count := binary.BigEndian.Uint32(body)
+	body = body[4:]
+	// Every element takes at least one byte, which bounds the allocation.
+	if uint64(count) > uint64(len(body)) {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	list := make([]any, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var value any
+		var err error
+		value, body, err = decodeSchemaValue(elemType, body)
+		if err != nil {
+			return nil, nil, err
+		}
+		list = append(list, value)
+	}
+	return list, body, nil
+}
+
+func decodeSchemaValue(fieldType byte, body []byte) (any, []byte, error) {
+	need := func(n int) error {
+		if len(body) < n {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+
+	switch fieldType {
+	case fieldInt8, fieldUint8, fieldBool:
+		if err := need(1); err != nil {
+			return nil, nil, err
+		}
+		switch fieldType {
+		case fieldInt8:
+			return int8(body[0]), body[1:], nil
+		case fieldUint8:
+			return body[0], body[1:], nil
+		}
+		if body[0] > 1 {
+			return nil, nil, fmt.Errorf("invalid bool %d", body[0])
+		}
+		return body[0] == 1, body[1:], nil
+	case fieldInt16, fieldUint16:
+		if err := need(2); err != nil {
+			return nil, nil, err
+		}
+		v := binary.BigEndian.Uint16(body)
+		if fieldType == fieldInt16 {
+			return int16(v), body[2:], nil
+		}
+		return v, body[2:], nil
+	case fieldInt32, fieldUint32, fieldFloat32:
+		if err := need(4); err != nil {
+			return nil, nil, err
+		}
+		v := binary.BigEndian.Uint32(body)
+		switch fieldType {
+		case fieldInt32:
+			return int32(v), body[4:], nil
+		case fieldFloat32:
+			return math.Float32frombits(v), body[4:], nil
+		}
+		return v, body[4:], nil
+	case fieldInt64, fieldUint64, fieldFloat64, fieldTimestamp:
+		if err := need(8); err != nil {
+			return nil, nil, err
+		}
+		v := binary.BigEndian.Uint64(body)
+		switch fieldType {
+		case fieldInt64:
+			return int64(v), body[8:], nil
+		case fieldFloat64:
+			return math.Float64frombits(v), body[8:], nil
+		case fieldTimestamp:
+			return time.Unix(0, int64(v)).UTC(), body[8:], nil
+		}
+		return v, body[8:], nil
+	case fieldString, fieldBytes:
+		if err := need(4); err != nil {
+			return nil, nil, err
+		}
+		length := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		if uint64(length) > uint64(len(body)) {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		data := body[:length]
+		if fieldType == fieldBytes {
+			return append([]byte(nil), data...), body[length:], nil
+		}
+		if !utf8.Valid(data) {
+			return nil, nil, errors.New("string is not valid UTF-8")
+		}
+		return string(data), body[length:], nil
+	}
+	return nil, nil, fmt.Errorf("unknown field type %d", fieldType)
+}
+
+// formatSchemaPacket renders decoded values as "name: value" pairs.
+func formatSchemaPacket(s dataSchema, values []any) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprintf("%s: %v", s.Fields[i].Name, value)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// buildSchemaDefinition builds the 0x10 frame carrying a schema.
+func buildSchemaDefinition(s dataSchema) []byte {
+	return append([]byte{0x10}, encodeSchema(s)...)
+}
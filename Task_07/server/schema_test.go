@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	tooMany := make([]schemaField, maxSchemaFields+1)
+	tests := []struct {
+		name   string
+		schema dataSchema
+		valid  bool
+	}{
+		{"valid", dataSchema{Name: "s", Fields: []schemaField{{Name: "a", Type: fieldInt8}, {Name: "b", Type: fieldList, ElemType: fieldString}}}, true},
+		{"no name", dataSchema{Fields: []schemaField{{Name: "a", Type: fieldInt8}}}, false},
+		{"no fields", dataSchema{Name: "s"}, false},
+		{"too many fields", dataSchema{Name: "s", Fields: tooMany}, false},
+		{"empty field name", dataSchema{Name: "s", Fields: []schemaField{{Type: fieldInt8}}}, false},
+		{"duplicate field", dataSchema{Name: "s", Fields: []schemaField{{Name: "a", Type: fieldInt8}, {Name: "a", Type: fieldBool}}}, false},
+		{"unknown type", dataSchema{Name: "s", Fields: []schemaField{{Name: "a", Type: 0}}}, false},
+		{"type past the last", dataSchema{Name: "s", Fields: []schemaField{{Name: "a", Type: fieldList + 1}}}, false},
+		{"list of lists", dataSchema{Name: "s", Fields: []schemaField{{Name: "a", Type: fieldList, ElemType: fieldList}}}, false},
+		{"list without element type", dataSchema{Name: "s", Fields: []schemaField{{Name: "a", Type: fieldList}}}, false},
+	}
+	for _, tt := range tests {
+		err := tt.schema.validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: validate() = %v, want valid %v", tt.name, err, tt.valid)
+		}
+		if err != nil && !errors.Is(err, errInvalidSchema) {
+			t.Errorf("%s: %v is not errInvalidSchema", tt.name, err)
+		}
+	}
+}
+
+func TestSchemaEncodeReadRoundTrip(t *testing.T) {
+	in := dataSchema{ID: 42, Name: "weather", Fields: []schemaField{
+		{Name: "station", Type: fieldString},
+		{Name: "readings", Type: fieldList, ElemType: fieldFloat32},
+	}}
+	encoded := encodeSchema(in)
+	out, raw, err := readSchema(&frameReader{Reader: bufio.NewReader(bytes.NewReader(encoded))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) || !bytes.Equal(raw, encoded) {
+		t.Fatalf("readSchema = %+v with %x, want %+v with %x", out, raw, in, encoded)
+	}
+
+	// A field count past the limit is refused before the fields are read
+	tooMany := binary.BigEndian.AppendUint32(encodeSchema(dataSchema{ID: 1, Name: "s"})[:9], maxSchemaFields+1)
+	if _, _, err := readSchema(&frameReader{Reader: bufio.NewReader(bytes.NewReader(tooMany))}); !errors.Is(err, errInvalidSchema) {
+		t.Fatalf("readSchema with %d fields: %v", maxSchemaFields+1, err)
+	}
+	if _, _, err := readSchema(&frameReader{Reader: bufio.NewReader(bytes.NewReader(encoded[:len(encoded)-1]))}); err == nil {
+		t.Fatal("readSchema accepted a truncated definition")
+	}
+}
+
+func TestDecodeSchemaPacket(t *testing.T) {
+	u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+	u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	field := func(fieldType, elemType byte) dataSchema {
+		return dataSchema{Name: "s", Fields: []schemaField{{Name: "f", Type: fieldType, ElemType: elemType}}}
+	}
+
+	tests := []struct {
+		name   string
+		schema dataSchema
+		body   []byte
+		want   []any // nil when the body must be refused
+	}{
+		{"int8", field(fieldInt8, 0), []byte{0xff}, []any{int8(-1)}},
+		{"uint16", field(fieldUint16, 0), []byte{0x01, 0x02}, []any{uint16(0x0102)}},
+		{"int32", field(fieldInt32, 0), u32(math.MaxUint32), []any{int32(-1)}},
+		{"float32", field(fieldFloat32, 0), u32(math.Float32bits(2.5)), []any{float32(2.5)}},
+		{"int64", field(fieldInt64, 0), u64(math.MaxUint64), []any{int64(-1)}},
+		{"float64", field(fieldFloat64, 0), u64(math.Float64bits(-0.5)), []any{-0.5}},
+		{"timestamp", field(fieldTimestamp, 0), u64(1e9), []any{time.Unix(1, 0).UTC()}},
+		{"bool", field(fieldBool, 0), []byte{1}, []any{true}},
+		{"string", field(fieldString, 0), join(u32(2), []byte("hi")), []any{"hi"}},
+		{"bytes", field(fieldBytes, 0), join(u32(1), []byte{0}), []any{[]byte{0}}},
+		{"list", field(fieldList, fieldUint8), join(u32(2), []byte{3, 4}), []any{[]any{uint8(3), uint8(4)}}},
+		{"empty list", field(fieldList, fieldString), u32(0), []any{[]any{}}},
+		{"legacy layout", dataSchema{Name: "s", Fields: []schemaField{
+			{Name: "dataField1", Type: fieldUint32},
+			{Name: "dataField2", Type: fieldFloat64},
+			{Name: "dataField3", Type: fieldString},
+		}}, join(u32(7), u64(math.Float64bits(1.5)), u32(1), []byte("x")), []any{uint32(7), 1.5, "x"}},
+
+		{"short value", field(fieldUint64, 0), make([]byte, 7), nil},
+		{"trailing bytes", field(fieldUint8, 0), []byte{1, 2}, nil},
+		{"bad bool", field(fieldBool, 0), []byte{2}, nil},
+		{"string past the body", field(fieldString, 0), join(u32(3), []byte("hi")), nil},
+		{"invalid UTF-8", field(fieldString, 0), join(u32(1), []byte{0xff}), nil},
+		// The count alone must not size the allocation
+		{"list count past the body", field(fieldList, fieldUint8), join(u32(math.MaxUint32), []byte{1}), nil},
+		{"short list element", field(fieldList, fieldUint16), join(u32(1), []byte{1}), nil},
+		{"unknown type", field(0x7f, 0), []byte{1}, nil},
+	}
+	for _, tt := range tests {
+		got, err := decodeSchemaPacket(tt.schema, tt.body)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: decoded %v from an invalid body", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: decodeSchemaPacket = %#v, %v, want %#v", tt.name, got, err, tt.want)
+		}
+	}
+	if _, err := decodeSchemaPacket(field(fieldUint32, 0), []byte{1}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("short body: %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestSchemaRegistryPersists(t *testing.T) {
+	dir := t.TempDir()
+	r, err := openSchemaRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.register(dataSchema{Name: "bad"}); !errors.Is(err, errInvalidSchema) {
+		t.Fatalf("registered an invalid schema: %v", err)
+	}
+	s, err := r.register(dataSchema{Name: "s", Fields: []schemaField{{Name: "a", Type: fieldBool}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != legacyDataPacketSchemaID+1 {
+		t.Fatalf("first schema got ID %d, want %d", s.ID, legacyDataPacketSchemaID+1)
+	}
+
+	reopened, err := openSchemaRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reopened.lookup(s.ID); !ok || !reflect.DeepEqual(got, s) {
+		t.Fatalf("lookup after reopening = %+v, %v, want %+v", got, ok, s)
+	}
+	if _, ok := reopened.lookup(legacyDataPacketSchemaID); !ok {
+		t.Fatal("legacy schema missing after reopening")
+	}
+	next, err := reopened.register(dataSchema{Name: "t", Fields: []schemaField{{Name: "a", Type: fieldBool}}})
+	if err != nil || next.ID != s.ID+1 {
+		t.Fatalf("register after reopening = ID %d, %v, want %d", next.ID, err, s.ID+1)
+	}
+}
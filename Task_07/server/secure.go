@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"fmt"
+
+	"../protocol"
+)
+
+// Ciphers this server supports, in order of preference. How the channel
+// and the proof that stands in for the password hash work is described in
+// the protocol package.
+var supportedCiphers = []string{protocol.CipherAES256GCM, protocol.CipherChaCha20Poly1305}
+
+// exchangeKeys completes the server side of the key exchange against the
+// client's public key and returns the server's public key.
+func exchangeKeys(hs *handshake, clientShare []byte) ([]byte, error) {
+	peer, err := ecdh.X25519().NewPublicKey(clientShare)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key share: %w", err)
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hs.sharedSecret, err = private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key share: %w", err)
+	}
+	return private.PublicKey().Bytes(), nil
+}
+
+func (hs handshake) transcript() []byte {
+	return protocol.Transcript(hs.clientHello, hs.serverHello)
+}
+
+// authProof is the proof a client with passwordHash sends on hs.
+func authProof(passwordHash string, hs handshake) string {
+	return protocol.AuthProof(passwordHash, hs.sharedSecret, hs.transcript())
+}
+
+func authenticateProof(username, proof string, hs handshake) bool {
+	passwordHash, ok := passwordHashFor(username)
+	if !ok {
+		return false
+	}
+	return hmac.Equal([]byte(proof), []byte(authProof(passwordHash, hs)))
+}
+
+func (hs handshake) sessionKeys(purpose, passwordHash string) (clientKey, serverKey []byte, err error) {
+	return protocol.SessionKeys(purpose, passwordHash, hs.sharedSecret, hs.transcript())
+}
+
+func newSecureChannel(hs handshake, passwordHash string) (*protocol.SecureChannel, error) {
+	clientKey, serverKey, err := hs.sessionKeys("encryption", passwordHash)
+	if err != nil {
+		return nil, err
+	}
+	return protocol.NewSecureChannel(hs.features.ciphers[0], serverKey, clientKey)
+}
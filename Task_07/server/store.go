@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	storeDir          = "data"
+	segmentExtension  = ".log"
+	maxSegmentSize    = 16 * 1024 * 1024
+	recordHeaderSize  = 4 + 4 // payload length + CRC32 of the payload
+	maxRecordPayload  = 1 << 30
+	segmentNameDigits = 20
+)
+
+var (
+	errCorruptRecord = errors.New("corrupt record")
+	errTornRecord    = errors.New("torn record")
+)
+
+// corruptRecordError reports a corrupt record followed by more data, which
+// a crash while appending cannot leave behind.
+type corruptRecordError struct {
+	offset, size int64
+}
+
+func (e *corruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record at offset %d of %d bytes", e.offset, e.size)
+}
+
+func (e *corruptRecordError) Unwrap() error { return errCorruptRecord }
+
+// storedPacket is a data packet as persisted in the packet log.
+type storedPacket struct {
+	receivedAt time.Time
+	sender     string
+	dataField1 uint32
+	dataField2 float64
+	dataField3 string
+}
+
+func (p storedPacket) encode() []byte {
+	buf := make([]byte, 0, 8+4+len(p.sender)+4+8+4+len(p.dataField3))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(p.receivedAt.UnixNano()))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.sender)))
+	buf = append(buf, p.sender...)
+	buf = binary.BigEndian.AppendUint32(buf, p.dataField1)
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(p.dataField2))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.dataField3)))
+	buf = append(buf, p.dataField3...)
+	return buf
+}
+
+func decodeStoredPacket(buf []byte) (storedPacket, error) {
+	var p storedPacket
+	if len(buf) < 8+4 {
+		return p, errCorruptRecord
+	}
+	p.receivedAt = time.Unix(0, int64(binary.BigEndian.Uint64(buf)))
+	senderLength := int(binary.BigEndian.Uint32(buf[8:]))
+	buf = buf[12:]
+	if len(buf) < senderLength+4+8+4 {
+		return p, errCorruptRecord
+	}
+	p.sender = string(buf[:senderLength])
+	buf = buf[senderLength:]
+	p.dataField1 = binary.BigEndian.Uint32(buf)
+	p.dataField2 = math.Float64frombits(binary.BigEndian.Uint64(buf[4:]))
+	dataField3Length := int(binary.BigEndian.Uint32(buf[12:]))
+	buf = buf[16:]
+	if len(buf) != dataField3Length {
+		return p, errCorruptRecord
+	}
+	p.dataField3 = string(buf)
+	return p, nil
+}
+
+// packetStore is an append-only log of data packets split into numbered
+// segment files. Each record is framed as
+//
+//	[payload length uint32][CRC32 of payload uint32][payload]
+//
+// so that a record torn by a crash can be detected and truncated away when
+// the store is reopened. Any other damage stops the store from opening
+// unless it is opened for repair, which moves the damaged end of the
+// segment to a .damaged file beside it.
+type packetStore struct {
+	mu       sync.Mutex
+	dir      string
+	repair   bool
+	segments []uint64 // ids of the segment files, oldest first
+	files    map[uint64]*os.File
+	active   *os.File
+	size     int64
+	index    *packetIndex
+}
+
+var dataPackets *packetStore
+
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%0*d%s", segmentNameDigits, id, segmentExtension))
+}
+
+// openPacketStore opens the store in dir, creating it if needed, recovers
+// the final segment and indexes every stored record.
+func openPacketStore(dir string, repair bool) (*packetStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &packetStore{
+		dir:    dir,
+		repair: repair,
+		files:  make(map[uint64]*os.File),
+		index:  newPacketIndex(),
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExtension) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		store.segments = append(store.segments, id)
+	}
+	sort.Slice(store.segments, func(i, j int) bool { return store.segments[i] < store.segments[j] })
+
+	if len(store.segments) == 0 {
+		store.segments = append(store.segments, 0)
+	}
+	last := store.segments[len(store.segments)-1]
+	for _, id := range store.segments[:len(store.segments)-1] {
+		if err := store.load(id); err != nil {
+			store.close()
+			return nil, err
+		}
+	}
+	if err := store.recover(last); err != nil {
+		store.close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// load opens a sealed segment for reading and indexes its records.
+func (s *packetStore) load(id uint64) error {
+	file, err := os.Open(segmentPath(s.dir, id))
+	if err != nil {
+		return err
+	}
+	s.files[id] = file
+
+	// Sealed segments were synced in full, so a crash cannot have torn them
+	validSize, err := scanSegment(file, func(offset int64, packet storedPacket) bool {
+		s.index.add(id, offset, packet)
+		return true
+	})
+	if (errors.Is(err, errCorruptRecord) || errors.Is(err, errTornRecord)) && s.repair {
+		err = s.setAside(id, validSize, err)
+	}
+	if err != nil {
+		return segmentError(id, err)
+	}
+	return nil
+}
+
+func segmentError(id uint64, err error) error {
+	if errors.Is(err, errCorruptRecord) || errors.Is(err, errTornRecord) {
+		return fmt.Errorf("segment %d: %w (start with -repair-store to set the damaged records aside)", id, err)
+	}
+	return fmt.Errorf("segment %d: %w", id, err)
+}
+
+// setAside moves segment id from offset on, where damage was found, to a
+// file beside it, so that the segment opens cleanly from then on.
+func (s *packetStore) setAside(id uint64, offset int64, damage error) error {
+	path := segmentPath(s.dir, id)
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	damaged, err := os.OpenFile(path+".damaged", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(damaged, io.NewSectionReader(file, offset, info.Size()-offset))
+	if err == nil {
+		err = damaged.Sync()
+	}
+	if closeErr := damaged.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+	fmt.Printf("Segment %d: %v, moved %d bytes to %s\n", id, damage, info.Size()-offset, path+".damaged")
+	return file.Sync()
+}
+
+// recover opens segment id for appending after truncating a record torn at
+// its end, and indexes the records that remain. Corruption with data after
+// it is reported rather than truncated away, unless repairing.
+func (s *packetStore) recover(id uint64) error {
+	file, err := os.OpenFile(segmentPath(s.dir, id), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	validSize, err := scanSegment(file, func(offset int64, packet storedPacket) bool {
+		s.index.add(id, offset, packet)
+		return true
+	})
+	if errors.Is(err, errCorruptRecord) && s.repair {
+		err = s.setAside(id, validSize, err)
+	}
+	if err != nil && !errors.Is(err, errTornRecord) {
+		file.Close()
+		return segmentError(id, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if info.Size() != validSize {
+		fmt.Printf("Truncating segment %d from %d to %d bytes\n", id, info.Size(), validSize)
+		if err := file.Truncate(validSize); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if _, err := file.Seek(validSize, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	s.files[id] = file
+	s.active = file
+	s.size = validSize
+	return nil
+}
+
+// scanSegment calls fn with the offset and contents of every record in the
+// segment until fn returns false. It returns the size of the valid prefix of
+// the segment, and errTornRecord if it stopped at a record torn at the end
+// of the segment or a *corruptRecordError if it stopped at corruption with
+// more data after it.
+func scanSegment(file *os.File, fn func(offset int64, packet storedPacket) bool) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for offset < size {
+		if size-offset < recordHeaderSize {
+			return offset, errTornRecord
+		}
+		if _, err := file.ReadAt(header, offset); err != nil {
+			return offset, err
+		}
+
+		length := int64(binary.BigEndian.Uint32(header))
+		end := offset + recordHeaderSize + length
+		if length > maxRecordPayload {
+			return offset, damagedRecord(file, offset, size)
+		}
+		if end > size {
+			return offset, errTornRecord
+		}
+		payload := make([]byte, length)
+		if _, err := file.ReadAt(payload, offset+recordHeaderSize); err != nil {
+			return offset, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			if end == size {
+				return offset, errTornRecord
+			}
+			return offset, damagedRecord(file, offset, size)
+		}
+
+		packet, err := decodeStoredPacket(payload)
+		if err != nil {
+			return offset, damagedRecord(file, offset, size)
+		}
+		if !fn(offset, packet) {
+			return offset, nil
+		}
+		offset = end
+	}
+	return offset, nil
+}
+
+// damagedRecord classifies a bad record at offset: a tail of zeros, as a
+// crash can leave in blocks allocated but never written, is torn; anything
+// else is corruption.
+func damagedRecord(file *os.File, offset, size int64) error {
+	buf := make([]byte, 32*1024)
+	for at := offset; at < size; {
+		n, err := file.ReadAt(buf[:min(int64(len(buf)), size-at)], at)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return &corruptRecordError{offset: offset, size: size}
+			}
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		at += int64(n)
+	}
+	return errTornRecord
+}
+
+// append writes a record for packet and syncs it to disk, rolling over to a
+// new segment when the active one is full.
+func (s *packetStore) append(packet storedPacket) error {
+	payload := packet.encode()
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size > 0 && s.size+int64(len(record)) > maxSegmentSize {
+		if err := s.roll(); err != nil {
+			return err
+		}
+	}
+
+	offset := s.size
+	_, err := s.active.Write(record)
+	if err == nil {
+		err = s.active.Sync()
+	}
+	if err != nil {
+		// Drop whatever part of the record reached the file, so the next
+		// record follows the last good one
+		if truncErr := s.active.Truncate(offset); truncErr != nil {
+			return errors.Join(err, truncErr)
+		}
+		if _, seekErr := s.active.Seek(offset, io.SeekStart); seekErr != nil {
+			return errors.Join(err, seekErr)
+		}
+		return err
+	}
+	s.size += int64(len(record))
+	s.index.add(s.segments[len(s.segments)-1], offset, packet)
+	return nil
+}
+
+// roll syncs the active segment and starts the next one. The old segment
+// stays open for reading.
+func (s *packetStore) roll() error {
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+	next := s.segments[len(s.segments)-1] + 1
+	file, err := os.OpenFile(segmentPath(s.dir, next), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, next)
+	s.files[next] = file
+	s.active = file
+	s.size = 0
+	return nil
+}
+
+// read returns the record stored at offset in segment id.
+func (s *packetStore) read(id uint64, offset int64) (storedPacket, error) {
+	s.mu.Lock()
+	file, ok := s.files[id]
+	s.mu.Unlock()
+	if !ok {
+		return storedPacket{}, fmt.Errorf("unknown segment %d", id)
+	}
+	return readRecord(file, offset)
+}
+
+func readRecord(file *os.File, offset int64) (storedPacket, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return storedPacket{}, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := file.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return storedPacket{}, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return storedPacket{}, errCorruptRecord
+	}
+	return decodeStoredPacket(payload)
+}
+
+// storeView is a snapshot of the index and the segment files for reading
+// records back without holding the store's lock. Entries and segments are
+// only ever added, so a view stays valid while appends go on.
+type storeView struct {
+	entries []indexEntry
+	files   map[uint64]*os.File
+}
+
+// view returns a snapshot of the store and the candidate ids for q.
+func (s *packetStore) view(q packetQuery) (storeView, []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make(map[uint64]*os.File, len(s.files))
+	for id, file := range s.files {
+		files[id] = file
+	}
+	return storeView{entries: s.index.entries, files: files}, s.index.candidates(q)
+}
+
+func (v storeView) read(id int) (storedPacket, error) {
+	entry := v.entries[id]
+	file, ok := v.files[entry.segment]
+	if !ok {
+		return storedPacket{}, fmt.Errorf("unknown segment %d", entry.segment)
+	}
+	return readRecord(file, entry.offset)
+}
+
+func (s *packetStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for _, file := range s.files {
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// storeDataPacket persists a valid data packet received from sender.
+func storeDataPacket(sender string, dataField1 uint32, dataField2 float64, dataField3 string) {
+	err := dataPackets.append(storedPacket{
+		receivedAt: time.Now(),
+		sender:     sender,
+		dataField1: dataField1,
+		dataField2: dataField2,
+		dataField3: dataField3,
+	})
+	if err != nil {
+		fmt.Println("Error storing data packet:", err)
+	}
+}
+
+// replaceFile writes data to a temporary file beside path and renames it
+// over path, syncing the file before the rename and the directory after
+// it, so that a crash leaves either the old contents or the new ones.
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
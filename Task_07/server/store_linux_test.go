@@ -0,0 +1,55 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os/signal"
+	"syscall"
+	"testing"
+)
+
+func TestAppendRollsBackShortWrite(t *testing.T) {
+	dir, size := writeTestStore(t, 1)
+	store, err := openPacketStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	// Cap the file size a few bytes past the end, so the next record is
+	// written in part and then fails with EFBIG
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	signal.Ignore(syscall.SIGXFSZ)
+	defer signal.Reset(syscall.SIGXFSZ)
+	capped := limit
+	capped.Cur = uint64(size) + 5
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &capped); err != nil {
+		t.Fatal(err)
+	}
+	err = store.append(testPacket(1))
+	if restoreErr := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit); restoreErr != nil {
+		t.Fatal(restoreErr)
+	}
+	if !errors.Is(err, syscall.EFBIG) {
+		t.Fatalf("append with a capped file size: %v, want EFBIG", err)
+	}
+	if got := segmentSize(t, dir); got != size || store.size != size {
+		t.Fatalf("after a short write the segment is %d bytes and size %d, want %d", got, store.size, size)
+	}
+
+	if err := store.append(testPacket(2)); err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+	store, err = openPacketStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(store.index.entries); got != 2 {
+		t.Fatalf("indexed %d records, want 2", got)
+	}
+}
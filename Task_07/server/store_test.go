@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func testPacket(n uint32) storedPacket {
+	return storedPacket{
+		receivedAt: time.Unix(1700000000, int64(n)),
+		sender:     "user1",
+		dataField1: n,
+		dataField2: float64(n) / 2,
+		dataField3: "packet",
+	}
+}
+
+// writeTestStore appends count packets to a new store in a temporary
+// directory and returns the directory and the size of the segment.
+func writeTestStore(t *testing.T, count int) (string, int64) {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := openPacketStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		if err := store.append(testPacket(uint32(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := store.size
+	if err := store.close(); err != nil {
+		t.Fatal(err)
+	}
+	return dir, size
+}
+
+func segmentSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	info, err := os.Stat(segmentPath(dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func appendToSegment(t *testing.T, dir string, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(segmentPath(dir, 0), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPacketStoreReopen(t *testing.T) {
+	dir, _ := writeTestStore(t, 3)
+	store, err := openPacketStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	if got := len(store.index.entries); got != 3 {
+		t.Fatalf("indexed %d records, want 3", got)
+	}
+	e := store.index.entries[2]
+	packet, err := store.read(e.segment, e.offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.dataField1 != 2 || packet.sender != "user1" || !packet.receivedAt.Equal(testPacket(2).receivedAt) {
+		t.Fatalf("read back %+v", packet)
+	}
+}
+
+func TestRecoverTruncatesTornTail(t *testing.T) {
+	tails := map[string][]byte{
+		"partial header":  {0, 0, 0},
+		"partial payload": {0, 0, 0, 40, 1, 2, 3, 4, 5, 6},
+		"bad checksum":    {0, 0, 0, 2, 0xde, 0xad, 0xbe, 0xef, 1, 2},
+		"zero blocks":     make([]byte, 4096),
+	}
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			dir, size := writeTestStore(t, 2)
+			appendToSegment(t, dir, tail)
+
+			store, err := openPacketStore(dir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := segmentSize(t, dir); got != size {
+				t.Fatalf("segment is %d bytes after recovery, want %d", got, size)
+			}
+			if err := store.append(testPacket(2)); err != nil {
+				t.Fatal(err)
+			}
+			store.close()
+
+			store, err = openPacketStore(dir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.close()
+			if got := len(store.index.entries); got != 3 {
+				t.Fatalf("indexed %d records, want 3", got)
+			}
+		})
+	}
+}
+
+func TestRecoverReportsMidFileCorruption(t *testing.T) {
+	dir, size := writeTestStore(t, 3)
+
+	// Flip a byte in the payload of the first record
+	f, err := os.OpenFile(segmentPath(dir, 0), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	f.ReadAt(b, recordHeaderSize+2)
+	b[0] ^= 0xff
+	f.WriteAt(b, recordHeaderSize+2)
+	f.Close()
+
+	_, err = openPacketStore(dir, false)
+	var corrupt *corruptRecordError
+	if !errors.As(err, &corrupt) || corrupt.offset != 0 {
+		t.Fatalf("openPacketStore error = %v, want corruption at offset 0", err)
+	}
+	if got := segmentSize(t, dir); got != size {
+		t.Fatalf("segment was truncated to %d bytes, want %d kept", got, size)
+	}
+}
+
+// flipPayloadByte corrupts the first record of segment id.
+func flipPayloadByte(t *testing.T, dir string, id uint64) {
+	t.Helper()
+	f, err := os.OpenFile(segmentPath(dir, id), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	f.ReadAt(b, recordHeaderSize+2)
+	b[0] ^= 0xff
+	f.WriteAt(b, recordHeaderSize+2)
+}
+
+func TestDamagedSealedSegmentNeedsRepair(t *testing.T) {
+	dir, _ := writeTestStore(t, 2)
+	store, err := openPacketStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	err = store.roll()
+	store.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.append(testPacket(2)); err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+	flipPayloadByte(t, dir, 0)
+	size := segmentSize(t, dir)
+
+	if _, err := openPacketStore(dir, false); !errors.Is(err, errCorruptRecord) {
+		t.Fatalf("openPacketStore error = %v, want corruption", err)
+	}
+	if got := segmentSize(t, dir); got != size {
+		t.Fatalf("segment changed to %d bytes without repair, want %d", got, size)
+	}
+
+	store, err = openPacketStore(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+	damaged, err := os.ReadFile(segmentPath(dir, 0) + ".damaged")
+	if err != nil || int64(len(damaged)) != size {
+		t.Fatalf("set aside %d bytes (%v), want %d", len(damaged), err, size)
+	}
+
+	// Repaired once, the store opens without repair from then on
+	store, err = openPacketStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	if got := len(store.index.entries); got != 1 {
+		t.Fatalf("indexed %d records after repair, want 1", got)
+	}
+}
+
+func TestRepairSetsAsideMidFileCorruption(t *testing.T) {
+	dir, _ := writeTestStore(t, 3)
+	flipPayloadByte(t, dir, 0)
+
+	store, err := openPacketStore(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := segmentSize(t, dir); got != 0 {
+		t.Fatalf("segment is %d bytes after repair, want 0", got)
+	}
+	if err := store.append(testPacket(3)); err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+
+	store, err = openPacketStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	if got := len(store.index.entries); got != 1 {
+		t.Fatalf("indexed %d records, want 1", got)
+	}
+}
+
+func TestSegmentNamesParsedStrictly(t *testing.T) {
+	dir, _ := writeTestStore(t, 1)
+	for _, name := range []string{"7junk.log", "+8.log", "9.log.damaged", "-1.log"} {
+		if err := os.WriteFile(dir+"/"+name, []byte("not a segment"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := openPacketStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	if len(store.segments) != 1 || store.segments[0] != 0 {
+		t.Fatalf("segments %v, want only segment 0", store.segments)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseTOML reads the subset of TOML that configuration files need:
+// comments, [table] and [[array of tables]] headers one level deep, and
+// key = value pairs whose values are strings, integers, floats, booleans or
+// single-line arrays of those.
+func parseTOML(data []byte) (map[string]any, error) {
+	root := make(map[string]any)
+	current := root
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripTOMLComment(line))
+		if line == "" {
+			continue
+		}
+		lineErr := func(format string, args ...any) error {
+			return fmt.Errorf("line %d: %s", i+1, fmt.Sprintf(format, args...))
+		}
+
+		switch {
+		case strings.HasPrefix(line, "[["):
+			name, ok := strings.CutSuffix(strings.TrimPrefix(line, "[["), "]]")
+			if !ok {
+				return nil, lineErr("unterminated table header")
+			}
+			name = strings.TrimSpace(name)
+			tables, _ := root[name].([]any)
+			if _, exists := root[name]; exists && tables == nil {
+				return nil, lineErr("%s is not an array of tables", name)
+			}
+			current = make(map[string]any)
+			root[name] = append(tables, current)
+		case strings.HasPrefix(line, "["):
+			name, ok := strings.CutSuffix(strings.TrimPrefix(line, "["), "]")
+			if !ok {
+				return nil, lineErr("unterminated table header")
+			}
+			name = strings.TrimSpace(name)
+			if _, exists := root[name]; exists {
+				return nil, lineErr("table %s defined twice", name)
+			}
+			current = make(map[string]any)
+			root[name] = current
+		default:
+			key, text, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, lineErr("expected key = value")
+			}
+			key = strings.Trim(strings.TrimSpace(key), `"`)
+			if _, exists := current[key]; exists {
+				return nil, lineErr("key %s defined twice", key)
+			}
+			value, err := parseTOMLValue(strings.TrimSpace(text))
+			if err != nil {
+				return nil, lineErr("%s: %v", key, err)
+			}
+			current[key] = value
+		}
+	}
+	return root, nil
+}
+
+// stripTOMLComment removes a # comment that is not inside a string.
+func stripTOMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++ // skip the escaped character
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseTOMLValue(text string) (any, error) {
+	switch {
+	case text == "":
+		return nil, fmt.Errorf("missing value")
+	case text == "true" || text == "false":
+		return text == "true", nil
+	case strings.HasPrefix(text, `"`):
+		return strconv.Unquote(text)
+	case strings.HasPrefix(text, "'"):
+		literal, ok := strings.CutSuffix(text[1:], "'")
+		if !ok || strings.Contains(literal, "'") {
+			return nil, fmt.Errorf("bad literal string %s", text)
+		}
+		return literal, nil
+	case strings.HasPrefix(text, "["):
+		inner, ok := strings.CutSuffix(text[1:], "]")
+		if !ok {
+			return nil, fmt.Errorf("arrays must be on one line")
+		}
+		values := []any{}
+		for _, item := range splitTOMLArray(inner) {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			value, err := parseTOMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	number := strings.ReplaceAll(text, "_", "")
+	if n, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("cannot parse value %s", text)
+}
+
+// splitTOMLArray splits the inside of an array at commas outside strings.
+func splitTOMLArray(inner string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, inner[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, inner[start:])
+}
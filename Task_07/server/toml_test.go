@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]any // nil when the input must be refused
+	}{
+		{"empty", "", map[string]any{}},
+		{"scalars", `
+s = "a # not a comment" # a comment
+l = 'C:\path'
+i = 1_000
+h = 0x10
+f = 2.5
+b = true
+`, map[string]any{"s": "a # not a comment", "l": `C:\path`, "i": int64(1000), "h": int64(16), "f": 2.5, "b": true}},
+		{"escapes", `s = "tab\there \"quoted\""`, map[string]any{"s": "tab\there \"quoted\""}},
+		{"arrays", `a = ["x, y", 'z', 3, []]`, map[string]any{"a": []any{"x, y", "z", int64(3), []any{}}}},
+		{"tables", `
+debug = false
+[limits]
+max_frame_size = 2048
+[timeouts]
+idle = "1m"
+`, map[string]any{"debug": false, "limits": map[string]any{"max_frame_size": int64(2048)}, "timeouts": map[string]any{"idle": "1m"}}},
+		{"arrays of tables", `
+[[listeners]]
+address = "localhost:8080"
+[[listeners]]
+network = "udp"
+address = ":8080"
+`, map[string]any{"listeners": []any{
+			map[string]any{"address": "localhost:8080"},
+			map[string]any{"network": "udp", "address": ":8080"},
+		}}},
+		{"quoted key", `"user_store" = "users.json"`, map[string]any{"user_store": "users.json"}},
+
+		{"no value", "a =", nil},
+		{"no equals", "a", nil},
+		{"duplicate key", "a = 1\na = 2", nil},
+		{"duplicate table", "[t]\n[t]", nil},
+		{"table then array of tables", "[t]\n[[t]]", nil},
+		{"unterminated table", "[t", nil},
+		{"unterminated array of tables", "[[t]", nil},
+		{"multi-line array", "a = [1,\n2]", nil},
+		{"unterminated string", `s = "abc`, nil},
+		{"bad literal string", `s = 'a'b'`, nil},
+		{"bare word", "s = abc", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseTOML([]byte(tt.input))
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: parsed %v", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseTOML = %#v, %v, want %#v", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"../protocol"
+)
+
+// udpListener accepts UDP connections on one socket. It implements
+// net.Listener. A connection starts when a client echoes the cookie sent
+// for the first segment of a new connection ID; the segments and the
+// cookie exchange are described in protocol/udp.go.
+type udpListener struct {
+	socket net.PacketConn
+	accept chan *protocol.UDPConn
+	secret []byte
+
+	mu    sync.Mutex
+	conns map[uint32]*protocol.UDPConn
+}
+
+func listenUDP(address string) (net.Listener, error) {
+	socket, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &udpListener{socket: socket, accept: make(chan *protocol.UDPConn, 16), secret: make([]byte, 32), conns: make(map[uint32]*protocol.UDPConn)}
+	if _, err := rand.Read(l.secret); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	go l.receive()
+	return l, nil
+}
+
+// cookie is what a client at addr must echo to open connection id. A
+// cookie is accepted during the period it was issued in and the next.
+func (l *udpListener) cookie(id uint32, addr net.Addr, period int64) []byte {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write(binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint32(nil, id), uint64(period)))
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:protocol.UDPCookieSize]
+}
+
+func cookiePeriod(t time.Time) int64 {
+	return t.UnixNano() / int64(protocol.UDPCookieLifetime)
+}
+
+// validCookies returns the cookies a client at addr may echo for id now.
+func (l *udpListener) validCookies(id uint32, addr net.Addr) [][]byte {
+	period := cookiePeriod(time.Now())
+	return [][]byte{l.cookie(id, addr, period), l.cookie(id, addr, period-1)}
+}
+
+func (l *udpListener) validCookie(id uint32, addr net.Addr, cookie []byte) bool {
+	for _, valid := range l.validCookies(id, addr) {
+		if hmac.Equal(cookie, valid) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *udpListener) receive() {
+	defer close(l.accept)
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := l.socket.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		id, ok := protocol.UDPPacketID(buf[:n])
+		if !ok {
+			continue
+		}
+		l.mu.Lock()
+		c, known := l.conns[id]
+		l.mu.Unlock()
+		if known {
+			c.Receive(buf[:n], from)
+		} else {
+			l.handshake(id, buf[:n], from)
+		}
+	}
+}
+
+// handshake answers a packet for a connection ID with no connection: the
+// echo of a valid cookie opens the connection, and a first segment gets a
+// cookie. The client sends the first segment again keyed with the cookie
+// when its echo is lost.
+func (l *udpListener) handshake(id uint32, data []byte, from net.Addr) {
+	p, ok := protocol.DecodeUDPPacket(data, nil)
+	if ok && p.Kind == protocol.UDPCookieEcho {
+		if l.validCookie(id, from, p.Payload) {
+			l.open(id, p.Payload, from)
+		}
+		return
+	}
+	for _, key := range l.validCookies(id, from) {
+		if !ok {
+			p, ok = protocol.DecodeUDPPacket(data, key)
+		}
+	}
+	if ok && p.Kind == protocol.UDPData && p.Seq == 1 && len(p.Payload) >= protocol.UDPCookieSize {
+		cookie := l.cookie(id, from, cookiePeriod(time.Now()))
+		l.sendTo(protocol.EncodeUDPPacket(protocol.UDPPacket{Kind: protocol.UDPCookie, ID: id, Payload: cookie}, nil), from)
+	}
+}
+
+// open starts connection id keyed with cookie and hands it to Accept.
+func (l *udpListener) open(id uint32, cookie []byte, from net.Addr) {
+	forget := func() {
+		l.mu.Lock()
+		delete(l.conns, id)
+		l.mu.Unlock()
+	}
+	c := protocol.NewUDPConn(id, cookie, l.socket.LocalAddr(), from, l.sendTo, forget)
+	l.mu.Lock()
+	l.conns[id] = c
+	l.mu.Unlock()
+	select {
+	case l.accept <- c:
+	default:
+		// Nobody is accepting: let the client retry
+		c.Stop()
+	}
+}
+
+func (l *udpListener) sendTo(packet []byte, to net.Addr) error {
+	_, err := l.socket.WriteTo(packet, to)
+	return err
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	c, ok := <-l.accept
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return c, nil
+}
+
+func (l *udpListener) Close() error {
+	return l.socket.Close()
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.socket.LocalAddr()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"../protocol"
+)
+
+// dialTestUDP opens a connection to address the way the client does.
+func dialTestUDP(t *testing.T, address string, id uint32) net.Conn {
+	socket, err := net.Dial("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(packet []byte, _ net.Addr) error {
+		_, err := socket.Write(packet)
+		return err
+	}
+	c := protocol.NewUDPConn(id, nil, socket.LocalAddr(), socket.RemoteAddr(), send, func() { socket.Close() })
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := socket.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err == nil {
+				c.Receive(buf[:n], socket.RemoteAddr())
+			}
+		}
+	}()
+	return c
+}
+
+func TestUDPListenerRequiresCookie(t *testing.T) {
+	listener, err := listenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	l := listener.(*udpListener)
+
+	// A first segment gets only a cookie back, no larger than itself
+	socket, err := net.Dial("udp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	first := protocol.EncodeUDPPacket(protocol.UDPPacket{Kind: protocol.UDPData, ID: 9, Seq: 1, Payload: make([]byte, protocol.UDPCookieSize)}, nil)
+	if _, err := socket.Write(first); err != nil {
+		t.Fatal(err)
+	}
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := socket.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, ok := protocol.DecodeUDPPacket(buf[:n], nil)
+	if !ok || reply.Kind != protocol.UDPCookie || n > len(first) {
+		t.Fatalf("reply %x to a first segment, want a cookie of at most %d bytes", buf[:n], len(first))
+	}
+	l.mu.Lock()
+	conns := len(l.conns)
+	l.mu.Unlock()
+	if conns != 0 {
+		t.Fatal("listener kept state before the cookie came back")
+	}
+
+	// A cookie is only good for the address it was sent to
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	if l.validCookie(9, other, reply.Payload) || !l.validCookie(9, socket.LocalAddr(), reply.Payload) {
+		t.Fatal("cookie not bound to the client address")
+	}
+
+	// A segment keyed with anything but the cookie gets nothing
+	forged := protocol.EncodeUDPPacket(protocol.UDPPacket{Kind: protocol.UDPData, ID: 9, Seq: 1, Payload: make([]byte, protocol.UDPCookieSize)}, bytes.Repeat([]byte{9}, protocol.UDPCookieSize))
+	if _, err := socket.Write(forged); err != nil {
+		t.Fatal(err)
+	}
+	socket.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := socket.Read(buf); err == nil {
+		t.Fatalf("reply %x to a segment keyed with a forged cookie", buf[:n])
+	}
+
+	// A client that echoes the cookie gets through
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	client := dialTestUDP(t, listener.Addr().String(), 10)
+	defer client.Close()
+	if _, err := client.Write([]byte("a first segment at least as long as a cookie")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got := make([]byte, 64)
+		n, err := conn.Read(got)
+		if err != nil || string(got[:n]) != "a first segment at least as long as a cookie" {
+			t.Fatalf("Read = %q, %v", got[:n], err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not accepted")
+	}
+}
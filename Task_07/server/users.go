@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// A user store is a JSON file mapping usernames to the hex SHA-256 hash of
+// their password, and optionally the hex SHA-256 hashes of bearer tokens
+// for the HTTP bridge to their users:
+//
+//	{
+//	  "users": {"user1": "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"},
+//	  "tokens": {"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08": "user1"}
+//	}
+//
+// Without one the server knows only the built-in user.
+type userStore struct {
+	Users  map[string]string `json:"users"`
+	Tokens map[string]string `json:"tokens,omitempty"`
+}
+
+// users maps each username to its password hash.
+var users = map[string]string{storedUsername: storedPasswordHash}
+
+// tokens maps the hash of each bearer token to its user.
+var tokens = map[string]string{}
+
+func loadUserStore(path string) (userStore, error) {
+	var store userStore
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return store, fmt.Errorf("reading user store: %w", err)
+	}
+	if err := json.Unmarshal(data, &store); err != nil {
+		return store, fmt.Errorf("reading user store %s: %w", path, err)
+	}
+	if len(store.Users) == 0 {
+		return store, fmt.Errorf("user store %s has no users", path)
+	}
+	for username, passwordHash := range store.Users {
+		if decoded, err := hex.DecodeString(passwordHash); err != nil || len(decoded) != 32 {
+			return store, fmt.Errorf("user store %s: password hash of %s is not a hex SHA-256 hash", path, username)
+		}
+	}
+	for tokenHash, username := range store.Tokens {
+		if decoded, err := hex.DecodeString(tokenHash); err != nil || len(decoded) != 32 {
+			return store, fmt.Errorf("user store %s: token of %s is not a hex SHA-256 hash", path, username)
+		}
+		if _, ok := store.Users[username]; !ok {
+			return store, fmt.Errorf("user store %s: token for unknown user %s", path, username)
+		}
+	}
+	if store.Tokens == nil {
+		store.Tokens = map[string]string{}
+	}
+	return store, nil
+}
+
+func passwordHashFor(username string) (string, bool) {
+	passwordHash, ok := users[username]
+	return passwordHash, ok
+}
+
+// tokenUser returns the user a bearer token belongs to.
+func tokenUser(token string) (string, bool) {
+	sum := sha256.Sum256([]byte(token))
+	username, ok := tokens[hex.EncodeToString(sum[:])]
+	return username, ok
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket (RFC 6455) opcodes and close codes
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+
+	wsCloseNormal          = 1000
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupportedData = 1003
+	wsCloseTooBig          = 1009
+
+	// Room for envelope headers around a frame of the maximum size
+	wsFrameSlack = 1 << 16
+)
+
+// upgradeWebSocket completes the opening handshake for r and takes over
+// its connection. If the request is not a valid upgrade it answers with an
+// HTTP error instead.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	fail := func(status int, reason string) error {
+		http.Error(w, reason, status)
+		return errors.New(reason)
+	}
+	if r.Method != http.MethodGet {
+		return nil, fail(http.StatusMethodNotAllowed, "WebSocket upgrade needs GET")
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return nil, fail(http.StatusBadRequest, "Not a WebSocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, fail(http.StatusUpgradeRequired, "Unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		return nil, fail(http.StatusBadRequest, "Bad Sec-WebSocket-Key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fail(http.StatusInternalServerError, "Connection cannot be upgraded")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// Drop the deadlines the HTTP server set; handleConnection sets its own
+	conn.SetDeadline(time.Time{})
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{Conn: conn, reader: rw.Reader}, nil
+}
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether the comma-separated header name contains
+// token, ignoring case.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn carries the protocol over a WebSocket connection. It implements
+// net.Conn: Read returns the payloads of binary messages in order, and each
+// Write, which is one protocol frame, is sent as one binary message.
+type wsConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	pending   []byte // unread payload of the last data frame
+	inMessage bool   // a fragmented message is being received
+	readErr   error
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.readFrame(); err != nil {
+			c.readErr = err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readFrame reads one WebSocket frame, answering control frames itself.
+func (c *wsConn) readFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		return c.fail(wsCloseProtocolError, "reserved bits set")
+	}
+	if header[1]&0x80 == 0 {
+		return c.fail(wsCloseProtocolError, "client frames must be masked")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if opcode >= wsClose && (!fin || length > 125) {
+		return c.fail(wsCloseProtocolError, "bad control frame")
+	}
+	if length > uint64(cfg.Limits.MaxFrameSize)+wsFrameSlack {
+		return c.fail(wsCloseTooBig, fmt.Sprintf("frame of %d bytes is too large", length))
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	switch opcode {
+	case wsBinary, wsContinuation:
+		if (opcode == wsContinuation) != c.inMessage {
+			return c.fail(wsCloseProtocolError, "unexpected continuation frame")
+		}
+		c.inMessage = !fin
+		c.pending = payload
+	case wsText:
+		return c.fail(wsCloseUnsupportedData, "only binary messages carry frames")
+	case wsPing:
+		return c.writeFrame(wsPong, payload)
+	case wsPong:
+	case wsClose:
+		// Echo the status code and end the stream
+		c.writeFrame(wsClose, payload[:min(len(payload), 2)])
+		return io.EOF
+	default:
+		return c.fail(wsCloseProtocolError, fmt.Sprintf("unknown opcode 0x%X", opcode))
+	}
+	return nil
+}
+
+// fail closes the WebSocket with code and returns reason as an error.
+func (c *wsConn) fail(code uint16, reason string) error {
+	c.writeClose(code, reason)
+	return errors.New("websocket: " + reason)
+}
+
+func (c *wsConn) writeClose(code uint16, reason string) error {
+	return c.writeFrame(wsClose, append(binary.BigEndian.AppendUint16(nil, code), reason...))
+}
+
+// writeFrame sends one unmasked, unfragmented frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = binary.BigEndian.AppendUint16(append(frame, 126), uint16(len(payload)))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 127), uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	if opcode == wsClose {
+		c.closeSent = true
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	c.writeClose(wsCloseNormal, "")
+	return c.Conn.Close()
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// maskedFrame encodes a frame the way a browser sends it.
+func maskedFrame(fin bool, opcode byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(len(payload)))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(len(payload)))
+	}
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readServerFrame reads one frame sent by wsConn, which must be unmasked.
+func readServerFrame(reader *bufio.Reader) (wsFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return wsFrame{}, err
+	}
+	if header[1]&0x80 != 0 {
+		return wsFrame{}, errors.New("server frame is masked")
+	}
+	length := uint64(header[1])
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return wsFrame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return wsFrame{}, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return wsFrame{}, err
+	}
+	return wsFrame{fin: header[0]&0x80 != 0, opcode: header[0] & 0x0f, payload: payload}, nil
+}
+
+// wsPipe returns a wsConn and the frames it sends. The client frames are
+// written to it in order.
+func wsPipe(t *testing.T, client ...[]byte) (*wsConn, <-chan wsFrame) {
+	t.Helper()
+	clientEnd, serverEnd := net.Pipe()
+	t.Cleanup(func() {
+		clientEnd.Close()
+		serverEnd.Close()
+	})
+	go func() {
+		for _, frame := range client {
+			if _, err := clientEnd.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+	frames := make(chan wsFrame, 16)
+	go func() {
+		defer close(frames)
+		reader := bufio.NewReader(clientEnd)
+		for {
+			frame, err := readServerFrame(reader)
+			if err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+	return &wsConn{Conn: serverEnd, reader: bufio.NewReader(serverEnd)}, frames
+}
+
+func nextFrame(t *testing.T, frames <-chan wsFrame) wsFrame {
+	t.Helper()
+	select {
+	case frame, ok := <-frames:
+		if !ok {
+			t.Fatal("no frame from the server")
+		}
+		return frame
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a frame from the server")
+	}
+	return wsFrame{}
+}
+
+// expectClose checks that the server closed the WebSocket with code.
+func expectClose(t *testing.T, frames <-chan wsFrame, code uint16) {
+	t.Helper()
+	frame := nextFrame(t, frames)
+	if frame.opcode != wsClose || len(frame.payload) < 2 || binary.BigEndian.Uint16(frame.payload) != code {
+		t.Fatalf("server sent opcode 0x%X %x, want close %d", frame.opcode, frame.payload, code)
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	accepted := make(chan net.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := upgradeWebSocket(w, r); err == nil {
+			accepted <- conn
+		}
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The example handshake in RFC 6455, section 1.3
+	request := "GET /ws HTTP/1.1\r\n" +
+		"Host: example\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("response %s, accept %q", response.Status, response.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	var upgraded net.Conn
+	select {
+	case upgraded = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upgrade not accepted")
+	}
+	defer upgraded.Close()
+	if _, err := conn.Write(maskedFrame(true, wsBinary, []byte("over the socket"))); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := upgraded.Read(buf)
+	if err != nil || string(buf[:n]) != "over the socket" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+}
+
+func TestWebSocketRejectsBadUpgrades(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgradeWebSocket(w, r)
+	}))
+	defer server.Close()
+
+	valid := http.Header{
+		"Upgrade":               {"websocket"},
+		"Connection":            {"Upgrade"},
+		"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+		"Sec-Websocket-Version": {"13"},
+	}
+	tests := []struct {
+		name   string
+		method string
+		change func(http.Header)
+		status int
+	}{
+		{"POST", http.MethodPost, func(http.Header) {}, http.StatusMethodNotAllowed},
+		{"no upgrade", http.MethodGet, func(h http.Header) { h.Del("Upgrade") }, http.StatusBadRequest},
+		{"old version", http.MethodGet, func(h http.Header) { h.Set("Sec-WebSocket-Version", "8") }, http.StatusUpgradeRequired},
+		{"short key", http.MethodGet, func(h http.Header) { h.Set("Sec-WebSocket-Key", "c2hvcnQ=") }, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		request, err := http.NewRequest(tt.method, server.URL+webSocketPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header = valid.Clone()
+		tt.change(request.Header)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, response.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestWebSocketFragmentedMessage(t *testing.T) {
+	conn, frames := wsPipe(t,
+		maskedFrame(false, wsBinary, []byte("frag")),
+		// Control frames may come between the fragments
+		maskedFrame(true, wsPing, []byte("are you there")),
+		maskedFrame(false, wsContinuation, []byte("mented ")),
+		maskedFrame(true, wsContinuation, []byte("message")),
+	)
+	got := make([]byte, len("fragmented message"))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "fragmented message" {
+		t.Fatalf("Read %q", got)
+	}
+	if pong := nextFrame(t, frames); pong.opcode != wsPong || string(pong.payload) != "are you there" {
+		t.Fatalf("ping answered with opcode 0x%X %q", pong.opcode, pong.payload)
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	conn, frames := wsPipe(t, maskedFrame(true, wsClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal)))
+	if _, err := conn.Read(make([]byte, 16)); err != io.EOF {
+		t.Fatalf("Read after close: %v, want EOF", err)
+	}
+	expectClose(t, frames, wsCloseNormal)
+	if _, err := conn.Write([]byte{0x01}); err == nil {
+		t.Fatal("Write succeeded after the close handshake")
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	unmasked := maskedFrame(true, wsBinary, []byte("plain"))
+	unmasked[1] &^= 0x80
+	unmasked = append(unmasked[:2], []byte("plain")...)
+	tooLarge := binary.BigEndian.AppendUint64([]byte{0x80 | wsBinary, 0x80 | 127}, uint64(cfg.Limits.MaxFrameSize)+wsFrameSlack+1)
+	tests := []struct {
+		name  string
+		frame []byte
+		code  uint16
+	}{
+		{"unmasked", unmasked, wsCloseProtocolError},
+		{"reserved bits", append([]byte{0x40}, maskedFrame(true, wsBinary, nil)[1:]...), wsCloseProtocolError},
+		{"continuation first", maskedFrame(true, wsContinuation, []byte("x")), wsCloseProtocolError},
+		{"fragmented ping", maskedFrame(false, wsPing, nil), wsCloseProtocolError},
+		{"long ping", maskedFrame(true, wsPing, make([]byte, 126)), wsCloseProtocolError},
+		{"text", maskedFrame(true, wsText, []byte("hi")), wsCloseUnsupportedData},
+		{"unknown opcode", maskedFrame(true, 0x3, nil), wsCloseProtocolError},
+		// Refused from the header alone, before the payload is read
+		{"too large", tooLarge, wsCloseTooBig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, frames := wsPipe(t, tt.frame)
+			if _, err := conn.Read(make([]byte, 16)); err == nil || !strings.HasPrefix(err.Error(), "websocket: ") {
+				t.Fatalf("Read: %v, want a websocket error", err)
+			}
+			expectClose(t, frames, tt.code)
+		})
+	}
+}
+
+func TestWebSocketWriteIsOneMessage(t *testing.T) {
+	conn, frames := wsPipe(t)
+	// One size for each of the three length encodings
+	for _, size := range []int{125, 126, 0x10000} {
+		frame := bytes.Repeat([]byte{0x2A}, size)
+		go conn.Write(frame)
+		got := nextFrame(t, frames)
+		if !got.fin || got.opcode != wsBinary || !bytes.Equal(got.payload, frame) {
+			t.Fatalf("Write of %d bytes sent fin %v opcode 0x%X with %d bytes", size, got.fin, got.opcode, len(got.payload))
+		}
+	}
+}